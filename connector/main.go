@@ -2,33 +2,31 @@ package main
 
 import (
 	"bytes"
-	"crypto/rsa"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"evoting/pbft"
+	"evoting/transport"
+
 	"github.com/gorilla/mux"
 )
 
-type Node struct {
-	Address    string         `json:"address"`
-	Port       int            `json:"port"`
-	Type       string         `json:"node-type"`
-	Identifier string         `json:"node-id"`
-	PublicKey  *rsa.PublicKey `json:"public-key"`
-}
-
-type Blockchain struct {
-	Chain      []Block `json:"chain"`
-	Identifier string  `json:"node-id"`
-}
+// Nodes are described the same way as by the replicas, including their public keys.
+type Node = pbft.Node
 
 type Block struct {
 	Identifier        int           `json:"id"`
@@ -42,28 +40,136 @@ type Transaction struct {
 	ToId    string `json:"ToId"`
 }
 
+type TransactionInfo struct {
+	Transaction Transaction `json:"transaction"`
+	BlockId     int         `json:"block-id"`
+	BlockHash   string      `json:"block-hash"`
+}
+
+type VerifyResult struct {
+	Transaction
+	BlockId        int      `json:"block-id"`
+	BlockHash      string   `json:"block-hash"`
+	DivergentNodes []string `json:"divergent-nodes,omitempty"`
+}
+
+type RejectReason struct {
+	TokenId string `json:"Token"`
+	Reason  string `json:"reason"`
+}
+
+type RequestResult struct {
+	BlockId   int            `json:"block-id"`
+	Status    string         `json:"status"` // pending / committed / rejected / failed
+	BlockHash string         `json:"block-hash,omitempty"`
+	Reasons   []RejectReason `json:"reasons,omitempty"`
+}
+
+type RequestStatus struct {
+	RequestId string         `json:"request-id"`
+	Status    string         `json:"status"` // pending / committed / rejected / failed, or expired (pow, see pow.go)
+	BlockId   int            `json:"block-id"`
+	BlockHash string         `json:"block-hash,omitempty"`
+	Reasons   []RejectReason `json:"reasons,omitempty"`
+}
+
+type ClientRequest struct {
+	RequestId    string        `json:"request-id"` // replicas deduplicate retransmitted requests by this id
+	Transactions []Transaction `json:"transactions"`
+	Callbacks    []string      `json:"callbacks,omitempty"`
+}
+
+type Webhook struct {
+	URL string `json:"url"`
+}
+
+// global webhooks, invoked for every committed request
+var webhooks []Webhook
+var webhooksMutex sync.Mutex
+
+type SubmittedRequest struct {
+	ClientId  string // client node tracking the request
+	BlockId   int
+	Tokens    []string // pow: tokens of the transactions, the status is read from the chain (see pow.go)
+	Submitted time.Time
+}
+
+const (
+	requestRetention   time.Duration = 24 * time.Hour // statuses of submitted requests are kept this long
+	maxTrackedRequests int           = 100000         // ... or dropped earlier, oldest first, once more are tracked
+)
+
+// request id -> submitted request
+var submittedRequests = make(map[string]SubmittedRequest)
+var submittedOrder []string // request ids in order of submission
+var submittedMutex sync.Mutex
+
+func trackRequest(requestId string, submitted SubmittedRequest) {
+	// Records a submitted request for /status, drops the requests tracked for too long.
+	submittedMutex.Lock()
+	defer submittedMutex.Unlock()
+
+	submitted.Submitted = time.Now()
+	submittedRequests[requestId] = submitted
+	submittedOrder = append(submittedOrder, requestId)
+
+	for len(submittedOrder) > 0 {
+		oldest := submittedOrder[0]
+		if len(submittedOrder) <= maxTrackedRequests && time.Since(submittedRequests[oldest].Submitted) < requestRetention {
+			return
+		}
+		submittedOrder = submittedOrder[1:]
+		delete(submittedRequests, oldest)
+	}
+}
+
+func NewRequestId() string {
+	id := make([]byte, 16)
+	crand.Read(id)
+	return hex.EncodeToString(id)
+}
+
 type VotingParty struct {
 	Identifier string `json:"id"`
 }
 
 type Results struct {
+	Height     int            `json:"height"` // chain height the tally reflects
+	BlockId    int            `json:"block-id"`
+	BlockHash  string         `json:"block-hash"`
 	TotalVotes int            `json:"total-votes"`
 	Votes      map[string]int `json:"results"`
-}
 
-func (n Node) String() string {
-	return fmt.Sprintf("%v:%v", n.Address, n.Port)
+	DivergentNodes []string `json:"divergent-nodes,omitempty"` // replicas not agreeing with the others
 }
 
-func RandomNode(nodes []Node) Node {
-	rand.Seed(time.Now().Unix())
-	n := rand.Int() % len(nodes)
-	return nodes[n]
+const defaultWaitTimeout int = 10 // seconds
+
+// static cluster config (-cluster flag), nil if node discovery is used
+var cluster *pbft.ClusterConfig
+
+func StaticNodes(nodeType string) ([]Node, bool) {
+	/*
+		Returns nodes of given type from the static cluster config, with the public keys the replicas are verified against.
+		The second return value is false if no static config is used.
+	*/
+	if cluster == nil {
+		return nil, false
+	}
+
+	if nodeType == "client" {
+		return cluster.ClientNodes(), true
+	}
+	return cluster.BlockchainNodes(), true
 }
 
 func ClientNodes(ndAddr string) []Node {
+	if nodes, static := StaticNodes("client"); static {
+		return nodes
+	}
+
 	var clients []Node
-	req, err := http.Get(fmt.Sprintf("http://%v/get-clients", ndAddr))
+	req, err := transport.Get(ndAddr, "get-clients")
 	if err != nil {
 		fmt.Println("[ERROR] cant connect to node discovery")
 		return nil
@@ -79,8 +185,12 @@ func ClientNodes(ndAddr string) []Node {
 }
 
 func BlockchainNodes(ndAddr string) []Node {
+	if nodes, static := StaticNodes("blockchain"); static {
+		return nodes
+	}
+
 	var nodes []Node
-	req, err := http.Get(fmt.Sprintf("http://%v/get-blockchain", ndAddr))
+	req, err := transport.Get(ndAddr, "get-blockchain")
 	if err != nil {
 		fmt.Println("[ERROR] cant connect to node discovery")
 		return nil
@@ -95,86 +205,61 @@ func BlockchainNodes(ndAddr string) []Node {
 	return nodes
 }
 
-func ReconstructBlockchain(r io.ReadCloser) (Blockchain, error) {
-	var bc Blockchain
-	decodingErr := json.NewDecoder(r).Decode(&bc)
-
-	if decodingErr != nil {
-		return Blockchain{}, decodingErr
+func Statistics() (Results, error) {
+	// Tally agreed on by f+1 replicas, see reads.go.
+	quorum, err := NewReadQuorum()
+	if err != nil {
+		return Results{}, err
 	}
 
-	return bc, nil
-}
-
-func GetBlockchainFromNode(n Node) (Blockchain, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%v/chain", n))
+	statusCode, body, err := quorum.Read(fmt.Sprintf("tally?height=%v", quorum.Height))
 	if err != nil {
-		fmt.Println("[ERROR] could not connect to peer", err.Error())
-		return Blockchain{}, err
+		return Results{}, err
 	}
-
-	bc, decodingErr := ReconstructBlockchain(resp.Body)
-	if decodingErr != nil {
-		fmt.Println("[ERROR] could not parse blockchain data", decodingErr.Error())
-		return Blockchain{}, decodingErr
+	if statusCode != http.StatusOK {
+		return Results{}, fmt.Errorf("blockchain nodes responded with status code %v", statusCode)
 	}
 
-	return bc, nil
-}
-
-func Statistics(bc Blockchain) Results {
-	var res Results
-	res.Votes = make(map[string]int)
-
-	for _, block := range bc.Chain {
-		res.TotalVotes += len(block.Transactions)
-		for _, t := range block.Transactions {
-			res.Votes[t.ToId] += 1
-		}
+	var tally Results
+	if err := json.Unmarshal(body, &tally); err != nil {
+		return Results{}, err
 	}
 
-	return res
+	tally.DivergentNodes = quorum.Divergent
+	return tally, nil
 }
 
-func BlockchainFromRandomNode() (Blockchain, error) {
-	ndAddr := NodeDiscoveryAddress()
-	nodes := BlockchainNodes(ndAddr)
-	n := RandomNode(nodes)
+var errTransactionNotFound = errors.New("transaction of given id not found")
 
-	bc, err := GetBlockchainFromNode(n)
+func TransactionByToken(tokenId string) (VerifyResult, error) {
+	// Transaction agreed on by f+1 replicas, see reads.go.
+	quorum, err := NewReadQuorum()
 	if err != nil {
-		return Blockchain{}, err
+		return VerifyResult{}, err
 	}
-	return bc, nil
+	return quorum.Transaction(tokenId)
 }
 
-func StatisticsFromRandomNode() (Results, error) {
-	bc, err := BlockchainFromRandomNode()
-
+func (quorum *ReadQuorum) Transaction(tokenId string) (VerifyResult, error) {
+	// Transaction in the chain up to the common height.
+	statusCode, body, err := quorum.Read(fmt.Sprintf("tx/%v?height=%v", url.PathEscape(tokenId), quorum.Height))
 	if err != nil {
-		return Results{}, err
+		return VerifyResult{}, err
 	}
 
-	results := Statistics(bc)
-	return results, nil
-}
-
-func TransactionByToken(tokenId string) (Transaction, error) {
-	bc, err := BlockchainFromRandomNode()
-
-	if err != nil {
-		return Transaction{}, err
+	if statusCode == http.StatusNotFound {
+		return VerifyResult{}, errTransactionNotFound
+	}
+	if statusCode != http.StatusOK {
+		return VerifyResult{}, fmt.Errorf("blockchain nodes responded with status code %v", statusCode)
 	}
 
-	for _, block := range bc.Chain {
-		for _, t := range block.Transactions {
-			if t.TokenId == tokenId {
-				return t, nil
-			}
-		}
+	var info TransactionInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return VerifyResult{}, err
 	}
 
-	return Transaction{}, errors.New("transaction of given id not found")
+	return VerifyResult{Transaction: info.Transaction, BlockId: info.BlockId, BlockHash: info.BlockHash, DivergentNodes: quorum.Divergent}, nil
 }
 
 func JsonBodyPadding(message string) string {
@@ -206,6 +291,11 @@ func HttpAddData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if PowBackend() {
+		addPowData(w, r, transactions)
+		return
+	}
+
 	ndAddr := NodeDiscoveryAddress()
 
 	clientNodes := ClientNodes(ndAddr)
@@ -216,15 +306,45 @@ func HttpAddData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := RandomNode(clientNodes)
+	client := pbft.RandomNode(clientNodes)
+
+	/*
+		?wait=true - blocking mode, the response is sent once the request is committed / rejected
+		(or after timeout seconds, the status is pending then)
+	*/
+	endpoint := "submit"
+	requestClient := transport.ClientWithTimeout(10 * time.Second)
+	if r.URL.Query().Get("wait") == "true" {
+		timeout, err := strconv.Atoi(r.URL.Query().Get("timeout"))
+		if err != nil || timeout <= 0 {
+			timeout = defaultWaitTimeout
+		}
+		endpoint = fmt.Sprintf("submit?wait=true&timeout=%v", timeout)
+		requestClient = transport.ClientWithTimeout(time.Duration(timeout+5) * time.Second)
+	}
+
+	requestId := NewRequestId()
+	clientRequest := ClientRequest{RequestId: requestId, Transactions: transactions}
+	if callback := r.URL.Query().Get("callback"); callback != "" {
+		if err := pbft.ValidateCallback(callback); err != nil {
+			http.Error(w, JsonBodyPadding(err.Error()), http.StatusBadRequest)
+			return
+		}
+		clientRequest.Callbacks = append(clientRequest.Callbacks, callback)
+	}
+	webhooksMutex.Lock()
+	for _, hook := range webhooks {
+		clientRequest.Callbacks = append(clientRequest.Callbacks, hook.URL)
+	}
+	webhooksMutex.Unlock()
 
-	transactionsJson, _ := json.Marshal(transactions)
-	reqbody := fmt.Sprintf("{\"transactions\":%v}", string(transactionsJson))
-	response, error := http.Post(fmt.Sprintf("http://%v/new-request", client), "application/json", bytes.NewBuffer([]byte(reqbody)))
+	reqbody, _ := json.Marshal(clientRequest)
+	response, error := requestClient.Post(transport.NodeURL(client.String(), endpoint), "application/json", bytes.NewBuffer(reqbody))
 
 	if error != nil {
 		fmt.Println("[ERROR] can't connect to blockchain client:", client, error.Error())
 		http.Error(w, "an error occured when making a request to blockchain client", http.StatusInternalServerError)
+		return
 	}
 
 	if response.StatusCode != http.StatusOK {
@@ -234,8 +354,171 @@ func HttpAddData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var result RequestResult
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		fmt.Println("[ERROR] cant parse blockchain client response", err.Error())
+		http.Error(w, "blockchain client response cant be parsed", http.StatusInternalServerError)
+		return
+	}
+
+	trackRequest(requestId, SubmittedRequest{ClientId: client.Identifier, BlockId: result.BlockId})
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(JsonBodyPadding("request submitted to the blockchain"))
+	json.NewEncoder(w).Encode(RequestStatus{RequestId: requestId, Status: result.Status, BlockId: result.BlockId, BlockHash: result.BlockHash, Reasons: result.Reasons})
+}
+
+func authorizeWebhooks(w http.ResponseWriter, r *http.Request) bool {
+	/*
+		webhooks are managed by the operator of the web application only, authenticated by the token set in
+		WEBHOOK_TOKEN ("Authorization: Bearer <token>") - without the token the endpoints are disabled
+	*/
+	token := os.Getenv("WEBHOOK_TOKEN")
+	if token == "" {
+		http.Error(w, JsonBodyPadding("webhooks are disabled, WEBHOOK_TOKEN is not set"), http.StatusForbidden)
+		return false
+	}
+
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		http.Error(w, JsonBodyPadding("incorrect webhook token"), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func HttpRegisterWebhook(w http.ResponseWriter, r *http.Request) {
+	/*
+		register a global webhook invoked for every committed request
+	*/
+	if !authorizeWebhooks(w, r) {
+		return
+	}
+
+	var hook Webhook
+	decodingErr := json.NewDecoder(r.Body).Decode(&hook)
+	if decodingErr != nil {
+		http.Error(w, JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	if err := pbft.ValidateCallback(hook.URL); err != nil {
+		http.Error(w, JsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+
+	exists := false
+	for _, existing := range webhooks {
+		exists = exists || existing == hook
+	}
+	if !exists {
+		webhooks = append(webhooks, hook)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+func HttpGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !authorizeWebhooks(w, r) {
+		return
+	}
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+func HttpDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if !authorizeWebhooks(w, r) {
+		return
+	}
+
+	var hook Webhook
+	decodingErr := json.NewDecoder(r.Body).Decode(&hook)
+	if decodingErr != nil {
+		http.Error(w, JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+
+	var remaining []Webhook
+	for _, existing := range webhooks {
+		if existing != hook {
+			remaining = append(remaining, existing)
+		}
+	}
+	webhooks = remaining
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+func HttpGetStatus(w http.ResponseWriter, r *http.Request) {
+	/*
+		status of a submitted request (pending / committed / rejected with reasons / failed), as tracked by the client node
+	*/
+	w.Header().Set("Content-Type", "application/json")
+	requestId := mux.Vars(r)["id"]
+
+	submittedMutex.Lock()
+	submitted, exists := submittedRequests[requestId]
+	submittedMutex.Unlock()
+
+	if !exists {
+		http.Error(w, JsonBodyPadding("request not found"), http.StatusNotFound)
+		return
+	}
+
+	if submitted.Tokens != nil {
+		status, err := powStatus(requestId, submitted)
+		if err != nil {
+			fmt.Println("[ERROR] cant read request status:", err.Error())
+			http.Error(w, JsonBodyPadding("cant read request status"), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
+	var client Node
+	for _, n := range ClientNodes(NodeDiscoveryAddress()) {
+		if n.Identifier == submitted.ClientId {
+			client = n
+		}
+	}
+
+	if client.Identifier == "" {
+		http.Error(w, JsonBodyPadding("client node not found"), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := transport.Get(client.String(), fmt.Sprintf("result/%v", submitted.BlockId))
+	if err != nil {
+		fmt.Println("[ERROR] can't connect to blockchain client:", client, err.Error())
+		http.Error(w, JsonBodyPadding("cant connect to blockchain client"), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, JsonBodyPadding("request not found"), http.StatusNotFound)
+		return
+	}
+
+	var result RequestResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		http.Error(w, JsonBodyPadding("blockchain client response cant be parsed"), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(RequestStatus{RequestId: requestId, Status: result.Status, BlockId: result.BlockId, BlockHash: result.BlockHash, Reasons: result.Reasons})
 }
 
 func HttpAddVotingParty(w http.ResponseWriter, r *http.Request) {
@@ -254,7 +537,7 @@ func HttpAddVotingParty(w http.ResponseWriter, r *http.Request) {
 	ndAddr := NodeDiscoveryAddress()
 
 	msgBuffer, _ := json.Marshal(newParty)
-	resp, err := http.Post(fmt.Sprintf("http://%v/register-party", ndAddr), "application/json", bytes.NewBuffer(msgBuffer))
+	resp, err := transport.Post(ndAddr, "register-party", msgBuffer)
 
 	if err != nil || resp.StatusCode != http.StatusOK {
 		if err != nil {
@@ -272,7 +555,7 @@ func HttpAddVotingParty(w http.ResponseWriter, r *http.Request) {
 }
 
 func HttpGetStatistics(w http.ResponseWriter, r *http.Request) {
-	stats, err := StatisticsFromRandomNode()
+	stats, err := Statistics()
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -299,9 +582,13 @@ func HttpVerifyByToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	transaction, err := TransactionByToken(tToken.TokenId)
-	if err != nil {
+	if err == errTransactionNotFound {
 		http.Error(w, JsonBodyPadding("token not found"), http.StatusNotFound)
 		return
+	} else if err != nil {
+		fmt.Println("[ERROR] failed to verify token", err.Error())
+		http.Error(w, JsonBodyPadding("failed to verify token"), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -312,15 +599,37 @@ func Handler(port int) {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/statistics", HttpGetStatistics).Methods("GET")
+	r.HandleFunc("/stream", HttpStream).Methods("GET")
 
 	r.HandleFunc("/add-data", HttpAddData).Methods("POST")
+	r.HandleFunc("/status/{id}", HttpGetStatus).Methods("GET")
+	r.HandleFunc("/webhooks", HttpGetWebhooks).Methods("GET")
+	r.HandleFunc("/webhooks", HttpRegisterWebhook).Methods("POST")
+	r.HandleFunc("/webhooks", HttpDeleteWebhook).Methods("DELETE")
 	r.HandleFunc("/add-voting-party", HttpAddVotingParty).Methods("POST")
 	r.HandleFunc("/verify", HttpVerifyByToken).Methods("POST")
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), r))
+	log.Fatal(transport.ListenAndServePublic(port, r))
 }
 
 func main() {
+	clusterPtr := flag.String("cluster", "", "static cluster config (JSON) shared with the replicas, replaces node discovery")
+	flag.Parse()
+
+	if *clusterPtr != "" {
+		config, err := pbft.LoadClusterConfig(*clusterPtr)
+		if err != nil {
+			log.Fatal("[ERROR] ", err.Error())
+		}
+		cluster = config
+	}
+
+	if err := transport.EnableFromEnv(); err != nil {
+		log.Fatal("[ERROR] failed to enable TLS: ", err.Error())
+	}
+
+	go stream.Run()
+
 	port := 1234
 	fmt.Println("[INFO] starting HTTP server on port", port)
 	Handler(port)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"evoting/pbft"
+	"evoting/transport"
+)
+
+/*
+Proof of Work backend, enabled with CONSENSUS=pow.
+There are no client nodes - transactions are submitted straight to a PoW node (/submit, like client nodes of the
+other engines), which mines them in the background. The status of a request is read from the chains of the
+blockchain nodes: it's committed once all of its transactions are stored in blocks buried under powConfirmations
+blocks, and expired if they aren't all mined within powExpiry - a transaction dropped from the mempool or orphaned by a
+reorganization is never mined. Reads, verification and the event stream use the API shared by all engines and work
+unchanged.
+Callbacks and webhooks are not supported, they are invoked by client nodes.
+*/
+
+func PowBackend() bool {
+	return os.Getenv("CONSENSUS") == "pow"
+}
+
+var errPowRejected = errors.New("transaction rejected")
+
+const (
+	powConfirmations int           = 6                // blocks mined on top of the last block of a request before it's committed
+	powExpiry        time.Duration = 30 * time.Minute // a request not mined by then is expired
+)
+
+func submitToPow(requestId string, transactions []Transaction) error {
+	nodes := BlockchainNodes(NodeDiscoveryAddress())
+	if len(nodes) == 0 {
+		return errors.New("no blockchain nodes found")
+	}
+
+	node := pbft.RandomNode(nodes)
+	reqbody, _ := json.Marshal(ClientRequest{RequestId: requestId, Transactions: transactions})
+	response, err := transport.Post(node.String(), "submit", reqbody)
+	if err != nil {
+		return fmt.Errorf("cant connect to blockchain node %v", node)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		fmt.Println("[ERROR] blockchain node error - response status code", response.StatusCode, ", body:", string(body))
+		if response.StatusCode == http.StatusBadRequest {
+			// invalid transaction or token already used, none of the transactions is added
+			var detail struct {
+				Detail string `json:"detail"`
+			}
+			json.Unmarshal(body, &detail)
+			return fmt.Errorf("%w: %v", errPowRejected, detail.Detail)
+		}
+		return errors.New("transactions not accepted by the blockchain")
+	}
+
+	return nil
+}
+
+func powStatus(requestId string, submitted SubmittedRequest) (RequestStatus, error) {
+	/*
+		Committed once every transaction is in the chain and the last block containing any of them is buried under
+		powConfirmations blocks, pending until then. Expired if some transaction isn't mined within powExpiry.
+	*/
+	quorum, err := NewReadQuorum()
+	if err != nil {
+		return RequestStatus{}, err
+	}
+
+	status := RequestStatus{RequestId: requestId, Status: "committed"}
+	for _, token := range submitted.Tokens {
+		result, err := quorum.Transaction(token)
+		if err == errTransactionNotFound {
+			if time.Since(submitted.Submitted) > powExpiry {
+				return RequestStatus{RequestId: requestId, Status: "expired"}, nil
+			}
+			return RequestStatus{RequestId: requestId, Status: "pending"}, nil
+		}
+		if err != nil {
+			return RequestStatus{}, err
+		}
+
+		if result.BlockId >= status.BlockId {
+			// the identifier of a PoW block is its height
+			status.BlockId, status.BlockHash = result.BlockId, result.BlockHash
+		}
+	}
+
+	if quorum.Height-status.BlockId < powConfirmations {
+		status.Status = "pending"
+	}
+	return status, nil
+}
+
+func addPowData(w http.ResponseWriter, r *http.Request, transactions []Transaction) {
+	if r.URL.Query().Get("callback") != "" {
+		http.Error(w, "callbacks are not supported with pow", http.StatusBadRequest)
+		return
+	}
+
+	if len(transactions) == 0 {
+		http.Error(w, "no transactions", http.StatusBadRequest)
+		return
+	}
+
+	requestId := NewRequestId()
+	if err := submitToPow(requestId, transactions); errors.Is(err, errPowRejected) {
+		http.Error(w, JsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		fmt.Println("[ERROR]", err.Error())
+		http.Error(w, "blockchain failed to add transaction data", http.StatusInternalServerError)
+		return
+	}
+
+	var tokens []string
+	for _, t := range transactions {
+		tokens = append(tokens, t.TokenId)
+	}
+
+	submitted := SubmittedRequest{Tokens: tokens, Submitted: time.Now()}
+	trackRequest(requestId, submitted)
+
+	status := RequestStatus{RequestId: requestId, Status: "pending"}
+	if r.URL.Query().Get("wait") == "true" {
+		// blocks are mined in the background, poll the chain until the timeout
+		timeout, err := strconv.Atoi(r.URL.Query().Get("timeout"))
+		if err != nil || timeout <= 0 {
+			timeout = defaultWaitTimeout
+		}
+
+		deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+		for status.Status == "pending" && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+			if current, err := powStatus(requestId, submitted); err == nil {
+				status = current
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
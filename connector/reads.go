@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"evoting/pbft"
+	"evoting/transport"
+)
+
+/*
+Byzantine fault tolerant reads.
+A single replica can't be trusted, so responses of at least 2f+1 replicas are collected and only a result reported
+by f+1 of them (at least one of which is correct) is accepted. Over TLS, every response has to come from the key
+registered for the replica (cluster config or node discovery). Before reading, the replicas are compared at a common
+height - replicas whose block at that height differs from the agreed one are reported as divergent and not read from.
+The reads are answered as of the common height, so replicas that have committed more blocks in the meantime still
+report the same result.
+*/
+
+type Height struct {
+	Height    int    `json:"height"`
+	BlockId   int    `json:"block-id"`
+	BlockHash string `json:"block-hash"`
+}
+
+type ReplicaResponse struct {
+	Node       Node
+	StatusCode int
+	Body       []byte
+	Err        error
+}
+
+type ReadQuorum struct {
+	Replicas  []Node   // replicas agreeing on the chain
+	Divergent []string // identifiers of replicas whose chain differs from the agreed one
+	Faulty    int      // maximum number of faulty replicas (f)
+	Height    int      // common height the replicas agree on, reads are made at this height
+}
+
+func QueryReplicas(nodes []Node, endpoint string) []ReplicaResponse {
+	// Sends the GET request to all nodes concurrently, responses are returned in order of the nodes.
+	responses := make([]ReplicaResponse, len(nodes))
+	done := make(chan bool)
+
+	for i, n := range nodes {
+		go func(i int, n Node) {
+			responses[i].Node = n
+			resp, err := transport.Get(n.String(), endpoint)
+			if err == nil {
+				if err = pbft.VerifyResponse(resp, n); err != nil {
+					resp.Body.Close()
+				}
+			}
+			if err != nil {
+				responses[i].Err = err
+			} else {
+				responses[i].StatusCode = resp.StatusCode
+				responses[i].Body, responses[i].Err = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			done <- true
+		}(i, n)
+	}
+
+	for range nodes {
+		<-done
+	}
+	return responses
+}
+
+func NewReadQuorum() (*ReadQuorum, error) {
+	nodes := BlockchainNodes(NodeDiscoveryAddress())
+	if len(nodes) == 0 {
+		return nil, errors.New("no blockchain nodes found")
+	}
+
+	quorum := ReadQuorum{Faulty: (len(nodes) - 1) / 3}
+	f := quorum.Faulty
+
+	var responding []Node
+	var heights []Height
+	for _, resp := range QueryReplicas(nodes, "height") {
+		var height Height
+		if resp.Err != nil || resp.StatusCode != http.StatusOK || json.Unmarshal(resp.Body, &height) != nil {
+			fmt.Println("[ERROR] replica", resp.Node.Identifier, "did not report its height")
+			continue
+		}
+		responding = append(responding, resp.Node)
+		heights = append(heights, height)
+	}
+
+	if len(responding) < 2*f+1 {
+		return nil, fmt.Errorf("only %v of %v replicas responded, %v required", len(responding), len(nodes), 2*f+1)
+	}
+
+	// common height - reached by at least f+1 replicas, so it can't be made up by faulty replicas alone
+	sorted := make([]int, len(heights))
+	for i, h := range heights {
+		sorted[i] = h.Height
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	common := sorted[f]
+	quorum.Height = common
+
+	// hash of every replica's block at the common height, lagging replicas can't be compared yet
+	hashes := make(map[string]string) // node id -> block hash
+	votes := make(map[string]int)     // block hash -> replicas
+	for i, n := range responding {
+		hash := heights[i].BlockHash
+		if heights[i].Height < common {
+			continue
+		} else if heights[i].Height > common {
+			hash = blockHashAt(n, common)
+		}
+		hashes[n.Identifier] = hash
+		votes[hash]++
+	}
+
+	agreed := ""
+	for hash, count := range votes {
+		if hash != "" && count > f && (agreed == "" || count > votes[agreed]) {
+			agreed = hash
+		}
+	}
+	if agreed == "" {
+		return nil, fmt.Errorf("replicas do not agree on the block at height %v", common)
+	}
+
+	for _, n := range responding {
+		if hash, compared := hashes[n.Identifier]; compared && hash != agreed {
+			fmt.Println("[ERROR] replica", n.Identifier, "diverges from the agreed chain at height", common)
+			quorum.Divergent = append(quorum.Divergent, n.Identifier)
+			continue
+		}
+		quorum.Replicas = append(quorum.Replicas, n)
+	}
+
+	return &quorum, nil
+}
+
+func blockHashAt(n Node, height int) string {
+	// Returns an empty string if the replica doesn't respond correctly.
+	resp, err := transport.Get(n.String(), fmt.Sprintf("height/%v", height))
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if pbft.VerifyResponse(resp, n) != nil {
+		return ""
+	}
+
+	var h Height
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&h) != nil {
+		return ""
+	}
+	return h.BlockHash
+}
+
+func (q *ReadQuorum) Read(endpoint string) (int, []byte, error) {
+	/*
+		Queries the agreeing replicas, returns the status code and the body of the response reported by most
+		of them, provided it was reported by at least f+1 replicas.
+	*/
+	type answer struct {
+		statusCode int
+		body       []byte
+		count      int
+	}
+	var answers []*answer
+
+	for _, resp := range QueryReplicas(q.Replicas, endpoint) {
+		if resp.Err != nil {
+			continue
+		}
+
+		body := bytes.TrimSpace(resp.Body)
+		found := false
+		for _, a := range answers {
+			if a.statusCode == resp.StatusCode && bytes.Equal(a.body, body) {
+				a.count++
+				found = true
+			}
+		}
+		if !found {
+			answers = append(answers, &answer{statusCode: resp.StatusCode, body: body, count: 1})
+		}
+	}
+
+	var best *answer
+	for _, a := range answers {
+		if best == nil || a.count > best.count {
+			best = a
+		}
+	}
+
+	if best == nil || best.count <= q.Faulty {
+		return 0, nil, fmt.Errorf("replicas do not agree on %v", endpoint)
+	}
+	return best.statusCode, best.body, nil
+}
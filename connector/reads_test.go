@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"evoting/pbft"
+
+	"github.com/gorilla/mux"
+)
+
+type fakeReplica struct {
+	chain []string // block hashes by height, block i > 0 holds the vote of token t<i> for party a
+	down  bool     // doesn't answer at all
+	lie   int      // if set, reports this many votes and wrong blocks for transactions
+}
+
+func chainOf(height int, fork string) []string {
+	// Block hashes of a chain of the given height, chains with a different fork name differ after the genesis block.
+	chain := []string{"genesis"}
+	for i := 1; i <= height; i++ {
+		chain = append(chain, fmt.Sprintf("%v%v", fork, i))
+	}
+	return chain
+}
+
+func (f fakeReplica) readHeight(w http.ResponseWriter, r *http.Request) (int, bool) {
+	height, err := strconv.Atoi(r.URL.Query().Get("height"))
+	if err != nil || height < 0 || height >= len(f.chain) {
+		http.Error(w, "height not reached", http.StatusNotFound)
+		return 0, false
+	}
+	return height, true
+}
+
+func (f fakeReplica) handler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/height", func(w http.ResponseWriter, r *http.Request) {
+		height := len(f.chain) - 1
+		json.NewEncoder(w).Encode(Height{Height: height, BlockId: height, BlockHash: f.chain[height]})
+	})
+	r.HandleFunc("/height/{height}", func(w http.ResponseWriter, r *http.Request) {
+		height, err := strconv.Atoi(mux.Vars(r)["height"])
+		if err != nil || height >= len(f.chain) {
+			http.Error(w, "height not reached", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(Height{Height: height, BlockId: height, BlockHash: f.chain[height]})
+	})
+	r.HandleFunc("/tally", func(w http.ResponseWriter, r *http.Request) {
+		height, ok := f.readHeight(w, r)
+		if !ok {
+			return
+		}
+		votes := height
+		if f.lie != 0 {
+			votes = f.lie
+		}
+		json.NewEncoder(w).Encode(Results{Height: height, BlockId: height, BlockHash: f.chain[height],
+			TotalVotes: votes, Votes: map[string]int{"a": votes}})
+	})
+	r.HandleFunc("/tx/{token}", func(w http.ResponseWriter, r *http.Request) {
+		height, ok := f.readHeight(w, r)
+		if !ok {
+			return
+		}
+		block, err := strconv.Atoi(strings.TrimPrefix(mux.Vars(r)["token"], "t"))
+		if err != nil || block < 1 || block > height {
+			http.Error(w, "transaction not found", http.StatusNotFound)
+			return
+		}
+		hash := f.chain[block]
+		if f.lie != 0 {
+			hash = fmt.Sprintf("forged%v", f.lie)
+		}
+		json.NewEncoder(w).Encode(TransactionInfo{Transaction: Transaction{TokenId: mux.Vars(r)["token"], ToId: "a"},
+			BlockId: block, BlockHash: hash})
+	})
+
+	if f.down {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		})
+	}
+	return r
+}
+
+func startReplicas(t *testing.T, replicas []fakeReplica) func() {
+	// Serves the replicas and points the static cluster config at them, returns a function stopping them.
+	signer, err := pbft.GenerateSigningKey(pbft.SchemeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var servers []*httptest.Server
+	cluster = &pbft.ClusterConfig{}
+	for i, replica := range replicas {
+		server := httptest.NewServer(replica.handler())
+		servers = append(servers, server)
+
+		_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		portNumber, _ := strconv.Atoi(port)
+		cluster.Nodes = append(cluster.Nodes, pbft.NodeConfig{Identifier: fmt.Sprintf("r%v", i), Address: "127.0.0.1",
+			Port: portNumber, Type: "blockchain", PublicKey: string(signer.Public())})
+	}
+
+	return func() {
+		for _, server := range servers {
+			server.Close()
+		}
+		cluster = nil
+	}
+}
+
+func TestReadQuorum(t *testing.T) {
+	tests := []struct {
+		name      string
+		replicas  []fakeReplica
+		height    int      // expected common height
+		divergent []string // expected divergent replicas
+		err       bool     // no quorum
+	}{
+		{
+			name:     "single replica",
+			replicas: []fakeReplica{{chain: chainOf(3, "x")}},
+			height:   3,
+		},
+		{
+			name:     "all replicas agree",
+			replicas: []fakeReplica{{chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}},
+			height:   4,
+		},
+		{
+			name:     "one replica ahead",
+			replicas: []fakeReplica{{chain: chainOf(6, "x")}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}},
+			height:   4,
+		},
+		{
+			name:     "one replica lagging",
+			replicas: []fakeReplica{{chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {chain: chainOf(2, "x")}},
+			height:   4,
+		},
+		{
+			name:     "replicas at different heights",
+			replicas: []fakeReplica{{chain: chainOf(7, "x")}, {chain: chainOf(6, "x")}, {chain: chainOf(5, "x")}, {chain: chainOf(4, "x")}},
+			height:   6,
+		},
+		{
+			name:      "one replica on another chain",
+			replicas:  []fakeReplica{{chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "y")}, {chain: chainOf(4, "x")}},
+			height:    4,
+			divergent: []string{"r2"},
+		},
+		{
+			name:     "one replica down",
+			replicas: []fakeReplica{{chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {down: true}},
+			height:   4,
+		},
+		{
+			name:     "one replica lying",
+			replicas: []fakeReplica{{chain: chainOf(4, "x"), lie: 1000}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}},
+			height:   4,
+		},
+		{
+			name:     "too many replicas down",
+			replicas: []fakeReplica{{chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {down: true}, {down: true}},
+			err:      true,
+		},
+		{
+			name:     "no agreement on the chain",
+			replicas: []fakeReplica{{chain: chainOf(4, "w")}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "y")}, {chain: chainOf(4, "z")}},
+			err:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stop := startReplicas(t, tt.replicas)
+			defer stop()
+
+			quorum, err := NewReadQuorum()
+			if tt.err {
+				if err == nil {
+					t.Fatalf("read quorum formed at height %v, want error", quorum.Height)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewReadQuorum: %v", err)
+			}
+
+			if quorum.Height != tt.height {
+				t.Fatalf("common height = %v, want %v", quorum.Height, tt.height)
+			}
+			if strings.Join(quorum.Divergent, ",") != strings.Join(tt.divergent, ",") {
+				t.Fatalf("divergent replicas = %v, want %v", quorum.Divergent, tt.divergent)
+			}
+
+			tally, err := Statistics()
+			if err != nil {
+				t.Fatalf("Statistics: %v", err)
+			}
+			if tally.Height != tt.height || tally.TotalVotes != tt.height || tally.Votes["a"] != tt.height {
+				t.Fatalf("tally = %+v, want %v votes at height %v", tally, tt.height, tt.height)
+			}
+
+			// transactions are read as of the common height
+			for block := 1; block <= tt.height+1; block++ {
+				token := fmt.Sprintf("t%v", block)
+				result, err := TransactionByToken(token)
+				if block > tt.height {
+					if err != errTransactionNotFound {
+						t.Fatalf("transaction %v above the common height: err = %v, want not found", token, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("transaction %v: %v", token, err)
+				}
+				if result.BlockId != block || result.BlockHash != chainOf(block, "x")[block] {
+					t.Fatalf("transaction %v in block %v (%v), want block %v", token, result.BlockId, result.BlockHash, block)
+				}
+			}
+		})
+	}
+}
+
+func TestReadDisagreement(t *testing.T) {
+	// with f = 1, a result has to be reported by two replicas
+	tests := []struct {
+		name     string
+		replicas []fakeReplica
+		err      bool
+	}{
+		{"honest majority", []fakeReplica{{chain: chainOf(4, "x"), lie: 1000}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x")}, {down: true}}, false},
+		{"every replica reports another result", []fakeReplica{{chain: chainOf(4, "x"), lie: 1000}, {chain: chainOf(4, "x")}, {chain: chainOf(4, "x"), lie: 2000}, {down: true}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stop := startReplicas(t, tt.replicas)
+			defer stop()
+
+			quorum, err := NewReadQuorum()
+			if err != nil {
+				t.Fatalf("NewReadQuorum: %v", err)
+			}
+			if _, err := quorum.Transaction("t1"); (err != nil) != tt.err {
+				t.Fatalf("Transaction error = %v, want error = %v", err, tt.err)
+			}
+			if _, _, err := quorum.Read(fmt.Sprintf("tally?height=%v", quorum.Height)); (err != nil) != tt.err {
+				t.Fatalf("Read error = %v, want error = %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"evoting/pbft"
+	"evoting/transport"
+)
+
+/*
+Live results streamed to the web application as server-sent events.
+The connector subscribes to the commit events of all replicas (GET /events on the replicas), an event is accepted
+once f+1 replicas sent the same one. The last streamHistory accepted events are kept, so a client may resume the
+stream by block id (the "from" query parameter or the standard Last-Event-ID header) - every event carries the whole
+tally, so a client resuming before the kept events only misses the blocks.
+Chains may be reorganized (PoW, PoA): a replica sends the events from the fork point on again. Once f+1 replicas sent
+a different event for an accepted block id, it replaces the accepted event and all later ones, and is streamed again
+with the same id - clients replace the blocks with that id and higher ones.
+*/
+
+const (
+	streamBuffer      = 100   // events buffered per client, slow clients are disconnected and have to resume
+	streamHistory     = 10000 // accepted events kept for resuming clients
+	streamKeepAlive   = 15 * time.Second
+	subscriptionRetry = 2 * time.Second
+	replicasRefresh   = 10 * time.Second
+)
+
+type StreamEvent struct {
+	BlockId int
+	Data    []byte // commit event as sent by the replicas
+}
+
+type EventStream struct {
+	mutex       sync.Mutex
+	reports     map[int]map[string]map[string]bool // block id -> event data -> replicas that sent it, pruned on acceptance
+	history     []StreamEvent                      // last accepted events, ordered by block id
+	subscribers map[chan StreamEvent]bool
+	replicas    map[string]bool // replicas subscribed to
+	faulty      int
+}
+
+var stream = NewEventStream()
+
+func NewEventStream() *EventStream {
+	var s EventStream
+	s.reports = make(map[int]map[string]map[string]bool)
+	s.subscribers = make(map[chan StreamEvent]bool)
+	s.replicas = make(map[string]bool)
+	return &s
+}
+
+func (s *EventStream) lastAccepted() int {
+	if len(s.history) == 0 {
+		return -1
+	}
+	return s.history[len(s.history)-1].BlockId
+}
+
+func (s *EventStream) accepted(blockId int) (StreamEvent, bool) {
+	// Accepted event with the given block id, if it's still kept.
+	i := sort.Search(len(s.history), func(i int) bool { return s.history[i].BlockId >= blockId })
+	if i < len(s.history) && s.history[i].BlockId == blockId {
+		return s.history[i], true
+	}
+	return StreamEvent{}, false
+}
+
+func (s *EventStream) Report(replicaId string, event StreamEvent) {
+	// Counts an event sent by a replica, accepts it once f+1 replicas sent it.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if event.BlockId <= s.lastAccepted() {
+		// late report of an accepted event, or the event of a reorganized chain
+		accepted, kept := s.accepted(event.BlockId)
+		if !kept || string(accepted.Data) == string(event.Data) {
+			return
+		}
+	}
+
+	if s.reports[event.BlockId] == nil {
+		s.reports[event.BlockId] = make(map[string]map[string]bool)
+	}
+	replicas := s.reports[event.BlockId][string(event.Data)]
+	if replicas == nil {
+		replicas = make(map[string]bool)
+		s.reports[event.BlockId][string(event.Data)] = replicas
+	}
+	replicas[replicaId] = true
+
+	if len(replicas) <= s.faulty {
+		return
+	}
+
+	for blockId := range s.reports {
+		// reports of older blocks are either accepted or never will be
+		if blockId <= event.BlockId {
+			delete(s.reports, blockId)
+		}
+	}
+
+	if event.BlockId <= s.lastAccepted() {
+		fmt.Println("[INFO] chain reorganized, events from block", event.BlockId, "replaced")
+		i := sort.Search(len(s.history), func(i int) bool { return s.history[i].BlockId >= event.BlockId })
+		s.history = s.history[:i]
+	}
+	s.history = append(s.history, event)
+	if len(s.history) > streamHistory {
+		s.history = s.history[len(s.history)-streamHistory:]
+	}
+
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(s.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+func (s *EventStream) Subscribe(from int) ([]StreamEvent, chan StreamEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var backlog []StreamEvent
+	for _, event := range s.history {
+		if event.BlockId >= from {
+			backlog = append(backlog, event)
+		}
+	}
+
+	events := make(chan StreamEvent, streamBuffer)
+	s.subscribers[events] = true
+	return backlog, events
+}
+
+func (s *EventStream) Unsubscribe(events chan StreamEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.subscribers[events] {
+		delete(s.subscribers, events)
+		close(events)
+	}
+}
+
+func (s *EventStream) Run() {
+	// Subscribes to all replicas, new replicas are picked up periodically.
+	for {
+		nodes := BlockchainNodes(NodeDiscoveryAddress())
+
+		s.mutex.Lock()
+		if len(nodes) > 0 {
+			s.faulty = (len(nodes) - 1) / 3
+		}
+		for _, n := range nodes {
+			if !s.replicas[n.Identifier] {
+				s.replicas[n.Identifier] = true
+				go s.follow(n)
+			}
+		}
+		s.mutex.Unlock()
+
+		time.Sleep(replicasRefresh)
+	}
+}
+
+func (s *EventStream) follow(n Node) {
+	// Keeps a subscription to the replica's commit events, resumes after the last event received.
+	client := transport.ClientWithTimeout(0) // the stream never ends
+	next := 0
+
+	for {
+		resp, err := client.Get(transport.NodeURL(n.String(), fmt.Sprintf("events?from=%v", next)))
+		if err == nil {
+			if err = pbft.VerifyResponse(resp, n); err != nil {
+				resp.Body.Close()
+			}
+		}
+		if err == nil && resp.StatusCode == http.StatusOK {
+			next = s.read(n, resp, next)
+		}
+		if err != nil {
+			fmt.Println("[ERROR] subscription to replica", n.Identifier, "failed:", err.Error())
+		} else {
+			resp.Body.Close()
+		}
+
+		time.Sleep(subscriptionRetry)
+	}
+}
+
+func (s *EventStream) read(n Node, resp *http.Response, next int) int {
+	// Reads events until the stream is closed, returns the block id the stream should be resumed at.
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var event StreamEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			event.BlockId, _ = strconv.Atoi(strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "data: "):
+			event.Data = []byte(strings.TrimPrefix(line, "data: "))
+		case line == "" && event.Data != nil:
+			// end of event
+			s.Report(n.Identifier, event)
+			next = event.BlockId + 1
+			event = StreamEvent{}
+		}
+	}
+	return next
+}
+
+func writeStreamEvent(w http.ResponseWriter, event StreamEvent) {
+	// Every commit event is sent as two events - the committed block and the updated tally.
+	var commit struct {
+		Height    int             `json:"height"`
+		BlockHash string          `json:"block-hash"`
+		Block     json.RawMessage `json:"block"`
+		Tally     json.RawMessage `json:"tally"`
+	}
+	if err := json.Unmarshal(event.Data, &commit); err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "id: %v\nevent: block\ndata: {\"height\": %v, \"block-hash\": %q, \"block\": %s}\n\n", event.BlockId, commit.Height, commit.BlockHash, commit.Block)
+	fmt.Fprintf(w, "id: %v\nevent: tally\ndata: %s\n\n", event.BlockId, commit.Tally)
+}
+
+func HttpStream(w http.ResponseWriter, r *http.Request) {
+	/*
+		GET /stream?from=<block id>
+		Streams committed blocks and tally updates, starting at the given block id.
+		Reconnecting clients resume after the Last-Event-ID header if "from" isn't given.
+	*/
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, JsonBodyPadding("streaming not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	from := 0
+	if value := r.URL.Query().Get("from"); value != "" {
+		var err error
+		if from, err = strconv.Atoi(value); err != nil {
+			http.Error(w, JsonBodyPadding("incorrect block id"), http.StatusBadRequest)
+			return
+		}
+	} else if lastId, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		from = lastId + 1
+	}
+
+	backlog, events := stream.Subscribe(from)
+	defer stream.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, event := range backlog {
+		writeStreamEvent(w, event)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			writeStreamEvent(w, event)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package consensus
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Consensus engines.
+Every engine (pow, pbft, poa, raft, hotstuff) implements this interface, the API layer built on top of it
+(http.go, events.go) is shared, so clients and the connector talk to all engines the same way.
+Engine specific endpoints (the protocol messages, /chain, /certify, ...) are registered by the engines themselves.
+*/
+
+// ErrInvalid is wrapped by submission errors caused by the transactions themselves, other errors are transient.
+var ErrInvalid = errors.New("invalid transaction")
+
+type Consensus interface {
+	// Hands the transactions over to the engine. Transactions may still be rejected when their block is committed,
+	// the outcome is reported by the commit events and the queries below. A submission retried with the same
+	// request id is not assigned another block.
+	Submit(requestId string, transactions []Transaction) (Receipt, error)
+
+	// Returns the commit events of the blocks with identifiers >= from and a channel of the events of new blocks.
+	// The channel is closed if the subscriber doesn't keep up, cancel has to be called once the subscriber is done.
+	// An event with a height that has already been reported replaces the chain from that height on (PoW reorgs).
+	Subscribe(from int) (backlog []CommitEvent, events <-chan CommitEvent, cancel func())
+
+	// Chain queries, the second return value is false if there is no such block.
+	Height() int // height of the last block
+	BlockAt(height int) (Block, bool)
+	BlockById(id int) (Block, bool)
+	BlockByHash(hash string) (Block, bool)
+	BlockByToken(token string) (Block, bool) // block containing the transaction with the token
+	Tally() Tally                            // tally of the whole chain
+}
+
+// Engine is a consensus engine served by a node, Routes registers its engine specific endpoints.
+type Engine interface {
+	Consensus
+	Routes(r *mux.Router)
+	Port() int // HTTP server port of the node
+}
+
+// SubmitVerifier is implemented by engines accepting submissions from known nodes only (client nodes and replicas).
+type SubmitVerifier interface {
+	VerifySubmitter(r *http.Request) error
+}
@@ -0,0 +1,102 @@
+package consensus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+Commit events streamed to subscribers (the connector) as server-sent events.
+Every committed block is sent together with the tally after the block, the event id is the block id,
+so a subscriber may resume the stream after the last block it has received.
+*/
+
+const (
+	eventsBuffer    = 100              // events buffered per subscriber, slow subscribers are disconnected
+	eventsKeepAlive = 15 * time.Second // interval of keep-alive comments
+)
+
+/*
+Event channels of the subscribers of an engine. Not safe for concurrent use - engines guard it with the mutex
+of their chain, so the backlog of a new subscriber and the events published later don't overlap.
+*/
+type Subscribers map[chan CommitEvent]bool
+
+func (s Subscribers) Add() chan CommitEvent {
+	events := make(chan CommitEvent, eventsBuffer)
+	s[events] = true
+	return events
+}
+
+func (s Subscribers) Remove(events chan CommitEvent) {
+	if s[events] {
+		delete(s, events)
+		close(events)
+	}
+}
+
+func (s Subscribers) Publish(event CommitEvent) {
+	for events := range s {
+		select {
+		case events <- event:
+		default:
+			// subscriber doesn't keep up - it has to resume the stream
+			s.Remove(events)
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event CommitEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %v\ndata: %s\n\n", event.Block.Identifier, data)
+}
+
+func (api *Api) HttpEvents(w http.ResponseWriter, r *http.Request) {
+	/*
+		GET /events?from=<block id>
+		Streams commit events of the blocks starting at the given block id, followed by events of new blocks.
+	*/
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, jsonBodyPadding("streaming not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		from = 0
+	}
+
+	backlog, events, cancel := api.engine.Subscribe(from)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, event := range backlog {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			writeEvent(w, event)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+/*
+API shared by all engines - submission of transactions, the read API and the commit events.
+Responses are the same whatever the engine, so the connector reads every chain the same way.
+*/
+
+const maxBlocksPage = 100
+
+const tallyCheckpoint = 1000 // tallies of earlier heights are recounted from a checkpoint every this many blocks
+
+type Api struct {
+	engine      Consensus
+	mutex       sync.Mutex    // guards checkpoints
+	checkpoints map[int]Tally // height -> tally up to the block at the height, see tallyAt
+}
+
+type SubmitRequest struct {
+	RequestId    string        `json:"request-id,omitempty"` // assigned on submission if missing, retries keep the id
+	Transactions []Transaction `json:"transactions"`
+}
+
+func HandleApi(r *mux.Router, engine Consensus) {
+	api := &Api{engine: engine, checkpoints: make(map[int]Tally)}
+
+	r.HandleFunc("/submit", api.HttpSubmit).Methods("POST")
+	r.HandleFunc("/height", api.HttpGetHeight).Methods("GET")
+	r.HandleFunc("/height/{height:[0-9]+}", api.HttpGetHeightAt).Methods("GET")
+	r.HandleFunc("/blocks", api.HttpGetBlocks).Methods("GET")
+	r.HandleFunc("/block/{id:[0-9]+}", api.HttpGetBlock).Methods("GET")
+	r.HandleFunc("/block/hash/{hash}", api.HttpGetBlockByHash).Methods("GET")
+	r.HandleFunc("/tx/{token}", api.HttpGetTransaction).Methods("GET")
+	r.HandleFunc("/tally", api.HttpGetTally).Methods("GET")
+	r.HandleFunc("/events", api.HttpEvents).Methods("GET")
+}
+
+func jsonBodyPadding(message string) string {
+	return fmt.Sprintf(`{"detail": "%v"}`, message)
+}
+
+func (api *Api) HttpSubmit(w http.ResponseWriter, r *http.Request) {
+	// POST /submit - the transactions end up in a single block, except with PoW where every transaction is mined separately.
+	w.Header().Set("Content-Type", "application/json")
+
+	if verifier, ok := api.engine.(SubmitVerifier); ok {
+		// the same check as the engine's own client endpoint
+		if err := verifier.VerifySubmitter(r); err != nil {
+			http.Error(w, jsonBodyPadding("request must come from a client node or a replica"), http.StatusForbidden)
+			return
+		}
+	}
+
+	var req SubmitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, jsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Transactions) == 0 {
+		http.Error(w, jsonBodyPadding("no transactions"), http.StatusBadRequest)
+		return
+	}
+
+	if req.RequestId == "" {
+		req.RequestId = uuid.NewString()
+	}
+
+	receipt, err := api.engine.Submit(req.RequestId, req.Transactions)
+	if errors.Is(err, ErrInvalid) {
+		http.Error(w, jsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, jsonBodyPadding(err.Error()), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(receipt)
+}
+
+func (api *Api) HttpGetHeight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	block, exists := api.engine.BlockAt(api.engine.Height())
+	if !exists {
+		// the chain has been replaced in the meantime
+		http.Error(w, jsonBodyPadding("chain changed, try again"), http.StatusServiceUnavailable)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Height{Height: block.Height, BlockId: block.Identifier, BlockHash: block.Hash})
+}
+
+func (api *Api) HttpGetHeightAt(w http.ResponseWriter, r *http.Request) {
+	// Identifier and hash of the block at the given height, used to compare replicas at a common height.
+	w.Header().Set("Content-Type", "application/json")
+
+	height, err := strconv.Atoi(mux.Vars(r)["height"])
+	if err != nil {
+		http.Error(w, jsonBodyPadding("incorrect height"), http.StatusBadRequest)
+		return
+	}
+
+	block, exists := api.engine.BlockAt(height)
+	if !exists {
+		http.Error(w, jsonBodyPadding("height not reached yet"), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Height{Height: block.Height, BlockId: block.Identifier, BlockHash: block.Hash})
+}
+
+func (api *Api) HttpGetBlocks(w http.ResponseWriter, r *http.Request) {
+	/*
+		GET /blocks?from=<block id>&to=<block id>
+		Returns blocks with identifiers in the given range (both inclusive), at most maxBlocksPage blocks.
+		Rejected sequence numbers are skipped, so the next page starts after the identifier of the last block returned.
+	*/
+	w.Header().Set("Content-Type", "application/json")
+
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		from = 0
+	}
+
+	to, err := strconv.Atoi(r.URL.Query().Get("to"))
+	if err != nil {
+		to = -1 // till the end of the chain
+	}
+
+	if from < 0 || (to >= 0 && to < from) {
+		http.Error(w, jsonBodyPadding("incorrect block range"), http.StatusBadRequest)
+		return
+	}
+
+	// block identifiers grow with the height
+	end := api.engine.Height() + 1
+	start := sort.Search(end, func(height int) bool {
+		block, exists := api.engine.BlockAt(height)
+		return !exists || block.Identifier >= from
+	})
+
+	blocks := []Block{}
+	for height := start; height < end && len(blocks) < maxBlocksPage; height++ {
+		block, exists := api.engine.BlockAt(height)
+		if !exists || (to >= 0 && block.Identifier > to) {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+
+	json.NewEncoder(w).Encode(blocks)
+}
+
+func (api *Api) HttpGetBlock(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	blockId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, jsonBodyPadding("incorrect block id"), http.StatusBadRequest)
+		return
+	}
+
+	block, exists := api.engine.BlockById(blockId)
+	if !exists {
+		http.Error(w, jsonBodyPadding("block not found"), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(block)
+}
+
+func (api *Api) HttpGetBlockByHash(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	block, exists := api.engine.BlockByHash(mux.Vars(r)["hash"])
+	if !exists {
+		http.Error(w, jsonBodyPadding("block not found"), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(block)
+}
+
+func (api *Api) queryHeight(r *http.Request) (int, bool, error) {
+	// Optional ?height= parameter of the reads - answers as of the block at that height, so replicas that have
+	// already committed more blocks answer the same as the others. The second return value is false if not given.
+	param := r.URL.Query().Get("height")
+	if param == "" {
+		return 0, false, nil
+	}
+
+	height, err := strconv.Atoi(param)
+	if err != nil || height < 0 {
+		return 0, false, errors.New("incorrect height")
+	}
+	if height > api.engine.Height() {
+		return 0, false, errors.New("height not reached yet")
+	}
+	return height, true, nil
+}
+
+func (api *Api) HttpGetTransaction(w http.ResponseWriter, r *http.Request) {
+	// GET /tx/{token}?height= - transactions in blocks above the height are not reported.
+	w.Header().Set("Content-Type", "application/json")
+
+	height, atHeight, err := api.queryHeight(r)
+	if err != nil {
+		http.Error(w, jsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	block, exists := api.engine.BlockByToken(token)
+	if exists && (!atHeight || block.Height <= height) {
+		for _, t := range block.Transactions {
+			if t.TokenId == token {
+				json.NewEncoder(w).Encode(TransactionInfo{Transaction: t, BlockId: block.Identifier, BlockHash: block.Hash})
+				return
+			}
+		}
+	}
+
+	http.Error(w, jsonBodyPadding("transaction not found"), http.StatusNotFound)
+}
+
+func (api *Api) HttpGetTally(w http.ResponseWriter, r *http.Request) {
+	// GET /tally?height= - without the height, the tally of the whole chain.
+	w.Header().Set("Content-Type", "application/json")
+
+	height, atHeight, err := api.queryHeight(r)
+	if err != nil {
+		http.Error(w, jsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	}
+	if !atHeight {
+		json.NewEncoder(w).Encode(api.engine.Tally())
+		return
+	}
+
+	tally, exists := api.tallyAt(height)
+	if !exists {
+		// pruned or replaced by a reorganization in the meantime
+		http.Error(w, jsonBodyPadding("block not found"), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tally)
+}
+
+func (api *Api) tallyAt(height int) (Tally, bool) {
+	/*
+		Tally up to the block at the given height. The engines maintain the tally of the whole chain, which is
+		served if the chain is at that height. Otherwise the tally is recounted from the closest checkpoint below
+		the height - checkpoints are recorded while recounting, so a read counts at most tallyCheckpoint blocks once
+		they exist. Checkpoints replaced by a reorganization are discarded.
+	*/
+	if current := api.engine.Tally(); current.Height == height {
+		return current, true
+	}
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	start, tally := 0, NewTally()
+	for h := height - height%tallyCheckpoint; h > 0; h -= tallyCheckpoint {
+		checkpoint, exists := api.checkpoints[h]
+		if !exists {
+			continue
+		}
+		if block, exists := api.engine.BlockAt(h); exists && block.Hash == checkpoint.BlockHash {
+			if h == height {
+				return checkpoint.At(block), true
+			}
+			start, tally = h+1, checkpoint.At(block)
+			break
+		}
+		delete(api.checkpoints, h)
+	}
+
+	var block Block
+	for h := start; h <= height; h++ {
+		var exists bool
+		if block, exists = api.engine.BlockAt(h); !exists {
+			return Tally{}, false
+		}
+		tally.Count(block)
+		if h%tallyCheckpoint == 0 && h > 0 {
+			api.checkpoints[h] = tally.At(block)
+		}
+	}
+	return tally.At(block), true
+}
@@ -0,0 +1,93 @@
+package consensus
+
+/*
+Common block and transaction model.
+Every engine stores blocks in its own format (PoW blocks carry a nonce, PoA blocks a seal, ...), the API layer
+(http.go) serves them in this format, so clients and the connector read the same blocks from every engine.
+The JSON encoding is the one the PBFT replicas have always used.
+*/
+
+type Transaction struct {
+	/*
+		not storing issuer ID for privacy reasons (tokenId instead)
+		not storing amount because it is always a single vote
+	*/
+	TokenId string `json:"Token"`
+	ToId    string `json:"ToId"`
+}
+
+type Block struct {
+	Identifier        int           `json:"id"` // sequence number assigned by the engine (the height with PoW)
+	Timestamp         int           `json:"timestamp"`
+	Transactions      []Transaction `json:"transactions"`
+	PreviousBlockHash string        `json:"previousHash"`
+	Height            int           `json:"-"` // position in the chain, the genesis block is at height 0
+	Hash              string        `json:"-"` // calculated by the engine, served separately (see Height, TransactionInfo)
+}
+
+type Tally struct {
+	Height     int            `json:"height"` // height of the last block counted
+	BlockId    int            `json:"block-id"`
+	BlockHash  string         `json:"block-hash"`
+	TotalVotes int            `json:"total-votes"`
+	Votes      map[string]int `json:"results"` // voting party -> votes
+}
+
+type Height struct {
+	Height    int    `json:"height"` // number of blocks after the genesis block
+	BlockId   int    `json:"block-id"`
+	BlockHash string `json:"block-hash"`
+}
+
+type TransactionInfo struct {
+	Transaction Transaction `json:"transaction"`
+	BlockId     int         `json:"block-id"`
+	BlockHash   string      `json:"block-hash"`
+}
+
+type CommitEvent struct {
+	// Committed block together with the tally after the block.
+	Height    int    `json:"height"`
+	BlockHash string `json:"block-hash"`
+	Block     Block  `json:"block"`
+	Tally     Tally  `json:"tally"`
+}
+
+type Receipt struct {
+	// Answer to a submission. The block id is known only if the engine assigns blocks right away (not with PoW).
+	RequestId string `json:"request-id"` // id to retry the submission with
+	Status    string `json:"status"`
+	BlockId   int    `json:"block-id,omitempty"`
+}
+
+func NewTally() Tally {
+	return Tally{Votes: make(map[string]int)}
+}
+
+func (t *Tally) Count(block Block) {
+	t.CountTransactions(block.Transactions)
+}
+
+func (t *Tally) CountTransactions(transactions []Transaction) {
+	// Counts the transactions of a block, used by the engines with their own block type.
+	t.TotalVotes += len(transactions)
+	for _, ta := range transactions {
+		t.Votes[ta.ToId] += 1
+	}
+}
+
+func (t Tally) At(block Block) Tally {
+	// Copy of the tally labelled with the last block counted, safe to hand out while the original keeps counting.
+	votes := make(map[string]int)
+	for party, count := range t.Votes {
+		votes[party] = count
+	}
+	t.Votes = votes
+	t.Height, t.BlockId, t.BlockHash = block.Height, block.Identifier, block.Hash
+	return t
+}
+
+func NewCommitEvent(block Block, tally Tally) CommitEvent {
+	// tally must already include the block
+	return CommitEvent{Height: block.Height, BlockHash: block.Hash, Block: block, Tally: tally.At(block)}
+}
@@ -5,4 +5,5 @@ go 1.13
 require (
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 )
@@ -0,0 +1,298 @@
+package hotstuff
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"evoting/pbft"
+	"evoting/transport"
+)
+
+/*
+HotStuff.
+Byzantine fault tolerant alternative to PBFT with linear messaging. The leader proposes a block for every client
+request, the block goes through the prepare, pre-commit and commit phases - in each phase replicas vote to the leader,
+which starts the next phase with the quorum certificate of the votes. The commit certificate is sent in the decide
+phase, replicas then execute the block. Blocks are executed in order of their identifiers, transactions are validated
+at execution, so every correct replica rejects the same blocks.
+The leader of a view is chosen round robin from the replicas ordered by identifier. Replicas that wait for a block
+longer than the view timeout move to the next view (see pacemaker.go), so a crashed or faulty leader, or a block that
+misses its quorum, doesn't stop block production.
+Clients, the connector and the replica API are the same as with PBFT.
+*/
+
+const executedRetention = 1000 // messages and replies of executed blocks are kept for this many blocks
+
+type Blockchain struct {
+	pbft.Ledger            // chain, indexes and tally, see pbft/query.go
+	pbft.Membership        // peers (other replicas), see pbft/membership.go
+	Identifier      string `json:"node-id"`
+	View            int    `json:"-"` // determines the leader, see pacemaker.go
+	Executed        int    `json:"-"` // identifier of the last executed or rejected block
+	mutex           *sync.Mutex
+	signer          pbft.Signer
+
+	Certificates map[int]QuorumCertificate `json:"certificates"` // commit certificates of the blocks in the chain
+
+	proposals    map[int]Proposal          // message of the leader accepted for each block id
+	prepared     map[int]Proposal          // message with the highest certificate of each undecided block id
+	lastProposed int                       // highest block id proposed so far
+	votes        map[int]map[string][]Vote // leader: votes per block id and phase
+	certified    map[int]map[string]bool   // leader: phases certified per block id
+	decided      map[int]Proposal          // decide messages (with the commit certificate), kept for lagging replicas
+	requests     map[string]int            // client requests -> block id
+	replies      map[int]pbft.Reply        // replies sent to the clients by block id
+	pruned       int                       // messages and replies are dropped up to this block id
+
+	newViews     map[int]map[string]NewView // new-view messages per view and replica, see pacemaker.go
+	starting     int                        // leader: last view it collected a quorum of new-view messages for
+	started      int                        // leader: last view whose blocks were proposed again, new requests wait for it
+	waitingSince time.Time                  // since when a block is expected, zero if none is
+	viewChanges  int                        // view changes since the last executed block, doubles the timeout
+}
+
+func NewBlockchain(port int, keystore string, scheme string) (*Blockchain, error) {
+	/*
+		Creates a replica registered at the node discovery service.
+		If keystore is empty a throwaway key is generated and the hostname is used as the identifier.
+	*/
+	hostname := os.Getenv("HOSTNAME")
+	self := pbft.Node{Address: hostname, Port: port, Identifier: hostname, Type: "blockchain"}
+
+	var signer pbft.Signer
+	var err error
+	if keystore == "" {
+		// generate a throwaway signing key
+		signer, err = pbft.GenerateSigningKey(scheme)
+	} else {
+		signer, err = pbft.LoadOrCreateKeystore(keystore, pbft.KeystorePassword(), scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	self.PublicKey = signer.Public()
+	if keystore != "" {
+		self.Identifier = pbft.NodeIdFromKey(self.PublicKey)
+	}
+
+	if err := pbft.CheckTLSIdentity(self); err != nil {
+		return nil, err
+	}
+
+	return newBlockchain(self, signer, nil), nil
+}
+
+func NewStaticBlockchain(cluster *pbft.ClusterConfig, identifier string, keystore string) (*Blockchain, error) {
+	// Creates a replica described by the static cluster config.
+	signer, err := pbft.LoadKeystore(keystore, pbft.KeystorePassword())
+	if err != nil {
+		return nil, err
+	}
+
+	if identifier == "" {
+		identifier = pbft.NodeIdFromKey(signer.Public())
+	}
+
+	self, err := cluster.NodeById(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.Type != "blockchain" {
+		return nil, fmt.Errorf("node %v is not a blockchain node", identifier)
+	}
+
+	if signer.Public() != self.PublicKey {
+		return nil, fmt.Errorf("private key does not match the public key of node %v", identifier)
+	}
+
+	if err := pbft.CheckTLSIdentity(self); err != nil {
+		return nil, err
+	}
+
+	return newBlockchain(self, signer, cluster), nil
+}
+
+func newBlockchain(self pbft.Node, signer pbft.Signer, cluster *pbft.ClusterConfig) *Blockchain {
+	var bc Blockchain
+	bc.Identifier = self.Identifier
+	bc.signer = signer
+	bc.mutex = &sync.Mutex{}
+	bc.Ledger = pbft.NewLedger(bc.mutex, self.Identifier, signer)
+	bc.Membership = pbft.NewMembership(self, cluster, os.Getenv("DISCOVERY_ADDR"), bc.mutex)
+	bc.Certificates = make(map[int]QuorumCertificate)
+	bc.proposals = make(map[int]Proposal)
+	bc.prepared = make(map[int]Proposal)
+	bc.newViews = make(map[int]map[string]NewView)
+	bc.votes = make(map[int]map[string][]Vote)
+	bc.certified = make(map[int]map[string]bool)
+	bc.decided = make(map[int]Proposal)
+	bc.requests = make(map[string]int)
+	bc.replies = make(map[int]pbft.Reply)
+
+	bc.RegisterNode()
+	bc.RefreshPeers()
+
+	if bc.Cluster != nil {
+		// replicas of a static cluster share the same genesis block
+		bc.Chain = []pbft.Block{{Identifier: 0, Timestamp: 0, Transactions: []pbft.Transaction{}, PreviousBlockHash: ""}}
+		bc.FetchChain()
+	} else if len(bc.Peers) < 1 {
+		fmt.Println("[INFO] too few peers, creating genesis block (peers:", bc.Peers, ")")
+		bc.Chain = []pbft.Block{{Identifier: 0, Timestamp: int(time.Now().Unix()), Transactions: []pbft.Transaction{}, PreviousBlockHash: ""}}
+	} else {
+		bc.FetchChain()
+	}
+	bc.Reindex()
+
+	go bc.run()
+	return &bc
+}
+
+func (bc *Blockchain) FetchChain() {
+	// Replaces the local chain with the (verified) chain of a random peer if the peer's chain is longer.
+	if len(bc.Peers) < 1 {
+		return
+	}
+
+	fmt.Println("[INFO] fetching blockchain from a peer")
+	if err := bc.fetchChain(pbft.RandomNode(bc.Peers)); err != nil {
+		fmt.Println("[ERROR]", err.Error())
+	}
+}
+
+func (bc *Blockchain) fetchChain(peer pbft.Node) error {
+	// Replaces the local chain with the chain of the peer if it's longer and every block has a commit certificate.
+	resp, err := transport.Get(peer.String(), "chain")
+	if err != nil {
+		return fmt.Errorf("failed to fetch blockchain data from %v: %v", peer.Identifier, err.Error())
+	}
+	defer resp.Body.Close()
+
+	var peerBc Blockchain
+	if err := json.NewDecoder(resp.Body).Decode(&peerBc); err != nil {
+		return fmt.Errorf("erroring parsing blockchain of %v: %v", peer.Identifier, err.Error())
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if len(peerBc.Chain) <= len(bc.Chain) {
+		return nil
+	}
+	if err := bc.verifyChain(peerBc.Chain, peerBc.Certificates); err != nil {
+		return fmt.Errorf("chain of peer %v is not valid: %v", peer.Identifier, err.Error())
+	}
+	if len(bc.Chain) > 0 && pbft.CalculateHash(bc.Chain[0]) != pbft.CalculateHash(peerBc.Chain[0]) {
+		return fmt.Errorf("chain of peer %v has a different genesis block", peer.Identifier)
+	}
+
+	bc.Chain = peerBc.Chain
+	for _, block := range bc.Chain[1:] {
+		bc.Certificates[block.Identifier] = peerBc.Certificates[block.Identifier]
+	}
+	bc.Reindex()
+	if last := bc.LastBlock().Identifier; last > bc.Executed {
+		bc.Executed = last
+		bc.prune(last - executedRetention)
+	}
+	return nil
+}
+
+func (bc *Blockchain) verifyChain(chain []pbft.Block, certificates map[int]QuorumCertificate) error {
+	// Every block has to extend the preceding one and carry a commit certificate. Called with the mutex held.
+	if len(chain) == 0 {
+		return errors.New("missing genesis block")
+	}
+
+	for i, block := range chain[1:] {
+		previous := chain[i]
+		if block.Identifier <= previous.Identifier {
+			return fmt.Errorf("block %v out of order", block.Identifier)
+		}
+		if block.PreviousBlockHash != pbft.CalculateHash(previous) {
+			return fmt.Errorf("block %v does not extend block %v", block.Identifier, previous.Identifier)
+		}
+
+		// the certificate is over the proposed block, the previous hash is set once the block is executed
+		proposed := block
+		proposed.PreviousBlockHash = ""
+		qc, exists := certificates[block.Identifier]
+		if !exists || qc.Phase != phaseCommit || qc.BlockId != block.Identifier || qc.Digest != pbft.CalculateHash(proposed) {
+			return fmt.Errorf("block %v has no commit certificate", block.Identifier)
+		}
+		if err := bc.verifyQC(&qc); err != nil {
+			return fmt.Errorf("commit certificate of block %v: %v", block.Identifier, err.Error())
+		}
+	}
+	return nil
+}
+
+func (bc *Blockchain) replicaById(id string) pbft.Node {
+	// Called with the mutex held.
+	if id == bc.Self.Identifier {
+		return bc.Self
+	}
+	for _, peer := range bc.Peers {
+		if peer.Identifier == id {
+			return peer
+		}
+	}
+	return pbft.Node{}
+}
+
+func (bc *Blockchain) Leader() pbft.Node {
+	// The leader of the current view. Called with the mutex held.
+	return bc.leaderOf(bc.View)
+}
+
+func (bc *Blockchain) leaderOf(view int) pbft.Node {
+	// Replicas ordered by identifier take turns - the same order on every replica. Called with the mutex held.
+	replicas := append([]pbft.Node{bc.Self}, bc.Peers...)
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].Identifier < replicas[j].Identifier })
+	return replicas[view%len(replicas)]
+}
+
+func (bc *Blockchain) isLeader() bool {
+	return bc.Leader().Identifier == bc.Self.Identifier
+}
+
+func (bc *Blockchain) quorum() int {
+	// n - f votes
+	return len(bc.Peers) + 1 - bc.faulty()
+}
+
+func (bc *Blockchain) faulty() int {
+	// f = floor((n-1)/3)
+	return len(bc.Peers) / 3
+}
+
+func (bc *Blockchain) sign(message interface{}) string {
+	// Signature over the JSON encoded message, verifiable with pbft.VerifyMessage.
+	payload, _ := json.Marshal(message)
+	signed, _ := bc.signer.Sign(payload)
+	return hex.EncodeToString(signed)
+}
+
+func (bc *Blockchain) HttpGetChain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	json.NewEncoder(w).Encode(bc)
+}
+
+func (bc *Blockchain) HttpGetPeers(w http.ResponseWriter, r *http.Request) {
+	// Debug endpoint
+	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	json.NewEncoder(w).Encode(bc.Peers)
+}
@@ -0,0 +1,20 @@
+package hotstuff
+
+import "github.com/gorilla/mux"
+
+func (bc *Blockchain) Routes(r *mux.Router) {
+	// Engine specific endpoints, the shared API is registered by consensus.HandleApi (see main.go).
+	r.HandleFunc("/proposal", bc.HttpProposal).Methods("POST")
+	r.HandleFunc("/vote", bc.HttpVote).Methods("POST")
+	r.HandleFunc("/new-view", bc.HttpNewView).Methods("POST")
+	r.HandleFunc("/view-change", bc.HttpViewChange).Methods("POST")
+	r.HandleFunc("/decided/{id:[0-9]+}", bc.HttpGetDecided).Methods("GET")
+	r.HandleFunc("/chain", bc.HttpGetChain).Methods("GET")
+	r.HandleFunc("/certify/{height:[0-9]+}", bc.HttpCertify).Methods("GET")
+	r.HandleFunc("/request", bc.HttpRequest).Methods("POST")
+	r.HandleFunc("/peers", bc.HttpGetPeers).Methods("GET")
+}
+
+func (bc *Blockchain) Port() int {
+	return bc.Self.Port
+}
@@ -0,0 +1,185 @@
+package hotstuff
+
+import (
+	"errors"
+	"fmt"
+
+	"evoting/pbft"
+)
+
+/*
+Protocol messages.
+Replicas send their votes to the leader only, the leader aggregates a quorum of signed votes into a quorum
+certificate (QC) and sends it to all replicas with the next phase. Every phase costs O(n) messages instead of the
+O(n²) all-to-all broadcasts of PBFT. The certificate is the list of votes - it can be checked by anyone who knows the
+replicas' public keys, threshold signatures are not used.
+View changes (see pacemaker.go) add two messages: a replica leaving a view sends a new-view message with the highest
+certificate it knows of every undecided block id, the next leader starts its view with a quorum of them.
+*/
+
+const (
+	phasePrepare   = "prepare"
+	phasePreCommit = "pre-commit"
+	phaseCommit    = "commit"
+	phaseDecide    = "decide"
+)
+
+type Vote struct {
+	Phase     string `json:"phase"`
+	View      int    `json:"view"`
+	BlockId   int    `json:"block-id"`
+	Digest    string `json:"digest"`
+	VoterId   string `json:"voter-id"`
+	Signature string `json:"signature"`
+}
+
+type QuorumCertificate struct {
+	Phase   string `json:"phase"`
+	View    int    `json:"view"`
+	BlockId int    `json:"block-id"`
+	Digest  string `json:"digest"`
+	Votes   []Vote `json:"votes"` // signed votes of a quorum of replicas, aggregated by the leader
+}
+
+type Proposal struct {
+	// message of the leader starting a phase, carries the block so a replica may join in any phase
+	Phase     string             `json:"phase"`
+	View      int                `json:"view"`
+	Block     pbft.Block         `json:"block"`
+	Digest    string             `json:"digest"`
+	Client    pbft.Node          `json:"client"`
+	RequestId string             `json:"request-id"`
+	Justify   *QuorumCertificate `json:"justify,omitempty"` // certificate of the previous phase, missing in prepare
+	LeaderId  string             `json:"leader-id"`
+	Signature string             `json:"signature"`
+}
+
+type NewView struct {
+	// sent to all replicas by a replica moving to the view
+	View      int                `json:"view"`
+	VoterId   string             `json:"voter-id"`
+	Executed  int                `json:"executed"`
+	Proof     *QuorumCertificate `json:"proof,omitempty"` // commit certificate of the last executed block, missing for the genesis block
+	Prepared  []Proposal         `json:"prepared"`        // message with the highest certificate of every block id above Executed
+	Signature string             `json:"signature"`
+}
+
+type ViewChange struct {
+	// sent by the leader starting the view, the new-view messages prove that a quorum moved to it
+	View      int       `json:"view"`
+	NewViews  []NewView `json:"new-views"`
+	LeaderId  string    `json:"leader-id"`
+	Signature string    `json:"signature"`
+}
+
+func (m Vote) unsigned() Vote {
+	m.Signature = ""
+	return m
+}
+
+func (m Proposal) unsigned() Proposal {
+	m.Signature = ""
+	return m
+}
+
+func (m NewView) unsigned() NewView {
+	m.Signature = ""
+	return m
+}
+
+func (m ViewChange) unsigned() ViewChange {
+	m.Signature = ""
+	return m
+}
+
+func nextPhase(phase string) string {
+	switch phase {
+	case phasePrepare:
+		return phasePreCommit
+	case phasePreCommit:
+		return phaseCommit
+	}
+	return phaseDecide
+}
+
+func previousPhase(phase string) string {
+	switch phase {
+	case phasePreCommit:
+		return phasePrepare
+	case phaseCommit:
+		return phasePreCommit
+	}
+	return phaseCommit
+}
+
+func phaseRank(phase string) int {
+	switch phase {
+	case phasePreCommit:
+		return 1
+	case phaseCommit:
+		return 2
+	}
+	return 0
+}
+
+func higherCertificate(qc *QuorumCertificate, other *QuorumCertificate) bool {
+	// Certificates of later views win, within a view certificates of later phases.
+	return qc.View > other.View || (qc.View == other.View && phaseRank(qc.Phase) > phaseRank(other.Phase))
+}
+
+func locks(qc *QuorumCertificate) bool {
+	// A replica that saw a pre-commit (or commit) certificate of a block is locked on it, see accept.
+	return qc.Phase == phasePreCommit || qc.Phase == phaseCommit
+}
+
+func (p Proposal) votingInfo() pbft.VotingInfo {
+	// Response to the client's request, the client only needs the block id and the request id.
+	voting := pbft.Voting{BlockId: p.Block.Identifier, Digest: p.Digest, YesVotes: []pbft.VoteRequest{}, NoVotes: []pbft.VoteRequest{}, Client: p.Client, RequestId: p.RequestId}
+	return pbft.VotingInfo{View: p.View, VotingData: voting, BlockData: p.Block, Digest: p.Digest, Sender: p.LeaderId, Signature: p.Signature}
+}
+
+func (bc *Blockchain) verifyCertificate(qc *QuorumCertificate, phase string, p Proposal) error {
+	// Checks that the certificate belongs to the proposal and contains valid votes of a quorum. Called with the mutex held.
+	if qc == nil {
+		return errors.New("certificate missing")
+	}
+	if qc.Phase != phase || qc.View != p.View || qc.BlockId != p.Block.Identifier || qc.Digest != p.Digest {
+		return errors.New("certificate does not match the proposal")
+	}
+	return bc.verifyQC(qc)
+}
+
+func (bc *Blockchain) verifyJustified(p Proposal) error {
+	// Checks the certificate carried by a message of an earlier view (new-view messages, re-proposed blocks).
+	// Called with the mutex held.
+	if p.Justify == nil {
+		return errors.New("certificate missing")
+	}
+	if p.Justify.BlockId != p.Block.Identifier || p.Justify.Digest != p.Digest || p.Digest != pbft.CalculateHash(p.Block) {
+		return fmt.Errorf("certificate does not match block %v", p.Block.Identifier)
+	}
+	return bc.verifyQC(p.Justify)
+}
+
+func (bc *Blockchain) verifyQC(qc *QuorumCertificate) error {
+	// Checks that the certificate contains valid votes of a quorum. Called with the mutex held.
+	voters := make(map[string]bool)
+	for _, vote := range qc.Votes {
+		if vote.Phase != qc.Phase || vote.View != qc.View || vote.BlockId != qc.BlockId || vote.Digest != qc.Digest {
+			continue
+		}
+		voter := bc.replicaById(vote.VoterId)
+		if voter == (pbft.Node{}) || voters[voter.Identifier] {
+			continue
+		}
+		if pbft.VerifyMessage(voter, vote.unsigned(), vote.Signature) != nil {
+			continue
+		}
+		voters[voter.Identifier] = true
+	}
+
+	if len(voters) < bc.quorum() {
+		return fmt.Errorf("certificate contains %v valid votes, %v required", len(voters), bc.quorum())
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package hotstuff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"evoting/pbft"
+	"evoting/transport"
+)
+
+/*
+Pacemaker.
+A replica that waits for a block (it forwarded a request to the leader, accepted a proposal that isn't executed yet or
+received a new-view message of another replica) longer than the view timeout moves to the next view and sends a
+new-view message to all replicas. The message carries
+the highest certificate the replica knows of every block id it hasn't executed. A replica joins a view change once
+f+1 replicas moved to a later view, and the leader of the view starts it once it has new-view messages of a quorum.
+The new leader catches up with the replicas of the quorum that executed more blocks, then proposes every block id
+above its last executed block again: the block with the highest certificate among the new-view messages or, if no
+replica of the quorum prepared the id, an empty block (rejected at execution) that fills the gap.
+A replica locked on a block (it saw its pre-commit certificate) votes for another block with the same id only if the
+new proposal carries a certificate of a later view. A decided block was locked by a quorum, so every quorum of
+new-view messages contains its certificate and no other block can be decided with the same id.
+The timeout doubles with every view change that doesn't lead to an executed block.
+*/
+
+const (
+	viewTimeout    = 5 * time.Second
+	maxViewBackoff = 4 // the timeout doubles at most this many times
+)
+
+func (bc *Blockchain) run() {
+	// Moves to the next view once the replica waited for a block longer than the timeout.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		bc.mutex.Lock()
+		backoff := bc.viewChanges
+		if backoff > maxViewBackoff {
+			backoff = maxViewBackoff
+		}
+		expired := !bc.waitingSince.IsZero() && time.Since(bc.waitingSince) >= viewTimeout<<uint(backoff)
+
+		var message NewView
+		if expired {
+			bc.viewChanges++
+			fmt.Println("[HOTSTUFF] no progress in view", bc.View, "- moving to view", bc.View+1)
+			message = bc.moveToView(bc.View + 1)
+		}
+		bc.mutex.Unlock()
+
+		if expired {
+			bc.sendNewView(message)
+		}
+	}
+}
+
+func (bc *Blockchain) resetTimer() {
+	// Called with the mutex held.
+	if bc.lastProposed > bc.Executed {
+		bc.waitingSince = time.Now()
+	} else {
+		bc.waitingSince = time.Time{}
+	}
+}
+
+func (bc *Blockchain) enterView(view int) {
+	// Called with the mutex held.
+	bc.View = view
+	bc.votes = make(map[int]map[string][]Vote)
+	bc.certified = make(map[int]map[string]bool)
+	for v := range bc.newViews {
+		if v < view {
+			delete(bc.newViews, v)
+		}
+	}
+	bc.resetTimer()
+}
+
+func (bc *Blockchain) moveToView(view int) NewView {
+	// Enters the view, returns the signed new-view message of the replica. Called with the mutex held.
+	bc.enterView(view)
+
+	message := NewView{View: view, VoterId: bc.Self.Identifier, Executed: bc.Executed, Prepared: []Proposal{}}
+	if decided, exists := bc.decided[bc.Executed]; exists {
+		message.Proof = decided.Justify
+	} else if qc, exists := bc.Certificates[bc.Executed]; exists {
+		message.Proof = &qc
+	}
+	for id, p := range bc.prepared {
+		if id > bc.Executed {
+			message.Prepared = append(message.Prepared, p)
+		}
+	}
+	sort.Slice(message.Prepared, func(i, j int) bool {
+		return message.Prepared[i].Block.Identifier < message.Prepared[j].Block.Identifier
+	})
+	message.Signature = bc.sign(message)
+
+	if bc.newViews[view] == nil {
+		bc.newViews[view] = make(map[string]NewView)
+	}
+	bc.newViews[view][bc.Self.Identifier] = message
+	return message
+}
+
+func (bc *Blockchain) sendNewView(message NewView) {
+	// Sends the replica's new-view message to all replicas. Must not be called while holding the mutex.
+	bc.mutex.Lock()
+	peers := bc.Peers
+	bc.mutex.Unlock()
+
+	messageBuffer, _ := json.Marshal(message)
+	for _, peer := range peers {
+		go func(peer pbft.Node) {
+			resp, err := transport.Post(peer.String(), "new-view", messageBuffer)
+			if err != nil {
+				fmt.Println("[ERROR] failed to send new-view message of view", message.View, "to", peer.Identifier, err.Error())
+				return
+			}
+			resp.Body.Close()
+		}(peer)
+	}
+
+	bc.advanceView()
+}
+
+func (bc *Blockchain) verifyNewView(message NewView) error {
+	// Called with the mutex held.
+	voter := bc.replicaById(message.VoterId)
+	if voter == (pbft.Node{}) {
+		return fmt.Errorf("replica %v not found", message.VoterId)
+	}
+	if err := pbft.VerifyMessage(voter, message.unsigned(), message.Signature); err != nil {
+		return errors.New("incorrect signature")
+	}
+
+	if message.Executed > 0 {
+		proof := message.Proof
+		if proof == nil || proof.Phase != phaseCommit || proof.BlockId != message.Executed || bc.verifyQC(proof) != nil {
+			return fmt.Errorf("no commit certificate of block %v", message.Executed)
+		}
+	}
+	for _, p := range message.Prepared {
+		if p.Block.Identifier <= message.Executed {
+			return fmt.Errorf("block %v was executed already", p.Block.Identifier)
+		}
+		if err := bc.verifyJustified(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bc *Blockchain) addNewView(message NewView) error {
+	bc.mutex.Lock()
+	if err := bc.verifyNewView(message); err != nil {
+		bc.mutex.Unlock()
+		return err
+	}
+
+	if message.View > bc.View || (message.View == bc.View && message.View > bc.starting) {
+		if bc.newViews[message.View] == nil {
+			bc.newViews[message.View] = make(map[string]NewView)
+		}
+		bc.newViews[message.View][message.VoterId] = message
+	}
+	if message.View > bc.View && bc.waitingSince.IsZero() {
+		// another replica misses a block - the view changes as well unless a block is executed in time
+		bc.waitingSince = time.Now()
+	}
+	bc.mutex.Unlock()
+
+	bc.advanceView()
+	return nil
+}
+
+func (bc *Blockchain) advanceView() {
+	/*
+		Joins a view change once f+1 replicas moved to later views - at least one of them is correct - and starts
+		the view if the replica is its leader and a quorum moved to it.
+		Must not be called while holding the mutex.
+	*/
+	bc.mutex.Lock()
+
+	later := make(map[string]int) // replica -> its latest view after the current one
+	for view, messages := range bc.newViews {
+		if view <= bc.View {
+			continue
+		}
+		for voter := range messages {
+			if view > later[voter] {
+				later[voter] = view
+			}
+		}
+	}
+
+	var joined *NewView
+	if len(later) > bc.faulty() {
+		target := 0
+		for _, view := range later {
+			if target == 0 || view < target {
+				target = view
+			}
+		}
+		fmt.Println("[HOTSTUFF] joining view change to view", target)
+		message := bc.moveToView(target)
+		joined = &message
+	}
+
+	view := bc.View
+	var quorum []NewView
+	if bc.leaderOf(view).Identifier == bc.Self.Identifier && view > bc.starting && len(bc.newViews[view]) >= bc.quorum() {
+		bc.starting = view
+		for _, message := range bc.newViews[view] {
+			quorum = append(quorum, message)
+		}
+	}
+	bc.mutex.Unlock()
+
+	if joined != nil {
+		go bc.sendNewView(*joined)
+	}
+	if quorum != nil {
+		go bc.startView(view, quorum)
+	}
+}
+
+func lastPrepared(messages []NewView) int {
+	// Highest block id prepared by the replicas of the quorum.
+	last := 0
+	for _, message := range messages {
+		for _, p := range message.Prepared {
+			if p.Block.Identifier > last {
+				last = p.Block.Identifier
+			}
+		}
+	}
+	return last
+}
+
+func (bc *Blockchain) startView(view int, messages []NewView) {
+	// Leader: proposes the undecided block ids of the previous views again, see above.
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Executed > messages[j].Executed })
+
+	// blocks executed by other replicas of the quorum are decided, they are fetched instead of proposed again
+	for _, message := range messages {
+		bc.mutex.Lock()
+		behind := message.Executed > bc.Executed
+		from := bc.replicaById(message.VoterId)
+		bc.mutex.Unlock()
+
+		if behind {
+			bc.catchUp(from, message.Executed+1)
+		}
+	}
+
+	bc.mutex.Lock()
+	if bc.View != view {
+		// moved on to a later view in the meantime
+		bc.mutex.Unlock()
+		return
+	}
+	if bc.Executed < messages[0].Executed {
+		fmt.Println("[ERROR] failed to fetch the blocks executed by", messages[0].VoterId, "- view", view, "not started")
+		bc.mutex.Unlock()
+		return
+	}
+
+	highest := make(map[int]Proposal)
+	for _, message := range messages {
+		for _, p := range message.Prepared {
+			if known, exists := highest[p.Block.Identifier]; !exists || higherCertificate(p.Justify, known.Justify) {
+				highest[p.Block.Identifier] = p
+			}
+		}
+	}
+
+	var proposals []Proposal
+	last := lastPrepared(messages)
+	for id := bc.Executed + 1; id <= last; id++ {
+		proposal := Proposal{Phase: phasePrepare, View: view, LeaderId: bc.Self.Identifier}
+		if known, exists := highest[id]; exists {
+			proposal.Block, proposal.Digest, proposal.Client, proposal.RequestId, proposal.Justify = known.Block, known.Digest, known.Client, known.RequestId, known.Justify
+		} else {
+			proposal.Block = pbft.Block{Identifier: id, Timestamp: int(time.Now().Unix()), Transactions: []pbft.Transaction{}}
+			proposal.Digest = pbft.CalculateHash(proposal.Block)
+		}
+		proposal.Signature = bc.sign(proposal)
+		proposals = append(proposals, proposal)
+	}
+
+	// new requests get ids after the proposals of the view change
+	bc.started = view
+	bc.lastProposed = bc.Executed
+	if last > bc.lastProposed {
+		bc.lastProposed = last
+	}
+	bc.resetTimer()
+
+	viewChange := ViewChange{View: view, NewViews: messages, LeaderId: bc.Self.Identifier}
+	viewChange.Signature = bc.sign(viewChange)
+	peers := bc.Peers
+	bc.mutex.Unlock()
+
+	fmt.Println("[HOTSTUFF] starting view", view, "with", len(proposals), "block(s) proposed again")
+
+	// replicas move to the view before they receive its proposals
+	var wg sync.WaitGroup
+	messageBuffer, _ := json.Marshal(viewChange)
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer pbft.Node) {
+			defer wg.Done()
+			resp, err := transport.Post(peer.String(), "view-change", messageBuffer)
+			if err != nil {
+				fmt.Println("[ERROR] failed to send view change to", peer.Identifier, err.Error())
+				return
+			}
+			resp.Body.Close()
+		}(peer)
+	}
+	wg.Wait()
+
+	for _, proposal := range proposals {
+		bc.broadcast(proposal)
+	}
+}
+
+func (bc *Blockchain) HttpNewView(w http.ResponseWriter, r *http.Request) {
+	// A replica moved to a new view.
+	w.Header().Set("Content-Type", "application/json")
+
+	var message NewView
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	voter := bc.replicaById(message.VoterId)
+	bc.mutex.Unlock()
+
+	if err := pbft.VerifyPeer(r, voter); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	if err := bc.addNewView(message); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(pbft.JsonBodyPadding("ok"))
+}
+
+func (bc *Blockchain) HttpViewChange(w http.ResponseWriter, r *http.Request) {
+	// The leader of a new view started it.
+	w.Header().Set("Content-Type", "application/json")
+
+	var viewChange ViewChange
+	if err := json.NewDecoder(r.Body).Decode(&viewChange); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	leader := bc.leaderOf(viewChange.View)
+	if err := pbft.VerifyPeer(r, leader); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+	if viewChange.LeaderId != leader.Identifier || pbft.VerifyMessage(leader, viewChange.unsigned(), viewChange.Signature) != nil {
+		http.Error(w, pbft.JsonBodyPadding("not sent by the leader of the view"), http.StatusForbidden)
+		return
+	}
+
+	if viewChange.View < bc.View {
+		// outdated
+		json.NewEncoder(w).Encode(pbft.JsonBodyPadding("ok"))
+		return
+	}
+
+	voters := make(map[string]bool)
+	for _, message := range viewChange.NewViews {
+		if message.View == viewChange.View && bc.verifyNewView(message) == nil {
+			voters[message.VoterId] = true
+		}
+	}
+	if len(voters) < bc.quorum() {
+		http.Error(w, pbft.JsonBodyPadding(fmt.Sprintf("%v valid new-view messages, %v required", len(voters), bc.quorum())), http.StatusBadRequest)
+		return
+	}
+
+	if viewChange.View > bc.View {
+		fmt.Println("[HOTSTUFF] entering view", viewChange.View)
+		bc.enterView(viewChange.View)
+	}
+	// proposals of the previous views that aren't proposed again are abandoned
+	bc.lastProposed = bc.Executed
+	if last := lastPrepared(viewChange.NewViews); last > bc.lastProposed {
+		bc.lastProposed = last
+	}
+	bc.resetTimer()
+
+	json.NewEncoder(w).Encode(pbft.JsonBodyPadding("ok"))
+}
@@ -0,0 +1,498 @@
+package hotstuff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"evoting/consensus"
+	"evoting/pbft"
+	"evoting/transport"
+
+	"github.com/gorilla/mux"
+)
+
+func (bc *Blockchain) nextBlockId() int {
+	// Called with the mutex held.
+	if bc.lastProposed > bc.Executed {
+		return bc.lastProposed + 1
+	}
+	return bc.Executed + 1
+}
+
+func (bc *Blockchain) HttpRequest(w http.ResponseWriter, r *http.Request) {
+	// The leader proposes a block for the client's request, backups forward the request to the leader.
+	w.Header().Set("Content-Type", "application/json")
+
+	var req pbft.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// either the client itself or a backup forwarding the request
+	if pbft.VerifyPeer(r, req.Client) != nil && bc.VerifyReplica(r) != nil {
+		http.Error(w, pbft.JsonBodyPadding("request must come from the client or a replica"), http.StatusForbidden)
+		return
+	}
+
+	info, err := bc.submit(req, r.URL.Query().Get("forwarded") != "")
+	if err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusServiceUnavailable)
+		return
+	}
+
+	json.NewEncoder(w).Encode(info)
+}
+
+func (bc *Blockchain) Submit(requestId string, transactions []consensus.Transaction) (consensus.Receipt, error) {
+	// Request submitted through the shared API (see consensus/http.go) - there is no client to send the replies to.
+	info, err := bc.submit(pbft.Request{RequestId: requestId, Timestamp: int(time.Now().Unix()), Transactions: transactions}, false)
+	if err != nil {
+		return consensus.Receipt{}, err
+	}
+	return consensus.Receipt{RequestId: requestId, Status: "pending", BlockId: info.VotingData.BlockId}, nil
+}
+
+func (bc *Blockchain) submit(req pbft.Request, forwarded bool) (pbft.VotingInfo, error) {
+	// Proposes a block for the request, returns the block the request was assigned to.
+	bc.mutex.Lock()
+
+	if id, known := bc.requests[pbft.RequestKey(req.Client.Identifier, req.RequestId)]; known && req.RequestId != "" {
+		// retransmitted request - repeat the reply if the block has been executed already
+		if reply, replied := bc.replies[id]; replied {
+			go pbft.SendReply(req.Client, reply)
+		}
+		info := bc.proposals[id].votingInfo()
+		bc.mutex.Unlock()
+		return info, nil
+	}
+
+	if !bc.isLeader() {
+		leader := bc.Leader()
+		if bc.waitingSince.IsZero() {
+			// the leader has to propose the request before the view times out
+			bc.waitingSince = time.Now()
+		}
+		bc.mutex.Unlock()
+
+		if forwarded {
+			// replicas disagree on the leader (e.g. a replica joined recently)
+			return pbft.VotingInfo{}, errors.New("not the leader")
+		}
+
+		info, err := pbft.ForwardRequest(leader, "request?forwarded=true", req)
+		if err != nil {
+			fmt.Println("[ERROR] failed to forward request to the leader:", err.Error())
+			return pbft.VotingInfo{}, errors.New("failed to forward request to the leader")
+		}
+		return info, nil
+	}
+
+	if bc.View > bc.started {
+		// the block ids of the previous views are proposed again first, see startView
+		if bc.waitingSince.IsZero() {
+			bc.waitingSince = time.Now()
+		}
+		bc.mutex.Unlock()
+		return pbft.VotingInfo{}, errors.New("view change in progress, try again later")
+	}
+
+	block := pbft.Block{Identifier: bc.nextBlockId(), Timestamp: int(time.Now().Unix()), Transactions: append([]pbft.Transaction{}, req.Transactions...)}
+	proposal := Proposal{Phase: phasePrepare, View: bc.View, Block: block, Digest: pbft.CalculateHash(block), Client: req.Client, RequestId: req.RequestId, LeaderId: bc.Self.Identifier}
+	proposal.Signature = bc.sign(proposal)
+	bc.record(proposal)
+	fmt.Println("[HOTSTUFF] Request, new block:", block.Identifier)
+	bc.mutex.Unlock()
+
+	go bc.broadcast(proposal)
+	return proposal.votingInfo(), nil
+}
+
+func (bc *Blockchain) record(p Proposal) {
+	// Stores the accepted proposal of a block id. Called with the mutex held.
+	id := p.Block.Identifier
+	if known, exists := bc.proposals[id]; exists {
+		if known.Digest == p.Digest {
+			return
+		}
+		// another block proposed after a view change - the request of the abandoned block may be submitted again
+		key := pbft.RequestKey(known.Client.Identifier, known.RequestId)
+		if known.RequestId != "" && bc.requests[key] == id {
+			delete(bc.requests, key)
+		}
+	}
+
+	bc.proposals[id] = p
+	if id > bc.lastProposed {
+		bc.lastProposed = id
+	}
+	if p.RequestId != "" {
+		bc.requests[pbft.RequestKey(p.Client.Identifier, p.RequestId)] = id
+	}
+	if bc.waitingSince.IsZero() {
+		bc.waitingSince = time.Now()
+	}
+}
+
+func (bc *Blockchain) broadcast(p Proposal) {
+	// Sends the leader's message to all replicas, the leader handles it as well. Must not be called while holding the mutex.
+	bc.mutex.Lock()
+	peers := bc.Peers
+	bc.mutex.Unlock()
+
+	messageBuffer, _ := json.Marshal(p)
+	for _, peer := range peers {
+		go func(peer pbft.Node) {
+			resp, err := transport.Post(peer.String(), "proposal", messageBuffer)
+			if err != nil {
+				fmt.Println("[ERROR] failed to send", p.Phase, "of block", p.Block.Identifier, "to", peer.Identifier, err.Error())
+				return
+			}
+			resp.Body.Close()
+		}(peer)
+	}
+
+	bc.process(p)
+}
+
+func (bc *Blockchain) process(p Proposal) error {
+	// Handles a message of the leader and votes for it. Must not be called while holding the mutex.
+	bc.mutex.Lock()
+	vote, err := bc.accept(p)
+	behind := p.Phase == phaseDecide && p.Block.Identifier > bc.Executed+1
+	leader := bc.Leader()
+	bc.mutex.Unlock()
+
+	if err != nil {
+		fmt.Println("[ERROR]", p.Phase, "of block", p.Block.Identifier, "refused:", err.Error())
+		return err
+	}
+	if vote != nil {
+		bc.sendVote(leader, *vote)
+	}
+	if behind && leader.Identifier != bc.Self.Identifier {
+		// decide messages of the preceding blocks were missed (the leader's own decide messages are only reordered)
+		bc.catchUp(leader, p.Block.Identifier)
+	}
+	return nil
+}
+
+func (bc *Blockchain) accept(p Proposal) (*Vote, error) {
+	/*
+		Verifies the message, returns the vote to send (nil in the decide phase).
+		The commit certificate proves the decision, so decide messages of earlier views are accepted as well
+		(replicas catching up, view changes). Other messages have to belong to the current view.
+		Called with the mutex held.
+	*/
+	leader := bc.leaderOf(p.View)
+	if p.LeaderId != leader.Identifier || (p.View != bc.View && p.Phase != phaseDecide) {
+		return nil, errors.New("not sent by the leader of the current view")
+	}
+	if err := pbft.VerifyMessage(leader, p.unsigned(), p.Signature); err != nil {
+		return nil, errors.New("incorrect signature")
+	}
+	if p.Digest != pbft.CalculateHash(p.Block) {
+		return nil, errors.New("digest does not match the block")
+	}
+
+	id := p.Block.Identifier
+	if id <= bc.Executed {
+		return nil, nil
+	}
+
+	if p.Phase != phasePrepare {
+		if err := bc.verifyCertificate(p.Justify, previousPhase(p.Phase), p); err != nil {
+			return nil, err
+		}
+	} else if p.Justify != nil {
+		// block re-proposed after a view change, with the highest certificate the leader collected
+		if err := bc.verifyJustified(p); err != nil || p.Justify.View >= p.View {
+			return nil, errors.New("incorrect certificate of the re-proposed block")
+		}
+	}
+
+	if accepted, exists := bc.proposals[id]; exists && accepted.Digest != p.Digest && accepted.View == p.View {
+		// a replica never votes for two blocks with the same id in a view
+		return nil, fmt.Errorf("conflicting proposal for block %v", id)
+	}
+	if lock, locked := bc.prepared[id]; p.Phase == phasePrepare && locked && locks(lock.Justify) && lock.Digest != p.Digest {
+		// a locked replica votes for another block only if a later view certified it
+		if p.Justify == nil || p.Justify.View <= lock.Justify.View {
+			return nil, fmt.Errorf("locked on another proposal for block %v", id)
+		}
+	}
+	bc.record(p)
+
+	if known, exists := bc.prepared[id]; p.Justify != nil && (!exists || higherCertificate(p.Justify, known.Justify)) {
+		bc.prepared[id] = p
+	}
+
+	if p.Phase == phaseDecide {
+		bc.decided[id] = p
+		bc.execute()
+		return nil, nil
+	}
+
+	vote := Vote{Phase: p.Phase, View: p.View, BlockId: id, Digest: p.Digest, VoterId: bc.Self.Identifier}
+	vote.Signature = bc.sign(vote)
+	return &vote, nil
+}
+
+func (bc *Blockchain) sendVote(leader pbft.Node, vote Vote) {
+	if leader.Identifier == bc.Self.Identifier {
+		bc.addVote(vote)
+		return
+	}
+
+	messageBuffer, _ := json.Marshal(vote)
+	resp, err := transport.Post(leader.String(), "vote", messageBuffer)
+	if err != nil {
+		fmt.Println("[ERROR] failed to send", vote.Phase, "vote of block", vote.BlockId, "to the leader", err.Error())
+		return
+	}
+	resp.Body.Close()
+}
+
+func (bc *Blockchain) addVote(vote Vote) error {
+	// Leader: collects the votes of a phase, the next phase starts once a quorum voted.
+	bc.mutex.Lock()
+
+	voter := bc.replicaById(vote.VoterId)
+	if voter == (pbft.Node{}) {
+		bc.mutex.Unlock()
+		return fmt.Errorf("voter %v not found", vote.VoterId)
+	}
+	if err := pbft.VerifyMessage(voter, vote.unsigned(), vote.Signature); err != nil {
+		bc.mutex.Unlock()
+		return errors.New("incorrect signature")
+	}
+
+	id := vote.BlockId
+	proposal, exists := bc.proposals[id]
+	if !bc.isLeader() || !exists || proposal.Digest != vote.Digest || vote.View != bc.View || id <= bc.Executed || bc.certified[id][vote.Phase] {
+		// late or unrelated vote
+		bc.mutex.Unlock()
+		return nil
+	}
+
+	if bc.votes[id] == nil {
+		bc.votes[id] = make(map[string][]Vote)
+		bc.certified[id] = make(map[string]bool)
+	}
+	for _, v := range bc.votes[id][vote.Phase] {
+		if v.VoterId == vote.VoterId {
+			bc.mutex.Unlock()
+			return nil
+		}
+	}
+	bc.votes[id][vote.Phase] = append(bc.votes[id][vote.Phase], vote)
+
+	if len(bc.votes[id][vote.Phase]) < bc.quorum() {
+		bc.mutex.Unlock()
+		return nil
+	}
+
+	qc := QuorumCertificate{Phase: vote.Phase, View: vote.View, BlockId: id, Digest: vote.Digest, Votes: bc.votes[id][vote.Phase]}
+	bc.certified[id][vote.Phase] = true
+	delete(bc.votes[id], vote.Phase)
+
+	next := proposal
+	next.Phase, next.Justify, next.LeaderId, next.Signature = nextPhase(vote.Phase), &qc, bc.Self.Identifier, ""
+	next.Signature = bc.sign(next)
+	bc.mutex.Unlock()
+
+	bc.broadcast(next)
+	return nil
+}
+
+func (bc *Blockchain) execute() {
+	// Executes decided blocks in order of their identifiers and replies to the clients. Called with the mutex held.
+	for {
+		id := bc.Executed + 1
+		proposal, decided := bc.decided[id]
+		if !decided {
+			return
+		}
+
+		bc.Executed = id
+		delete(bc.votes, id)
+		delete(bc.certified, id)
+		delete(bc.prepared, id)
+		bc.prune(id - executedRetention)
+
+		// the next block is expected within a view timeout again
+		bc.viewChanges = 0
+		bc.resetTimer()
+
+		block := proposal.Block
+		block.PreviousBlockHash = pbft.CalculateHash(bc.LastBlock())
+
+		// empty blocks filling gaps after a view change (see pacemaker.go) are rejected as well
+		if reasons := bc.validateBlock(block); len(reasons) > 0 {
+			fmt.Println("[INFO] block", id, "rejected, reasons:", reasons)
+			bc.replyToClient(proposal, pbft.Reply{Result: "rejected", Reasons: reasons})
+			continue
+		}
+
+		bc.AppendBlock(block)
+		bc.Certificates[id] = *proposal.Justify
+		bc.replyToClient(proposal, pbft.Reply{Result: "committed", BlockHash: pbft.CalculateHash(block)})
+	}
+}
+
+func (bc *Blockchain) prune(blockId int) {
+	// Drops the messages and replies of executed blocks up to the given id. Called with the mutex held.
+	for id := bc.pruned + 1; id <= blockId; id++ {
+		if p, exists := bc.proposals[id]; exists && p.RequestId != "" {
+			key := pbft.RequestKey(p.Client.Identifier, p.RequestId)
+			if bc.requests[key] == id {
+				delete(bc.requests, key)
+			}
+		}
+		delete(bc.proposals, id)
+		delete(bc.prepared, id)
+		delete(bc.decided, id)
+		delete(bc.replies, id)
+	}
+	if blockId > bc.pruned {
+		bc.pruned = blockId
+	}
+}
+
+func (bc *Blockchain) validateBlock(block pbft.Block) []pbft.RejectReason {
+	return pbft.ValidateTransactions(block.Transactions, bc.TokenUsed)
+}
+
+func (bc *Blockchain) replyToClient(proposal Proposal, reply pbft.Reply) {
+	// Signs the reply, records it and sends it to the client. Called with the mutex held.
+	if proposal.Client.Identifier == "" {
+		return
+	}
+
+	reply.BlockId, reply.ReplicaId, reply.RequestIds = proposal.Block.Identifier, bc.Self.Identifier, []string{}
+	if proposal.RequestId != "" {
+		reply.RequestIds = []string{proposal.RequestId}
+	}
+	reply.Signature = bc.sign(reply)
+	bc.replies[reply.BlockId] = reply
+
+	go pbft.SendReply(proposal.Client, reply)
+}
+
+func (bc *Blockchain) catchUp(from pbft.Node, blockId int) {
+	// Fetches the decide messages of the blocks preceding the given block id.
+	fetched := false
+	for {
+		bc.mutex.Lock()
+		next := bc.Executed + 1
+		bc.mutex.Unlock()
+
+		if next >= blockId {
+			return
+		}
+
+		resp, err := transport.Get(from.String(), fmt.Sprintf("decided/%v", next))
+		if err != nil {
+			fmt.Println("[ERROR] failed to fetch block", next, "from", from.Identifier, err.Error())
+			return
+		}
+
+		var decided Proposal
+		decodingErr := json.NewDecoder(resp.Body).Decode(&decided)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && !fetched {
+			// the replica pruned the decision already - fetch its chain instead
+			fetched = true
+			if err := bc.fetchChain(from); err != nil {
+				fmt.Println("[ERROR]", err.Error())
+				return
+			}
+			continue
+		}
+		if decodingErr != nil || resp.StatusCode != http.StatusOK || decided.Phase != phaseDecide || decided.Block.Identifier != next {
+			fmt.Println("[ERROR] replica", from.Identifier, "did not send block", next)
+			return
+		}
+
+		if bc.process(decided) != nil {
+			return
+		}
+	}
+}
+
+func (bc *Blockchain) HttpProposal(w http.ResponseWriter, r *http.Request) {
+	// A message of the leader starting a phase.
+	w.Header().Set("Content-Type", "application/json")
+
+	var proposal Proposal
+	if err := json.NewDecoder(r.Body).Decode(&proposal); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	leader := bc.Leader()
+	bc.mutex.Unlock()
+
+	if err := pbft.VerifyPeer(r, leader); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	if err := bc.process(proposal); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(pbft.JsonBodyPadding("ok"))
+}
+
+func (bc *Blockchain) HttpVote(w http.ResponseWriter, r *http.Request) {
+	// A replica's vote, sent to the leader only.
+	w.Header().Set("Content-Type", "application/json")
+
+	var vote Vote
+	if err := json.NewDecoder(r.Body).Decode(&vote); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	voter := bc.replicaById(vote.VoterId)
+	bc.mutex.Unlock()
+
+	if err := pbft.VerifyPeer(r, voter); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	if err := bc.addVote(vote); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+	json.NewEncoder(w).Encode(pbft.JsonBodyPadding("ok"))
+}
+
+func (bc *Blockchain) HttpGetDecided(w http.ResponseWriter, r *http.Request) {
+	// Decide message (with the commit certificate) of an executed block, used by replicas that missed it.
+	w.Header().Set("Content-Type", "application/json")
+
+	blockId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect block id"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	decided, exists := bc.decided[blockId]
+	if !exists {
+		http.Error(w, pbft.JsonBodyPadding("block not decided"), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(decided)
+}
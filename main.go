@@ -1,16 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"evoting/consensus"
+	"evoting/hotstuff"
 	"evoting/pbft"
+	"evoting/poa"
 	"evoting/pow"
+	"evoting/raft"
+	"evoting/transport"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"math/rand"
 	"os"
 	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
-const blockchainDifficulty int = 3
+const blockchainDifficulty int = 12 // leading zero bits of the pow genesis block hash
 
 func RandomString(n int) string {
 	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -22,60 +33,365 @@ func RandomString(n int) string {
 	return string(s)
 }
 
+func keygen(args []string) {
+	/*
+		Provisions a node ahead of time: creates its keystore and prints the node's cluster config entry.
+		The keystore is encrypted if KEYSTORE_PASSWORD is set.
+	*/
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	outPtr := fs.String("out", "", "Keystore file to create")
+	typePtr := fs.String("type", "blockchain", "Node type: blockchain / client")
+	addressPtr := fs.String("address", "127.0.0.1", "Node address (cluster config entry)")
+	portPtr := fs.Int("port", 5000, "Node port (cluster config entry)")
+	schemePtr := fs.String("scheme", pbft.DefaultScheme, "Signature scheme: ed25519 / rsa")
+	caCertPtr := fs.String("ca_cert", "", "CA certificate - if set, a TLS certificate for the node is issued to <out>.crt")
+	caKeyPtr := fs.String("ca_key", "", "CA private key used to issue the TLS certificate")
+	fs.Parse(args)
+
+	if *outPtr == "" {
+		fmt.Println("[ERROR] -out is required")
+		os.Exit(1)
+	}
+
+	signer, err := pbft.GenerateSigningKey(*schemePtr)
+	if err != nil {
+		fmt.Println("[ERROR] failed to generate key:", err.Error())
+		os.Exit(1)
+	}
+
+	if err := pbft.SaveKeystore(*outPtr, signer, pbft.KeystorePassword()); err != nil {
+		fmt.Println("[ERROR] failed to create keystore:", err.Error())
+		os.Exit(1)
+	}
+
+	if *caCertPtr != "" {
+		cert, err := pbft.IssueCertificate(signer, pbft.NodeIdFromKey(signer.Public()), *addressPtr, *caCertPtr, *caKeyPtr)
+		if err != nil {
+			fmt.Println("[ERROR] failed to issue certificate:", err.Error())
+			os.Exit(1)
+		}
+		if err := ioutil.WriteFile(*outPtr+".crt", cert, 0644); err != nil {
+			fmt.Println("[ERROR] failed to save certificate:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	entry := pbft.NodeConfig{
+		Identifier: pbft.NodeIdFromKey(signer.Public()),
+		Address:    *addressPtr,
+		Port:       *portPtr,
+		Type:       *typePtr,
+		PublicKey:  string(signer.Public()),
+	}
+	entryJson, _ := json.MarshalIndent(entry, "", "  ")
+	fmt.Println(string(entryJson))
+}
+
+func enableTLS() {
+	// mutual TLS between replicas, client nodes, the connector and node discovery
+	if err := transport.EnableFromEnv(); err != nil {
+		fmt.Println("[ERROR] failed to enable TLS:", err.Error())
+		os.Exit(1)
+	}
+}
+
+func replicaSet(clusterFile string) []pbft.Node {
+	// Replicas from the static cluster config if given, node discovery (DISCOVERY_ADDR) otherwise.
+	if clusterFile != "" {
+		cluster, err := pbft.LoadClusterConfig(clusterFile)
+		if err != nil {
+			fmt.Println("[ERROR] failed to load cluster config:", err.Error())
+			os.Exit(1)
+		}
+		return cluster.BlockchainNodes()
+	}
+
+	replicas, err := pbft.DiscoverReplicas(os.Getenv("DISCOVERY_ADDR"))
+	if err != nil {
+		fmt.Println("[ERROR] failed to fetch replicas from node discovery:", err.Error())
+		os.Exit(1)
+	}
+	return replicas
+}
+
+func certify(args []string) {
+	/*
+		Freezes the results at a chain height and writes a report signed by a quorum of replicas.
+	*/
+	fs := flag.NewFlagSet("certify", flag.ExitOnError)
+	heightPtr := fs.Int("height", -1, "Chain height to certify, defaults to the highest height reached by 2f+1 replicas")
+	outPtr := fs.String("out", "report.json", "Report file to create")
+	clusterPtr := fs.String("cluster", "", "Static cluster config file (JSON), node discovery is used if not set")
+	fs.Parse(args)
+
+	enableTLS()
+
+	report, err := pbft.CertifyResults(replicaSet(*clusterPtr), *heightPtr)
+	if err != nil {
+		fmt.Println("[ERROR] failed to certify results:", err.Error())
+		os.Exit(1)
+	}
+
+	reportJson, _ := json.MarshalIndent(report, "", "  ")
+	if err := ioutil.WriteFile(*outPtr, reportJson, 0644); err != nil {
+		fmt.Println("[ERROR] failed to save report:", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("[INFO] results at height %v signed by %v of %v replicas, report saved to %v\n",
+		report.Results.Height, len(report.Attestations), len(report.Replicas), *outPtr)
+}
+
+func verifyReport(args []string) {
+	/*
+		Verifies a results report. Replica keys are taken from the cluster config if given, otherwise from
+		node discovery (DISCOVERY_ADDR) - never from the report itself.
+	*/
+	fs := flag.NewFlagSet("verify-report", flag.ExitOnError)
+	reportPtr := fs.String("report", "report.json", "Report file to verify")
+	clusterPtr := fs.String("cluster", "", "Static cluster config file (JSON) with the trusted replica keys")
+	fs.Parse(args)
+
+	data, err := ioutil.ReadFile(*reportPtr)
+	if err != nil {
+		fmt.Println("[ERROR] failed to read report:", err.Error())
+		os.Exit(1)
+	}
+
+	var report pbft.ResultsReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		fmt.Println("[ERROR] failed to parse report:", err.Error())
+		os.Exit(1)
+	}
+
+	if *clusterPtr == "" && os.Getenv("DISCOVERY_ADDR") == "" {
+		fmt.Println("[ERROR] trusted replica keys required, set -cluster or DISCOVERY_ADDR")
+		os.Exit(1)
+	}
+	if *clusterPtr == "" {
+		enableTLS()
+	}
+
+	valid, err := pbft.VerifyReport(report, replicaSet(*clusterPtr))
+	if err != nil {
+		fmt.Println("[ERROR] report is not valid:", err.Error())
+		os.Exit(1)
+	}
+
+	resultsJson, _ := json.MarshalIndent(report.Results, "", "  ")
+	fmt.Printf("[INFO] report is valid, %v valid signatures\n%v\n", valid, string(resultsJson))
+}
+
+type nodeOptions struct {
+	cluster *pbft.ClusterConfig // static cluster config, node discovery is used if nil
+	nodeId  string
+	key     string
+	scheme  string
+	port    int
+
+	// pow
+	root           bool
+	peerPort       int
+	blockTime      int
+	retarget       int
+	blockSize      int
+	miningInterval time.Duration
+
+	// raft
+	dataDir string
+}
+
+func replica(engine consensus.Engine, err error) (consensus.Engine, error) {
+	// Keeps a nil *Blockchain out of the returned interface.
+	if err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// Engine constructors by -consensus value.
+var engines = map[string]func(opts nodeOptions) (consensus.Engine, error){
+	// Proof of Work
+	"pow": newPow,
+
+	// Practical Byzantine Fault Tolerance
+	"pbft": func(opts nodeOptions) (consensus.Engine, error) {
+		if opts.cluster != nil {
+			return replica(pbft.NewStaticBlockchain(opts.cluster, opts.nodeId, opts.key))
+		}
+		return replica(pbft.NewBlockchain(opts.port, opts.key, opts.scheme))
+	},
+
+	// Proof of Authority - same setup and client interface as PBFT
+	"poa": func(opts nodeOptions) (consensus.Engine, error) {
+		if opts.cluster != nil {
+			return replica(poa.NewStaticBlockchain(opts.cluster, opts.nodeId, opts.key))
+		}
+		return replica(poa.NewBlockchain(opts.port, opts.key, opts.scheme))
+	},
+
+	// Raft - crash fault tolerant, same setup and client interface as PBFT
+	"raft": func(opts nodeOptions) (consensus.Engine, error) {
+		if opts.cluster != nil {
+			return replica(raft.NewStaticBlockchain(opts.cluster, opts.nodeId, opts.key, opts.dataDir))
+		}
+		return replica(raft.NewBlockchain(opts.port, opts.key, opts.scheme, opts.dataDir))
+	},
+
+	// HotStuff - BFT with votes aggregated by the leader, same setup and client interface as PBFT
+	"hotstuff": func(opts nodeOptions) (consensus.Engine, error) {
+		if opts.cluster != nil {
+			return replica(hotstuff.NewStaticBlockchain(opts.cluster, opts.nodeId, opts.key))
+		}
+		return replica(hotstuff.NewBlockchain(opts.port, opts.key, opts.scheme))
+	},
+}
+
+func newPow(opts nodeOptions) (consensus.Engine, error) {
+	/*
+		Creates a PoW node, fetches the chain from its peers (unless it's the root node) and starts mining.
+	*/
+	var hostname string
+	var port int
+	if os.Getenv("DOCKER") == "1" {
+		hostname = os.Getenv("HOSTNAME")
+		port, _ = strconv.Atoi(os.Getenv("PORT"))
+	} else {
+		hostname = "127.0.0.1"
+		port = opts.port
+	}
+
+	blockchain := pow.NewBlockchain(blockchainDifficulty, opts.blockTime, opts.retarget, hostname, port)
+	blockchain.DiscoveryAddress = os.Getenv("DISCOVERY_ADDR")
+	if err := blockchain.LoadKey(opts.key, opts.scheme); err != nil {
+		return nil, err
+	}
+
+	if blockchain.DiscoveryAddress != "" {
+		// peers are found through the node discovery service
+		if err := blockchain.RegisterNode(); err != nil {
+			fmt.Println("[ERROR] failed to register node at node discovery service:", err.Error())
+		}
+		if err := blockchain.RefreshPeers(); err != nil {
+			fmt.Println("[ERROR] failed to refresh peers:", err.Error())
+		}
+		if !opts.root {
+			fmt.Println("Fetching chain from peers")
+			blockchain.Update(true)
+		}
+	} else if !opts.root {
+		// not the "root" node - fetch existing chain from other peers
+		fmt.Println("Fetching chain from peers")
+		if os.Getenv("DOCKER") == "1" {
+			peerHostname := os.Getenv("PEER_HOSTNAME")
+			peerPort, _ := strconv.Atoi(os.Getenv("PEER_PORT"))
+			blockchain.Peers = append(blockchain.Peers,
+				pow.Node{Address: peerHostname, Port: peerPort},
+			)
+		} else {
+			blockchain.Peers = append(blockchain.Peers,
+				pow.Node{Address: "127.0.0.1", Port: opts.peerPort},
+			)
+		}
+
+		blockchain.Update(true)
+	}
+
+	blockchain.PropagateSelf()
+	go blockchain.Mine(opts.blockSize, opts.miningInterval)
+	return blockchain, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "keygen":
+			keygen(os.Args[2:])
+			return
+		case "certify":
+			certify(os.Args[2:])
+			return
+		case "verify-report":
+			verifyReport(os.Args[2:])
+			return
+		}
+	}
+
 	// cli params
 	clientPtr := flag.Bool("client_mode", false, "run client mode (middleman between web app and blockchain)")
 	portPtr := flag.Int("port", 5000, "HTTP server port")
 	rootPtr := flag.Bool("root", false, "Is node the root node - initialize a new chain")
 	peerPortPtr := flag.Int("peer", 5001, "Localhost peer port flag")
-	consensusPtr := flag.String("consensus", "pow", "Consensus mechanism: pow / poa / pbft")
+	consensusPtr := flag.String("consensus", "pow", "Consensus mechanism: pow / poa / pbft / raft / hotstuff")
+	clusterPtr := flag.String("cluster", "", "Static cluster config file (JSON), used instead of the node discovery service")
+	nodeIdPtr := flag.String("node_id", "", "Identifier of this node in the static cluster config")
+	keyPtr := flag.String("key", "", "Keystore (PEM private key) file of this node, created on first start if missing; see the keygen subcommand")
+	schemePtr := flag.String("key_scheme", pbft.DefaultScheme, "Signature scheme of newly generated keys: ed25519 / rsa")
+	blockTimePtr := flag.Int("block_time", 10, "Target block interval in seconds (pow), has to be the same on all nodes")
+	retargetPtr := flag.Int("retarget_interval", 10, "Number of blocks between difficulty adjustments (pow), has to be the same on all nodes")
+	blockSizePtr := flag.Int("block_size", 100, "Maximum number of transactions per block, a full mempool is mined right away (pow)")
+	miningIntervalPtr := flag.Int("mining_interval", 5, "Seconds between mining pending transactions (pow)")
+	dataDirPtr := flag.String("data_dir", "data", "Directory of the persistent replica state (raft), one subdirectory per node")
 
 	flag.Parse()
 
-	if *clientPtr {
-		pbft.StartClient(*portPtr)
-		return
-	}
+	enableTLS()
 
-	if *consensusPtr == "pow" {
-		// Proof of Work
-		var hostname string
-		var port int
-		if os.Getenv("DOCKER") == "1" {
-			hostname = os.Getenv("HOSTNAME")
-			port, _ = strconv.Atoi(os.Getenv("PORT"))
-		} else {
-			hostname = "127.0.0.1"
-			port = *portPtr
+	var cluster *pbft.ClusterConfig
+	if *clusterPtr != "" {
+		var err error
+		cluster, err = pbft.LoadClusterConfig(*clusterPtr)
+		if err != nil {
+			fmt.Println("[ERROR] failed to load cluster config:", err.Error())
+			os.Exit(1)
 		}
+	}
 
-		blockchain := pow.NewBlockchain(blockchainDifficulty, hostname, port)
-
-		if !*rootPtr {
-			// not the "root" node - fetch existing chain from other peers
-			fmt.Println("Fetching chain from peers")
-			if os.Getenv("DOCKER") == "1" {
-				peerHostname := os.Getenv("PEER_HOSTNAME")
-				peerPort, _ := strconv.Atoi(os.Getenv("PEER_PORT"))
-				blockchain.Peers = append(blockchain.Peers,
-					pow.Node{Address: peerHostname, Port: peerPort},
-				)
-			} else {
-				blockchain.Peers = append(blockchain.Peers,
-					pow.Node{Address: "127.0.0.1", Port: *peerPortPtr},
-				)
+	if *clientPtr {
+		if cluster != nil {
+			if err := pbft.StartStaticClient(cluster, *nodeIdPtr, *keyPtr, *schemePtr); err != nil {
+				fmt.Println("[ERROR]", err.Error())
+				os.Exit(1)
 			}
-
-			blockchain.Update(true)
+			return
+		}
+		if err := pbft.StartClient(*portPtr, *keyPtr, *schemePtr); err != nil {
+			fmt.Println("[ERROR]", err.Error())
+			os.Exit(1)
 		}
+		return
+	}
+
+	newEngine, ok := engines[*consensusPtr]
+	if !ok {
+		fmt.Println("[ERROR] unknown consensus mechanism:", *consensusPtr)
+		os.Exit(1)
+	}
 
-		fmt.Println("Starting HTTP server on port", blockchain.Self.Port)
-		blockchain.PropagateSelf()
-		pow.HandleRequests(blockchain)
-	} else if *consensusPtr == "pbft" {
-		// Practical Byzantine Fault Tolerance
-		blockchain := pbft.NewBlockchain(*portPtr)
-		fmt.Println("Starting HTTP server on port", *portPtr)
-		pbft.HandleRequests(*portPtr, blockchain)
+	engine, err := newEngine(nodeOptions{
+		cluster:        cluster,
+		nodeId:         *nodeIdPtr,
+		key:            *keyPtr,
+		scheme:         *schemePtr,
+		port:           *portPtr,
+		root:           *rootPtr,
+		peerPort:       *peerPortPtr,
+		blockTime:      *blockTimePtr,
+		retarget:       *retargetPtr,
+		blockSize:      *blockSizePtr,
+		miningInterval: time.Duration(*miningIntervalPtr) * time.Second,
+		dataDir:        *dataDirPtr,
+	})
+	if err != nil {
+		fmt.Println("[ERROR]", err.Error())
+		os.Exit(1)
 	}
+
+	// engine specific endpoints, then /submit, the read API and /events shared by all engines
+	r := mux.NewRouter()
+	engine.Routes(r)
+	consensus.HandleApi(r, engine)
+
+	fmt.Println("Starting HTTP server on port", engine.Port())
+	log.Fatal(transport.ListenAndServe(engine.Port(), r))
 }
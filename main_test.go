@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"evoting/consensus"
+	"evoting/pbft"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+Conformance of the engines to consensus.Engine. Every engine runs as a single node (a one node static cluster,
+the pow root node), so no network is involved.
+*/
+
+const commitTimeout = 30 * time.Second
+
+func newTestEngine(t *testing.T, name string, dir string) consensus.Engine {
+	keystore := filepath.Join(dir, "node.pem")
+	signer, err := pbft.LoadOrCreateKeystore(keystore, nil, pbft.SchemeEd25519)
+	if err != nil {
+		t.Fatalf("creating keystore: %v", err)
+	}
+
+	nodeId := pbft.NodeIdFromKey(signer.Public())
+	opts := nodeOptions{
+		nodeId:         nodeId,
+		key:            keystore,
+		scheme:         pbft.SchemeEd25519,
+		port:           5000,
+		root:           true,
+		blockTime:      1,
+		retarget:       10,
+		blockSize:      100,
+		miningInterval: 100 * time.Millisecond,
+		dataDir:        filepath.Join(dir, "data"),
+	}
+	if name != "pow" {
+		opts.cluster = &pbft.ClusterConfig{Nodes: []pbft.NodeConfig{{Identifier: nodeId, Address: "127.0.0.1", Port: opts.port,
+			Type: "blockchain", PublicKey: string(signer.Public())}}}
+	}
+
+	engine, err := engines[name](opts)
+	if err != nil {
+		t.Fatalf("creating %v engine: %v", name, err)
+	}
+	return engine
+}
+
+func submit(t *testing.T, engine consensus.Engine, requestId string, transactions ...consensus.Transaction) error {
+	// Retries transient errors (e.g. no leader elected yet), returns the error if the transactions are invalid.
+	deadline := time.Now().Add(commitTimeout)
+	for {
+		_, err := engine.Submit(requestId, transactions)
+		if err == nil || errors.Is(err, consensus.ErrInvalid) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("submitting request %v: %v", requestId, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func waitForToken(t *testing.T, engine consensus.Engine, token string) consensus.Block {
+	deadline := time.Now().Add(commitTimeout)
+	for {
+		if block, found := engine.BlockByToken(token); found {
+			return block
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transaction with token %v not committed within %v", token, commitTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func checkTally(t *testing.T, engine consensus.Engine, want map[string]int) {
+	t.Helper()
+	tally := engine.Tally()
+
+	total := 0
+	for party, votes := range want {
+		total += votes
+		if tally.Votes[party] != votes {
+			t.Fatalf("tally = %v, want %v", tally.Votes, want)
+		}
+	}
+	if tally.TotalVotes != total || len(tally.Votes) != len(want) {
+		t.Fatalf("tally = %v (%v votes), want %v", tally.Votes, tally.TotalVotes, want)
+	}
+
+	last, found := engine.BlockAt(engine.Height())
+	if !found || tally.Height != last.Height || tally.BlockHash != last.Hash {
+		t.Fatalf("tally at height %v (%v), last block at height %v (%v)", tally.Height, tally.BlockHash, last.Height, last.Hash)
+	}
+}
+
+func checkLookups(t *testing.T, engine consensus.Engine, block consensus.Block) {
+	// Every lookup returns the same block, which links to the block before it.
+	t.Helper()
+	lookups := []struct {
+		name  string
+		block consensus.Block
+		found bool
+	}{}
+	add := func(name string, b consensus.Block, found bool) {
+		lookups = append(lookups, struct {
+			name  string
+			block consensus.Block
+			found bool
+		}{name, b, found})
+	}
+	byId, found := engine.BlockById(block.Identifier)
+	add("BlockById", byId, found)
+	byHash, found := engine.BlockByHash(block.Hash)
+	add("BlockByHash", byHash, found)
+	atHeight, found := engine.BlockAt(block.Height)
+	add("BlockAt", atHeight, found)
+
+	for _, lookup := range lookups {
+		if !lookup.found {
+			t.Fatalf("%v: block %v not found", lookup.name, block.Identifier)
+		}
+		if lookup.block.Hash != block.Hash || lookup.block.Identifier != block.Identifier || lookup.block.Height != block.Height {
+			t.Fatalf("%v: got block %v at height %v (%v), want block %v at height %v (%v)", lookup.name,
+				lookup.block.Identifier, lookup.block.Height, lookup.block.Hash, block.Identifier, block.Height, block.Hash)
+		}
+	}
+
+	previous, found := engine.BlockAt(block.Height - 1)
+	if !found || block.PreviousBlockHash != previous.Hash {
+		t.Fatalf("block at height %v links to %v, block at height %v is %v", block.Height, block.PreviousBlockHash,
+			block.Height-1, previous.Hash)
+	}
+}
+
+func TestEngineConformance(t *testing.T) {
+	vote := func(token string, party string) consensus.Transaction {
+		return consensus.Transaction{TokenId: token, ToId: party}
+	}
+
+	for _, name := range []string{"pow", "pbft", "poa", "raft", "hotstuff"} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "engine")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engine := newTestEngine(t, name, dir)
+
+			// empty chain - just the genesis block
+			if height := engine.Height(); height != 0 {
+				t.Fatalf("height of a new chain = %v, want 0", height)
+			}
+			if _, found := engine.BlockAt(0); !found {
+				t.Fatal("genesis block not found")
+			}
+			for _, height := range []int{-1, 1} {
+				if _, found := engine.BlockAt(height); found {
+					t.Fatalf("block found at height %v of a new chain", height)
+				}
+			}
+			checkTally(t, engine, map[string]int{})
+
+			// a committed block is found by every lookup
+			if err := submit(t, engine, "r1", vote("t1", "a"), vote("t2", "b")); err != nil {
+				t.Fatalf("submitting valid transactions: %v", err)
+			}
+			block := waitForToken(t, engine, "t1")
+			if other := waitForToken(t, engine, "t2"); other.Hash != block.Hash {
+				t.Fatal("transactions of a request committed in different blocks")
+			}
+			if block.Height < 1 || block.Height > engine.Height() {
+				t.Fatalf("block at height %v, chain height %v", block.Height, engine.Height())
+			}
+			checkLookups(t, engine, block)
+			checkTally(t, engine, map[string]int{"a": 1, "b": 1})
+
+			// the backlog of a subscriber holds the committed blocks, new blocks are streamed
+			backlog, events, cancel := engine.Subscribe(0)
+			defer cancel()
+			if len(backlog) == 0 || backlog[len(backlog)-1].Height != engine.Height() {
+				t.Fatalf("backlog of %v events does not end at height %v", len(backlog), engine.Height())
+			}
+			for i := 1; i < len(backlog); i++ {
+				if backlog[i].Height != backlog[i-1].Height+1 {
+					t.Fatalf("backlog jumps from height %v to %v", backlog[i-1].Height, backlog[i].Height)
+				}
+			}
+
+			// neither retransmissions nor reused tokens or invalid transactions are counted
+			submit(t, engine, "r1", vote("t1", "a"), vote("t2", "b"))
+			submit(t, engine, "r2", vote("t1", "b"))
+			submit(t, engine, "r3", vote("", "a"))
+			if err := submit(t, engine, "r4", vote("t3", "a")); err != nil {
+				t.Fatalf("submitting valid transactions: %v", err)
+			}
+			last := waitForToken(t, engine, "t3")
+			checkLookups(t, engine, last)
+			if again, _ := engine.BlockByToken("t1"); again.Hash != block.Hash {
+				t.Fatalf("token t1 found in block %v, committed in block %v", again.Identifier, block.Identifier)
+			}
+
+			// engines may commit rejected or empty blocks in between, the tally catches up with the last block
+			deadline := time.Now().Add(commitTimeout)
+			for engine.Tally().Height < last.Height && time.Now().Before(deadline) {
+				time.Sleep(50 * time.Millisecond)
+			}
+			checkTally(t, engine, map[string]int{"a": 2, "b": 1})
+
+			select {
+			case event, open := <-events:
+				if !open || event.Height <= backlog[len(backlog)-1].Height {
+					t.Fatalf("no commit event after height %v", backlog[len(backlog)-1].Height)
+				}
+			case <-time.After(commitTimeout):
+				t.Fatal("no commit event for new blocks")
+			}
+		})
+	}
+}
@@ -2,4 +2,10 @@ module evoting/nodediscovery
 
 go 1.13
 
-require github.com/gorilla/mux v1.8.0
+require (
+	evoting v0.0.0
+	github.com/gorilla/mux v1.8.0
+)
+
+// shares the transport and node identities with the replicas
+replace evoting => ../
@@ -5,32 +5,30 @@ Simple server that keeps track of all nodes and their type (blockchain/client).
 */
 
 import (
-	"crypto/rsa"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"time"
+
+	"evoting/pbft"
+	"evoting/transport"
 
 	"github.com/gorilla/mux"
 )
 
-type Node struct {
-	Address    string         `json:"address"`
-	Port       int            `json:"port"`
-	Type       string         `json:"node-type"`
-	Identifier string         `json:"node-id"`
-	PublicKey  *rsa.PublicKey `json:"public-key"`
-}
+const refreshTimeout = 5 * time.Second
 
-func (n Node) String() string {
-	return fmt.Sprintf("%v:%v", n.Address, n.Port)
-}
+// Nodes register with the same description the replicas use, including their public keys.
+type Node = pbft.Node
 
 type NodeDiscovery struct {
 	BlockchainNodes []Node
 	ClientNodes     []Node
 	VotingParties   []VotingParty
+	mutex           sync.Mutex
 }
 
 type VotingParty struct {
@@ -52,6 +50,9 @@ func (nd *NodeDiscovery) GetPartyById(id string) *VotingParty {
 }
 
 func (nd *NodeDiscovery) HttpGetAllNodes(w http.ResponseWriter, r *http.Request) {
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+
 	var all []Node
 	all = append(all, nd.BlockchainNodes...)
 	all = append(all, nd.ClientNodes...)
@@ -60,14 +61,23 @@ func (nd *NodeDiscovery) HttpGetAllNodes(w http.ResponseWriter, r *http.Request)
 }
 
 func (nd *NodeDiscovery) HttpGetBlockchain(w http.ResponseWriter, r *http.Request) {
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+
 	json.NewEncoder(w).Encode(nd.BlockchainNodes)
 }
 
 func (nd *NodeDiscovery) HttpGetClients(w http.ResponseWriter, r *http.Request) {
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+
 	json.NewEncoder(w).Encode(nd.ClientNodes)
 }
 
 func (nd *NodeDiscovery) HttpGetVotingParties(w http.ResponseWriter, r *http.Request) {
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+
 	json.NewEncoder(w).Encode(nd.VotingParties)
 }
 
@@ -80,6 +90,9 @@ func (nd *NodeDiscovery) HttpRegisterParty(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+
 	if nd.GetPartyById(newParty.Identifier) == nil {
 		nd.VotingParties = append(nd.VotingParties, newParty)
 	}
@@ -102,23 +115,78 @@ func (nd *NodeDiscovery) HttpRegisterNode(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if newNode.Type == "blockchain" {
-		nd.BlockchainNodes = append(nd.BlockchainNodes, newNode)
-	} else if newNode.Type == "client" {
-		nd.ClientNodes = append(nd.ClientNodes, newNode)
-	} else {
+	if err := pbft.VerifyPeer(r, newNode); err != nil {
+		http.Error(w, fmt.Sprintf(`{"detail": "%v"}`, err.Error()), http.StatusForbidden)
+		return
+	}
+
+	if newNode.Type != "blockchain" && newNode.Type != "client" {
 		http.Error(w, "{\"detail\": \"incorrect node type\"}", http.StatusBadRequest)
 		return
 	}
+
+	nd.mutex.Lock()
+	if err := nd.upsert(newNode); err != nil {
+		nd.mutex.Unlock()
+		http.Error(w, fmt.Sprintf(`{"detail": "%v"}`, err.Error()), http.StatusConflict)
+		return
+	}
+	blockchainNodes := append([]Node(nil), nd.BlockchainNodes...)
+	nd.mutex.Unlock()
+
 	fmt.Println("[INFO] New peer registered", newNode)
 	json.NewEncoder(w).Encode(`{"detail":"ok"}`)
 
-	for _, node := range nd.BlockchainNodes {
-		_, err := http.Get(fmt.Sprintf("http://%v/refresh", node))
-		if err != nil {
-			fmt.Println("[ERR] failed to trigger refresh at", node)
+	go triggerRefresh(blockchainNodes)
+}
+
+func triggerRefresh(nodes []Node) {
+	// Asks all blockchain nodes to reload their peers, in parallel - an unreachable node doesn't hold up the others.
+	client := transport.ClientWithTimeout(refreshTimeout)
+	for _, node := range nodes {
+		go func(node Node) {
+			resp, err := client.Get(transport.NodeURL(node.String(), "refresh"))
+			if err != nil {
+				fmt.Println("[ERR] failed to trigger refresh at", node)
+				return
+			}
+			resp.Body.Close()
+		}(node)
+	}
+}
+
+func (nd *NodeDiscovery) upsert(newNode Node) error {
+	/*
+		Registers the node, replacing an earlier registration with the same identifier (a restarted node).
+		Over TLS the key of a registered node can't be changed - the registration is verified against the key
+		it carries, so anyone could take over an identifier otherwise.
+		Called with the mutex held.
+	*/
+	var blockchainNodes, clientNodes []Node
+	for _, existing := range append(append([]Node(nil), nd.BlockchainNodes...), nd.ClientNodes...) {
+		if existing.Identifier == newNode.Identifier {
+			if transport.Enabled() && existing.PublicKey != newNode.PublicKey {
+				return fmt.Errorf("node %v is already registered with a different key", newNode.Identifier)
+			}
+			continue
+		}
+
+		if existing.Type == "blockchain" {
+			blockchainNodes = append(blockchainNodes, existing)
+		} else {
+			clientNodes = append(clientNodes, existing)
 		}
 	}
+
+	if newNode.Type == "blockchain" {
+		blockchainNodes = append(blockchainNodes, newNode)
+	} else {
+		clientNodes = append(clientNodes, newNode)
+	}
+
+	nd.BlockchainNodes = blockchainNodes
+	nd.ClientNodes = clientNodes
+	return nil
 }
 
 func HandleRequests(port int, nd *NodeDiscovery) {
@@ -133,12 +201,17 @@ func HandleRequests(port int, nd *NodeDiscovery) {
 	r.HandleFunc("/get-parties", nd.HttpGetVotingParties).Methods("GET")
 	r.HandleFunc("/register-party", nd.HttpRegisterParty).Methods("POST")
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), r))
+	log.Fatal(transport.ListenAndServe(port, r))
 }
 
 func main() {
 	nd := NewDiscovery()
 	portPtr := flag.Int("port", 9999, "HTTP listener port")
+	flag.Parse()
+
+	if err := transport.EnableFromEnv(); err != nil {
+		log.Fatal("[ERROR] failed to enable TLS: ", err.Error())
+	}
 
 	fmt.Println("[Node Discovery] Starting HTTP Listener on port", *portPtr)
 	HandleRequests(*portPtr, nd)
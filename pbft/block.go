@@ -16,7 +16,7 @@ func (b Block) AddTransaction(ta Transaction) {
 	b.Transactions = append(b.Transactions, ta)
 }
 
-func calculateHash(block Block) string {
+func CalculateHash(block Block) string {
 	hash := sha256.New()
 	hash.Write([]byte(fmt.Sprintf("%v", block)))
 
@@ -1,81 +1,162 @@
 package pbft
 
 import (
-	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
+
+	"evoting/consensus"
+	"evoting/transport"
 )
 
 type Blockchain struct {
-	Chain            []Block           `json:"chain"`
-	Peers            []Node            `json:"-"` // right now not shared but could be used to propagate new peers
-	Votings          map[string]Voting `json:"-"` // key - block ID, block ID stored as string so that the map can be encoded as JSON
-	Identifier       string            `json:"node-id"`
-	BlockBuffer      map[int]Block     `json:"-"`
-	DiscoveryAddress string            `json:"-"`
-	Self             Node              `json:"-"`
+	Ledger                        // chain, indexes and tally, see query.go
+	Membership                    // peers (other replicas), see membership.go
+	Votings     map[string]Voting `json:"-"` // key - block ID, block ID stored as string so that the map can be encoded as JSON
+	Identifier  string            `json:"node-id"`
+	BlockBuffer map[int]Block     `json:"-"`
+	View        int               `json:"-"` // PBFT view, determines the primary replica; view changes are not implemented, a crashed primary is never replaced
+	Executed    int               `json:"-"` // sequence number (block ID) of the last executed or rejected block
+	mutex       *sync.Mutex
+
+	requests map[string]*requestEntry // client requests by client and request id
 }
 
-type VotingInfo struct {
-	VotingData Voting `json:"voting-data"`
-	BlockData  Block  `json:"block-data"`
+func NewBlockchain(port int, keystore string, scheme string) (*Blockchain, error) {
+	/*
+		Creates a replica registered at the node discovery service.
+		If keystore is empty a throwaway key is generated and the hostname is used as the identifier.
+	*/
+	hostname := os.Getenv("HOSTNAME")
+
+	self := Node{Address: hostname, Port: port, Identifier: hostname, Type: "blockchain"}
+
+	var signer Signer
+	var err error
+	if keystore == "" {
+		// generate a throwaway signing key
+		signer, err = GenerateSigningKey(scheme)
+	} else {
+		signer, err = LoadOrCreateKeystore(keystore, KeystorePassword(), scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	self.PublicKey, self.signer = signer.Public(), signer
+	if keystore != "" {
+		self.Identifier = NodeIdFromKey(self.PublicKey)
+	}
+
+	if err := CheckTLSIdentity(self); err != nil {
+		return nil, err
+	}
+
+	return newBlockchain(self, nil), nil
 }
 
-func NewBlockchain(port int) *Blockchain {
-	var bc Blockchain
-	// uuid in production, for debug id=hostname
-	// bc.Identifier = uuid.NewString()
-	bc.DiscoveryAddress = os.Getenv("DISCOVERY_ADDR")
-	bc.Votings = make(map[string]Voting)
-	bc.BlockBuffer = make(map[int]Block)
+func NewStaticBlockchain(cluster *ClusterConfig, identifier string, keystore string) (*Blockchain, error) {
+	/*
+		Creates a replica described by the static cluster config.
+		Node discovery is not used - peers are taken from the config.
+		If identifier is empty it is derived from the keystore's public key.
+	*/
+	signer, err := LoadKeystore(keystore, KeystorePassword())
+	if err != nil {
+		return nil, err
+	}
 
-	hostname := os.Getenv("HOSTNAME")
-	// DEBUG mode
-	bc.Identifier = hostname
+	if identifier == "" {
+		identifier = NodeIdFromKey(signer.Public())
+	}
 
-	// generate priv/pub signing key pair
-	priv, pub := GenerateSigningKeyPair()
+	self, err := cluster.NodeById(identifier)
+	if err != nil {
+		return nil, err
+	}
 
-	self := Node{hostname, port, bc.Identifier, "blockchain", pub, &priv}
-	bc.Self = self
+	if self.Type != "blockchain" {
+		return nil, fmt.Errorf("node %v is not a blockchain node", identifier)
+	}
+
+	if signer.Public() != self.PublicKey {
+		return nil, fmt.Errorf("private key does not match the public key of node %v", identifier)
+	}
+	self.signer = signer
+
+	if err := CheckTLSIdentity(self); err != nil {
+		return nil, err
+	}
+
+	return newBlockchain(self, cluster), nil
+}
+
+func newBlockchain(self Node, cluster *ClusterConfig) *Blockchain {
+	var bc Blockchain
+	bc.mutex = &sync.Mutex{}
+	bc.Ledger = NewLedger(bc.mutex, self.Identifier, self.signer)
+	bc.Membership = NewMembership(self, cluster, os.Getenv("DISCOVERY_ADDR"), bc.mutex)
+	bc.Votings = make(map[string]Voting)
+	bc.BlockBuffer = make(map[int]Block)
+	bc.requests = make(map[string]*requestEntry)
+	bc.Identifier = self.Identifier
 
 	bc.RegisterNode()
 
 	bc.RefreshPeers()
-	if len(bc.Peers) < 1 {
+	if bc.Cluster != nil {
+		// replicas of a static cluster usually start at the same time - all of them share the same genesis block
+		bc.Chain = append(bc.Chain, Block{Identifier: 0, Timestamp: 0, Transactions: []Transaction{}, PreviousBlockHash: ""})
+		bc.FetchChain()
+	} else if len(bc.Peers) < 1 {
 		fmt.Println("[INFO] too few peers, creating genesis block (peers:", bc.Peers, ")")
 		// create genesis block
 		initBlock := Block{Identifier: 0, Timestamp: int(time.Now().Unix()), Transactions: []Transaction{}, PreviousBlockHash: ""}
 		bc.Chain = append(bc.Chain, initBlock)
 	} else {
-		fmt.Println("[INFO] fetching blockchain from a peer")
-		peer := RandomNode(bc.Peers)
+		bc.FetchChain()
+	}
+	bc.Reindex()
 
-		// prevent asking self for the current chain
-		for peer.Address == bc.Self.Address && peer.Port == bc.Self.Port {
-			peer = RandomNode(bc.Peers)
-		}
+	return &bc
+}
 
-		resp, error := http.Get(fmt.Sprintf("http://%v/chain", peer))
-		if error != nil {
-			fmt.Printf("[ERROR] failed to fetch blockchain data from %v", peer)
-		} else {
-			newChain, decodingErr := ReconstructBlockchain(resp.Body)
-			if decodingErr != "" {
-				fmt.Println("[ERROR] erroring parsing peer blockchain:", decodingErr)
-			}
-			bc.Chain = newChain.Chain
-		}
+func (bc *Blockchain) FetchChain() {
+	/*
+		Replaces the local chain with the chain of a random peer (if the peer's chain is longer).
+	*/
+	if len(bc.Peers) < 1 {
+		return
 	}
 
-	return &bc
+	fmt.Println("[INFO] fetching blockchain from a peer")
+	peer := RandomNode(bc.Peers)
+
+	resp, error := transport.Get(peer.String(), "chain")
+	if error != nil {
+		fmt.Printf("[ERROR] failed to fetch blockchain data from %v\n", peer)
+		return
+	}
+
+	newChain, decodingErr := ReconstructBlockchain(resp.Body)
+	if decodingErr != "" {
+		fmt.Println("[ERROR] erroring parsing peer blockchain:", decodingErr)
+		return
+	}
+
+	if len(newChain.Chain) > len(bc.Chain) {
+		bc.Chain = newChain.Chain
+		bc.Executed = bc.LastBlock().Identifier
+		bc.Reindex()
+	}
 }
 
 func ReconstructBlockchain(r io.ReadCloser) (Blockchain, string) {
@@ -89,133 +170,152 @@ func ReconstructBlockchain(r io.ReadCloser) (Blockchain, string) {
 	return bc, ""
 }
 
-func (bc Blockchain) MaximumFaultyNodes() int {
+func (bc *Blockchain) MaximumFaultyNodes() int {
 	// Max faulty nodes for PBFT is floor((n-1)/3).
 
 	return int(len(bc.Peers) / 3) // peers + self = n
 }
 
-func (bc Blockchain) RegisterNode() {
-	messageBuffer, _ := json.Marshal(bc.Self)
-	resp, err := http.Post(fmt.Sprintf("http://%v/register", bc.DiscoveryAddress), "application/json", bytes.NewBuffer(messageBuffer))
+func (bc *Blockchain) Replicas() []Node {
+	// All replicas (peers and self) ordered by identifier - the same order on every replica.
+	replicas := append([]Node{bc.Self}, bc.Peers...)
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].Identifier < replicas[j].Identifier })
+	return replicas
+}
 
-	if err != nil || resp.StatusCode != 200 {
-		fmt.Println("[ERROR] failed to register node at node discovery service")
-		if err != nil {
-			fmt.Println("details:", err.Error())
-		} else {
-			bodyBytes, _ := ioutil.ReadAll(resp.Body)
-			fmt.Println("status code:", resp.StatusCode, ", discovery response:", string(bodyBytes))
-		}
-	} else {
-		fmt.Println("[INFO] Node registered")
-	}
+func (bc *Blockchain) Primary(view int) Node {
+	replicas := bc.Replicas()
+	return replicas[view%len(replicas)]
 }
 
-func (bc Blockchain) LastBlock() Block {
-	if len(bc.Chain) < 1 { // chain empty
-		return Block{}
-	}
-	return bc.Chain[len(bc.Chain)-1]
+func (bc *Blockchain) IsPrimary() bool {
+	return bc.Primary(bc.View).Identifier == bc.Self.Identifier
 }
 
-func (bc *Blockchain) PeerById(id string) Node {
-	for _, peer := range bc.Peers {
-		if peer.Identifier == id {
-			return peer
+func (bc *Blockchain) nextBlockId() int {
+	// Next sequence number assigned by the primary, blocks still being voted on are taken into account.
+	next := bc.Executed + 1
+	for id := range bc.BlockBuffer {
+		if id >= next {
+			next = id + 1
 		}
 	}
-	return Node{}
+	for key := range bc.Votings {
+		if id, _ := strconv.Atoi(key); id >= next {
+			next = id + 1
+		}
+	}
+	return next
 }
 
-func (bc *Blockchain) InsertVote(vote VoteRequest, selfVote bool) {
-	voting, exists := bc.Votings[strconv.Itoa(vote.BlockId)]
+func (bc *Blockchain) minVotes() int {
+	return len(bc.Peers) + 1 - bc.MaximumFaultyNodes()
+}
 
-	voter := bc.PeerById(vote.VoterId)
-	if voter == (Node{}) && !selfVote {
-		fmt.Println("[ERROR] voter of given id not found", voter, "vote:", vote)
-		return
+func (bc *Blockchain) InsertVote(vote VoteRequest, verified bool) {
+	// Accepts a prepare message. Signature is checked unless the caller has already verified it (or cast the vote itself).
+	voter := bc.Self
+	if vote.VoterId != bc.Self.Identifier {
+		voter = bc.PeerById(vote.VoterId)
+		if voter == (Node{}) {
+			fmt.Println("[ERROR] voter of given id not found", voter, "vote:", vote)
+			return
+		}
 	}
 
-	if selfVote {
-		voter = bc.Self
+	if !verified {
+		if err := VerifyMessage(voter, vote.unsigned(), vote.Signature); err != nil {
+			fmt.Println("[ERROR] voter signature doesnt match", voter.Identifier, err.Error())
+			return
+		}
 	}
 
-	yesError := VerifySignature(voter.PublicKey, []byte(vote.Vote), "yes")
-	noError := VerifySignature(voter.PublicKey, []byte(vote.Vote), "no")
-
-	voteMsg := ""
-
-	if yesError == nil {
-		voteMsg = "yes"
-	} else if noError == nil {
-		voteMsg = "no"
-	} else {
-		fmt.Println("voter signature doesnt match", voter, "yes", yesError, ", no", noError)
+	if vote.View != bc.View {
+		fmt.Println("[ERROR] vote from", voter.Identifier, "for view", vote.View, "ignored, current view:", bc.View)
 		return
 	}
 
+	voting, exists := bc.Votings[strconv.Itoa(vote.BlockId)]
 	if !exists {
 		// create new voting
-		bc.Votings[strconv.Itoa(vote.BlockId)] = Voting{vote.BlockId, []VoteRequest{}, []VoteRequest{}, vote.Client}
-		voting = bc.Votings[strconv.Itoa(vote.BlockId)]
+		voting = Voting{BlockId: vote.BlockId, YesVotes: []VoteRequest{}, NoVotes: []VoteRequest{}, Client: vote.Client}
 	}
 
-	if voteMsg == "yes" {
+	if voting.HasVoted(voter) {
+		return
+	}
+
+	if vote.Vote == "yes" {
 		voting.YesVotes = append(voting.YesVotes, vote)
-	} else if voteMsg == "no" {
+	} else if vote.Vote == "no" {
 		voting.NoVotes = append(voting.NoVotes, vote)
+	} else {
+		fmt.Println("[ERROR] incorrect vote", vote.Vote, "from", voter.Identifier)
+		return
 	}
 
 	bc.Votings[strconv.Itoa(voting.BlockId)] = voting
 	bc.CheckVotingResults(voting.BlockId)
 }
 
-func (bc *Blockchain) RefreshPeers() []Node {
-	var newPeers []Node
-	resp, err := http.Get(fmt.Sprintf("http://%v/get-blockchain", bc.DiscoveryAddress))
+func (bc *Blockchain) InsertCommit(commit CommitVote, verified bool) {
+	// Accepts a commit message. Signature is checked unless the caller has already verified it.
+	replica := bc.Self
+	if commit.ReplicaId != bc.Self.Identifier {
+		replica = bc.PeerById(commit.ReplicaId)
+		if replica == (Node{}) {
+			fmt.Println("[ERROR] replica of given id not found, commit:", commit)
+			return
+		}
+	}
 
-	if err != nil {
-		fmt.Println("[CLIENT] failed to refresh nodes")
-		return nil
+	if !verified {
+		if err := VerifyMessage(replica, commit.unsigned(), commit.Signature); err != nil {
+			fmt.Println("[ERROR] commit signature doesnt match", replica.Identifier, err.Error())
+			return
+		}
 	}
 
-	decodingErr := json.NewDecoder(resp.Body).Decode(&newPeers)
+	if commit.View != bc.View {
+		fmt.Println("[ERROR] commit from", replica.Identifier, "for view", commit.View, "ignored, current view:", bc.View)
+		return
+	}
 
-	if decodingErr != nil {
-		fmt.Println("[ERROR] node discovery's response is ambiguous")
-		return nil
+	voting, exists := bc.Votings[strconv.Itoa(commit.BlockId)]
+	if !exists {
+		// commit arrived before pre-prepare / prepare messages
+		voting = Voting{BlockId: commit.BlockId, YesVotes: []VoteRequest{}, NoVotes: []VoteRequest{}}
 	}
 
-	// remove self from the peer list
-	bc.Peers = nil
-	for _, peer := range newPeers {
-		if peer.Identifier != bc.Self.Identifier {
-			bc.Peers = append(bc.Peers, peer)
-		}
+	if voting.HasCommitted(replica) {
+		return
 	}
-	return bc.Peers
+
+	voting.Commits = append(voting.Commits, commit)
+	bc.Votings[strconv.Itoa(voting.BlockId)] = voting
+	bc.CheckVotingResults(voting.BlockId)
 }
 
 func (bc *Blockchain) PropagateMessage(endpoint string, message interface{}) bool {
 	// Makes an HTTP post request to all discovered peers.
 	// Returns true if propagation was successful, else false.
+	// Must not be called while holding the mutex.
 
 	messageBuffer, bufferErr := json.Marshal(message)
-	// TODO: might want to use digital signatures here for node authentication
 	if bufferErr != nil {
 		return false
 	}
 
 	failedCtr := 0
 
-	bc.RefreshPeers()
+	peers := bc.RefreshPeers()
+	maxFaulty := len(peers) / 3
 
-	for _, peer := range bc.Peers {
-		_, err := http.Post(fmt.Sprintf("http://%v/%v", peer.String(), endpoint), "application/json", bytes.NewBuffer(messageBuffer))
+	for _, peer := range peers {
+		_, err := transport.Post(peer.String(), endpoint, messageBuffer)
 		if err != nil {
 			failedCtr++
-			if failedCtr > bc.MaximumFaultyNodes() {
+			if failedCtr > maxFaulty {
 				return false
 			}
 		}
@@ -223,11 +323,11 @@ func (bc *Blockchain) PropagateMessage(endpoint string, message interface{}) boo
 	return true
 }
 
-func (bc Blockchain) SignMessage(message string) string {
+func (bc *Blockchain) SignMessage(message string) string {
 	/*
 		Returns hex encoded string (signed message).
 	*/
-	signed, _ := SignData([]byte(message), bc.Self.privateKey)
+	signed, _ := bc.Self.signer.Sign([]byte(message))
 
 	signedHex := make([]byte, hex.EncodedLen(len(signed)))
 	hex.Encode(signedHex, signed)
@@ -238,12 +338,15 @@ func (bc Blockchain) SignMessage(message string) string {
 func (bc *Blockchain) HttpGetChain(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	// fmt.Println("GET /chain Request from:", r.RemoteAddr)
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
 	json.NewEncoder(w).Encode(bc)
 }
 
 func (bc *Blockchain) HttpRequest(w http.ResponseWriter, r *http.Request) {
 	// PBFT: Request Phase
-	// Node receives transaction data from a client (and thus becomes the "primary replica").
+	// The primary replica of the current view receives transaction data from a client.
+	// Backups forward the request to the primary.
 
 	var req Request
 	error := json.NewDecoder(r.Body).Decode(&req)
@@ -254,44 +357,91 @@ func (bc *Blockchain) HttpRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, JsonBodyPadding(error.Error()), http.StatusBadRequest)
 		return
 	}
-	_, encodingErr := json.Marshal(req.Transactions)
 
-	if encodingErr != nil {
-		http.Error(w, JsonBodyPadding(error.Error()), http.StatusBadRequest)
+	// either the client itself or a backup forwarding the request
+	if VerifyPeer(r, req.Client) != nil && bc.VerifyReplica(r) != nil {
+		http.Error(w, JsonBodyPadding("request must come from the client or a replica"), http.StatusForbidden)
 		return
 	}
 
+	votingData, err := bc.submit(req)
+	if err != nil {
+		http.Error(w, JsonBodyPadding(err.Error()), http.StatusServiceUnavailable)
+		return
+	}
+
+	json.NewEncoder(w).Encode(votingData)
+}
+
+func (bc *Blockchain) Submit(requestId string, transactions []consensus.Transaction) (consensus.Receipt, error) {
+	// Request submitted through the shared API (see consensus/http.go) - there is no client to send the replies to.
+	votingData, err := bc.submit(Request{RequestId: requestId, Timestamp: int(time.Now().Unix()), Transactions: transactions})
+	if err != nil {
+		return consensus.Receipt{}, err
+	}
+	return consensus.Receipt{RequestId: requestId, Status: "pending", BlockId: votingData.VotingData.BlockId}, nil
+}
+
+func (bc *Blockchain) submit(req Request) (VotingInfo, error) {
+	// Assigns the request to a new block and starts the voting, returns the pre-prepare message of the block.
+	bc.mutex.Lock()
+
+	if entry, exists := bc.knownRequest(req.Client.Identifier, req.RequestId); exists {
+		// retransmitted request - repeat the reply if it has been executed already
+		bc.resendReply(entry)
+		votingData := entry.PrePrepare
+		bc.mutex.Unlock()
+		return votingData, nil
+	}
+
+	if !bc.IsPrimary() {
+		// backups relay the request to the primary of the current view
+		primary := bc.Primary(bc.View)
+		bc.mutex.Unlock()
+
+		votingData, err := ForwardRequest(primary, "request", req)
+		if err != nil {
+			fmt.Println("[ERROR] failed to forward request to the primary:", err.Error())
+			return VotingInfo{}, errors.New("failed to forward request to the primary")
+		}
+		return votingData, nil
+	}
+
 	var newBlock Block
 	newBlock.Transactions = append(newBlock.Transactions, req.Transactions...)
-	newBlock.Identifier = bc.LastBlock().Identifier + 1
+	newBlock.Identifier = bc.nextBlockId()
 	newBlock.Timestamp = int(time.Now().Unix())
-	newBlock.PreviousBlockHash = calculateHash(bc.LastBlock())
+	newBlock.PreviousBlockHash = CalculateHash(bc.LastBlock())
+	digest := CalculateHash(newBlock)
 
 	bc.BlockBuffer[newBlock.Identifier] = newBlock
 
-	newVoting := Voting{BlockId: newBlock.Identifier, YesVotes: []VoteRequest{}, NoVotes: []VoteRequest{}, Client: req.Client}
-	jsonvoting, jsonerr := json.Marshal(newVoting)
-
-	if jsonerr != nil {
-		fmt.Println("json:", string(jsonvoting), "error", jsonerr)
-	}
+	newVoting := Voting{BlockId: newBlock.Identifier, Digest: digest, YesVotes: []VoteRequest{}, NoVotes: []VoteRequest{}, Client: req.Client, RequestId: req.RequestId}
 
-	votingData := VotingInfo{VotingData: newVoting, BlockData: newBlock}
+	votingData := VotingInfo{View: bc.View, VotingData: newVoting, BlockData: newBlock, Digest: digest, Sender: bc.Self.Identifier}
+	votingData.Signature = bc.SignMessage(signedPayload(votingData.unsigned()))
+	bc.logRequest(votingData)
 
 	fmt.Println("[PBFT] Request, new block:", newBlock)
 
 	bc.Votings[strconv.Itoa(newBlock.Identifier)] = newVoting
 	// validate
-	vote := VoteRequest{BlockId: newVoting.BlockId, Vote: bc.SignMessage("yes"), VoterId: bc.Self.Identifier, Client: req.Client}
+	vote := VoteRequest{View: bc.View, BlockId: newBlock.Identifier, Digest: digest, Vote: "yes", VoterId: bc.Self.Identifier, Client: req.Client}
+	if reasons := bc.validateBlock(newBlock); len(reasons) > 0 {
+		vote.Vote, vote.Reasons = "no", reasons
+	}
+	vote.Signature = bc.SignMessage(signedPayload(vote.unsigned()))
 	bc.InsertVote(vote, true)
 
+	bc.mutex.Unlock()
+
 	success := bc.PropagateMessage("pre-prepare", votingData)
-	if success {
-		json.NewEncoder(w).Encode(votingData)
-	} else {
-		http.Error(w, JsonBodyPadding("node connection error"), http.StatusBadRequest)
+	go bc.PropagateMessage("prepare", vote)
+
+	if !success {
+		return VotingInfo{}, errors.New("node connection error")
 	}
-	bc.PropagateMessage("prepare", vote)
+	return votingData, nil
 }
 
 func (bc *Blockchain) HttpPrePrepare(w http.ResponseWriter, r *http.Request) {
@@ -300,39 +450,98 @@ func (bc *Blockchain) HttpPrePrepare(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
+	if err := bc.VerifyReplica(r); err != nil {
+		http.Error(w, JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
 	var votingInfo VotingInfo
 	decodingErr := json.NewDecoder(r.Body).Decode(&votingInfo)
 	if decodingErr != nil {
 		http.Error(w, JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+
+	primary := bc.Primary(votingInfo.View)
+	if votingInfo.View != bc.View || votingInfo.Sender != primary.Identifier {
+		bc.mutex.Unlock()
+		http.Error(w, JsonBodyPadding("pre-prepare must come from the primary of the current view"), http.StatusForbidden)
+		return
+	}
+
+	if err := VerifyPeer(r, primary); err != nil {
+		bc.mutex.Unlock()
+		http.Error(w, JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	if err := VerifyMessage(primary, votingInfo.unsigned(), votingInfo.Signature); err != nil {
+		bc.mutex.Unlock()
+		http.Error(w, JsonBodyPadding("incorrect signature"), http.StatusForbidden)
+		return
 	}
 
 	block := votingInfo.BlockData
 	voting := votingInfo.VotingData
 
+	if CalculateHash(block) != votingInfo.Digest || block.Identifier != voting.BlockId {
+		bc.mutex.Unlock()
+		http.Error(w, JsonBodyPadding("digest does not match the block"), http.StatusBadRequest)
+		return
+	}
+
+	if buffered, exists := bc.BlockBuffer[block.Identifier]; exists && CalculateHash(buffered) != votingInfo.Digest {
+		// the primary can't assign the same sequence number to two different blocks
+		bc.mutex.Unlock()
+		http.Error(w, JsonBodyPadding("another block already pre-prepared with this id"), http.StatusConflict)
+		return
+	}
+
 	fmt.Println("[PBFT] Pre-Prepare, block to validate:", block)
 	json.NewEncoder(w).Encode(JsonBodyPadding("ok"))
 
-	// temporarily we assume all transactions are valid
+	vote := VoteRequest{View: bc.View, BlockId: block.Identifier, Digest: votingInfo.Digest, Vote: "yes", VoterId: bc.Self.Identifier, Client: voting.Client}
 
-	vote := VoteRequest{block.Identifier, bc.SignMessage("yes"), bc.Identifier, voting.Client}
-
-	if block.Identifier < bc.LastBlock().Identifier+1 {
-		vote.Vote = bc.SignMessage("no")
-		bc.InsertVote(vote, false)
-		bc.PropagateMessage("prepare", vote)
-		return
+	if block.Identifier <= bc.Executed {
+		vote.Vote = "no"
+		for _, t := range block.Transactions {
+			vote.Reasons = append(vote.Reasons, RejectReason{t.TokenId, "block id already used"})
+		}
+	} else if entry, exists := bc.knownRequest(voting.Client.Identifier, voting.RequestId); exists && entry.PrePrepare.VotingData.BlockId != block.Identifier {
+		// the primary must not execute a retransmitted request twice
+		vote.Vote = "no"
+		for _, t := range block.Transactions {
+			vote.Reasons = append(vote.Reasons, RejectReason{t.TokenId, fmt.Sprintf("request already assigned to block %v", entry.PrePrepare.VotingData.BlockId)})
+		}
+	} else {
+		bc.logRequest(votingInfo)
+		if reasons := bc.validateBlock(block); len(reasons) > 0 {
+			vote.Vote, vote.Reasons = "no", reasons
+		}
+		// further checks
+		bc.BlockBuffer[block.Identifier] = block
 	}
-	// further checks
-	bc.BlockBuffer[block.Identifier] = block
 
 	/*
 		It's possible that a node receives votes for a particular block before pre-prepare for the block arrives.
-		If that's the case - check if a voting already exists (to prevent overriding existing votes).
+		If that's the case - keep the votes casted so far.
 	*/
-	if _, exists := bc.Votings[strconv.Itoa(block.Identifier)]; !exists {
-		bc.Votings[strconv.Itoa(block.Identifier)] = voting
+	existing, exists := bc.Votings[strconv.Itoa(block.Identifier)]
+	if exists {
+		existing.Digest = votingInfo.Digest
+		existing.Client = voting.Client
+		existing.RequestId = voting.RequestId
+		bc.Votings[strconv.Itoa(block.Identifier)] = existing
+	} else {
+		bc.Votings[strconv.Itoa(block.Identifier)] = Voting{BlockId: block.Identifier, Digest: votingInfo.Digest, YesVotes: []VoteRequest{}, NoVotes: []VoteRequest{}, Client: voting.Client, RequestId: voting.RequestId}
 	}
+
+	vote.Signature = bc.SignMessage(signedPayload(vote.unsigned()))
 	bc.InsertVote(vote, true)
+	bc.mutex.Unlock()
+
 	bc.PropagateMessage("prepare", vote)
 }
 
@@ -346,35 +555,82 @@ func (bc *Blockchain) HttpPrepare(w http.ResponseWriter, r *http.Request) {
 
 	if decodingErr != nil {
 		http.Error(w, JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
 	}
 	// fmt.Println("[PBFT] Prepare, received vote:", vote)
 
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
 	voter := bc.PeerById(vote.VoterId)
 	if voter == (Node{}) {
-		// TODO: verify signature
 		http.Error(w, JsonBodyPadding("peer not found"), http.StatusForbidden)
 		return
 	}
 
-	if vote == (VoteRequest{}) {
-		http.Error(w, JsonBodyPadding("vote invalid"), http.StatusBadRequest)
+	if err := VerifyPeer(r, voter); err != nil {
+		http.Error(w, JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	if err := VerifyMessage(voter, vote.unsigned(), vote.Signature); err != nil {
+		http.Error(w, JsonBodyPadding("incorrect signature"), http.StatusForbidden)
+		return
+	}
+
+	bc.InsertVote(vote, true)
+	json.NewEncoder(w).Encode(JsonBodyPadding("ok"))
+}
+
+func (bc *Blockchain) HttpCommit(w http.ResponseWriter, r *http.Request) {
+	// PBFT: Commit Phase
+	// Accept other nodes' commit messages.
+
+	w.Header().Set("Content-Type", "application/json")
+	var commit CommitVote
+	decodingErr := json.NewDecoder(r.Body).Decode(&commit)
+
+	if decodingErr != nil {
+		http.Error(w, JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	replica := bc.PeerById(commit.ReplicaId)
+	if replica == (Node{}) {
+		http.Error(w, JsonBodyPadding("peer not found"), http.StatusForbidden)
+		return
+	}
+
+	if err := VerifyPeer(r, replica); err != nil {
+		http.Error(w, JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	if err := VerifyMessage(replica, commit.unsigned(), commit.Signature); err != nil {
+		http.Error(w, JsonBodyPadding("incorrect signature"), http.StatusForbidden)
 		return
 	}
 
-	bc.InsertVote(vote, false)
+	bc.InsertCommit(commit, true)
 	json.NewEncoder(w).Encode(JsonBodyPadding("ok"))
-	// check if their result is the same. If so, check if f+1 votes already received. If so, proceed to commit phase.
 }
 
 func (bc *Blockchain) HttpGetPending(w http.ResponseWriter, r *http.Request) {
 	// Debug endpoint
 	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
 	json.NewEncoder(w).Encode(bc.Votings)
 }
 
 func (bc *Blockchain) HttpGetPeers(w http.ResponseWriter, r *http.Request) {
 	// Debug endpoint
 	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
 	json.NewEncoder(w).Encode(bc.Peers)
 }
 
@@ -382,56 +638,83 @@ func (bc *Blockchain) HttpTriggerRefresh(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(JsonBodyPadding("ok"))
 
-	bc.Peers = bc.RefreshPeers()
+	bc.RefreshPeers()
 }
 
 func (bc *Blockchain) CheckVotingResults(blockId int) {
 	// Checks if sufficient number of votes has been casted. If so, proceed to commit.
+	// Called with the mutex held.
 	voting, exists := bc.Votings[strconv.Itoa(blockId)]
-	if !exists {
-		return
+	if !exists || voting.Digest == "" {
+		return // waiting for pre-prepare
 	}
 
 	yesVotes, noVotes := voting.Results()
-	minVotes := len(bc.Peers) + 1 - bc.MaximumFaultyNodes()
+	minVotes := bc.minVotes()
+
+	if yesVotes >= minVotes && !voting.HasCommitted(bc.Self) {
+		// prepared - announce commit
+		commit := CommitVote{View: bc.View, BlockId: blockId, Digest: voting.Digest, ReplicaId: bc.Self.Identifier}
+		commit.Signature = bc.SignMessage(signedPayload(commit.unsigned()))
+		voting.Commits = append(voting.Commits, commit)
+		bc.Votings[strconv.Itoa(blockId)] = voting
+
+		go bc.PropagateMessage("commit", commit)
+	} else if noVotes >= minVotes && !voting.Rejected {
+		// the sequence number is skipped once all preceding blocks are executed
+		voting.Rejected = true
+		bc.Votings[strconv.Itoa(blockId)] = voting
+		delete(bc.BlockBuffer, blockId)
+
+		fmt.Println("[INFO] block", blockId, "rejected, reasons:", voting.RejectReasons())
+		bc.replyToClient(voting, Reply{Result: "rejected", Reasons: voting.RejectReasons()})
+
+		bc.Commit()
+		return
+	}
 
-	if yesVotes >= minVotes || noVotes >= minVotes {
+	if voting.CommitResults() >= minVotes {
 		fmt.Println("[INFO] committing block", blockId, ", min votes:", minVotes)
-		bc.Commit(blockId)
+		bc.Commit()
 	}
 }
 
-func (bc *Blockchain) Commit(blockId int) {
+func (bc *Blockchain) Commit() {
 	// PBFT: Commit Phase
-	// Client node receives replies (votes) from other nodes with the same transactions executed.
-	// Before sending the result to client, nodes await f+1 votes where f is the maximum number of faulty nodes.
-
-	block, bExists := bc.BlockBuffer[blockId]
-	voting, vExists := bc.Votings[strconv.Itoa(blockId)]
-
-	if !bExists || !vExists {
-		fmt.Println("[DEBUG commit] block / voting doesnt exist, waiting for block data in pre-prepare") // enough votes have been casted but pre-prepare hasn't arrived yet.
-		return
-	}
-
-	bc.RefreshPeers() // so that we get accurate minVotes
+	// Executes committed blocks in order of their identifiers and sends the replies to the clients.
+	// Before accepting the result, client nodes await f+1 replies where f is the maximum number of faulty nodes.
+	// Called with the mutex held.
+
+	for {
+		blockId := bc.Executed + 1
+		block, bExists := bc.BlockBuffer[blockId]
+		voting, vExists := bc.Votings[strconv.Itoa(blockId)]
+
+		if vExists && voting.Rejected {
+			delete(bc.Votings, strconv.Itoa(blockId))
+			bc.Executed = blockId
+			continue
+		}
 
-	yesVotes, noVotes := voting.Results()
-	minVotes := len(bc.Peers) + 1 - bc.MaximumFaultyNodes()
+		if !bExists || !vExists || voting.CommitResults() < bc.minVotes() {
+			return // next block not committed yet
+		}
 
-	if yesVotes >= minVotes {
 		delete(bc.Votings, strconv.Itoa(blockId))
-		block.PreviousBlockHash = calculateHash(bc.LastBlock())
-		bc.Chain = append(bc.Chain, block)
-		message := fmt.Sprintf("{\"node-id\": %v}", blockId)
-		messageBuffer, _ := json.Marshal(message)
-		_, err := http.Post(fmt.Sprintf("http://%v/commit", voting.Client.String()), "application/json", bytes.NewBuffer(messageBuffer))
-		if err != nil {
-			// retry?
-			return
+		delete(bc.BlockBuffer, blockId)
+		bc.Executed = blockId
+
+		// Blocks are validated against the chain when pre-prepared, but several blocks may be pre-prepared
+		// concurrently - a token used by a block executed in the meantime invalidates this one.
+		if reasons := bc.validateBlock(block); len(reasons) > 0 {
+			fmt.Println("[PBFT] block", blockId, "rejected at execution")
+			bc.replyToClient(voting, Reply{Result: "rejected", Reasons: reasons})
+			continue
 		}
-	} else if noVotes >= minVotes {
-		// ??? notify the client their block was rejected?
-		return
+
+		block.PreviousBlockHash = CalculateHash(bc.LastBlock())
+		bc.AppendBlock(block)
+
+		bc.replyToClient(voting, Reply{Result: "committed", BlockHash: CalculateHash(block)})
 	}
 }
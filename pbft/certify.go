@@ -0,0 +1,203 @@
+package pbft
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"evoting/consensus"
+	"evoting/transport"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Certification of election results.
+Every replica signs the tally of its chain frozen at the requested height. A report containing the signatures of
+a quorum (2f+1) of replicas over the same tally can be verified offline by anyone who knows the replicas' public keys.
+*/
+
+type Attestation struct {
+	Tally     consensus.Tally `json:"tally"`
+	ReplicaId string          `json:"replica-id"`
+	Signature string          `json:"signature"`
+}
+
+type ReportReplica struct {
+	Identifier string    `json:"node-id"`
+	PublicKey  PublicKey `json:"public-key"`
+}
+
+type ResultsReport struct {
+	Results      consensus.Tally `json:"results"`
+	Replicas     []ReportReplica `json:"replicas"` // replica set the quorum is counted from, informational - verified against a trusted set
+	Attestations []Attestation   `json:"attestations"`
+	Created      int             `json:"created"`
+}
+
+func (m Attestation) unsigned() Attestation {
+	m.Signature = ""
+	return m
+}
+
+func (l *Ledger) HttpCertify(w http.ResponseWriter, r *http.Request) {
+	// GET /certify/{height} - signed tally of the chain up to (and including) the block at the given height.
+	w.Header().Set("Content-Type", "application/json")
+
+	height, err := strconv.Atoi(mux.Vars(r)["height"])
+	if err != nil {
+		http.Error(w, JsonBodyPadding("incorrect height"), http.StatusBadRequest)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if height >= len(l.Chain) {
+		http.Error(w, JsonBodyPadding("height not reached yet"), http.StatusNotFound)
+		return
+	}
+
+	tally := consensus.NewTally()
+	for _, block := range l.Chain[:height+1] {
+		tally.CountTransactions(block.Transactions)
+	}
+	tally.Height, tally.BlockId, tally.BlockHash = height, l.Chain[height].Identifier, CalculateHash(l.Chain[height])
+
+	attestation := Attestation{Tally: tally, ReplicaId: l.replicaId}
+	signed, _ := l.signer.Sign([]byte(signedPayload(attestation.unsigned())))
+	attestation.Signature = hex.EncodeToString(signed)
+
+	json.NewEncoder(w).Encode(attestation)
+}
+
+func DiscoverReplicas(discoveryAddress string) ([]Node, error) {
+	resp, err := transport.Get(discoveryAddress, "get-blockchain")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var nodes []Node
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return nil, fmt.Errorf("node discovery's response is ambiguous: %v", err.Error())
+	}
+	return nodes, nil
+}
+
+func quorumHeight(replicas []Node, f int) (int, error) {
+	// Highest height reached by 2f+1 replicas.
+	var heights []int
+	for _, replica := range replicas {
+		resp, err := transport.Get(replica.String(), "height")
+		if err != nil {
+			fmt.Println("[ERROR] replica", replica.Identifier, "did not report its height:", err.Error())
+			continue
+		}
+
+		var height consensus.Height
+		decodingErr := json.NewDecoder(resp.Body).Decode(&height)
+		resp.Body.Close()
+		if decodingErr == nil {
+			heights = append(heights, height.Height)
+		}
+	}
+
+	if len(heights) < 2*f+1 {
+		return 0, fmt.Errorf("only %v of %v replicas reported their height, %v required", len(heights), len(replicas), 2*f+1)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(heights)))
+	return heights[2*f], nil
+}
+
+func CertifyResults(replicas []Node, height int) (*ResultsReport, error) {
+	/*
+		Collects signed tallies at the given height (or at the highest height reached by 2f+1 replicas if height < 0)
+		and returns a report once 2f+1 replicas signed the same tally.
+	*/
+	if len(replicas) == 0 {
+		return nil, errors.New("no replicas found")
+	}
+	f := (len(replicas) - 1) / 3
+
+	if height < 0 {
+		var err error
+		if height, err = quorumHeight(replicas, f); err != nil {
+			return nil, err
+		}
+	}
+
+	signed := make(map[string][]Attestation) // tally -> attestations
+	for _, replica := range replicas {
+		resp, err := transport.Get(replica.String(), fmt.Sprintf("certify/%v", height))
+		if err != nil {
+			fmt.Println("[ERROR] replica", replica.Identifier, "did not respond:", err.Error())
+			continue
+		}
+
+		var attestation Attestation
+		decodingErr := json.NewDecoder(resp.Body).Decode(&attestation)
+		resp.Body.Close()
+		if decodingErr != nil || resp.StatusCode != http.StatusOK {
+			fmt.Println("[ERROR] replica", replica.Identifier, "did not certify height", height)
+			continue
+		}
+
+		if attestation.ReplicaId != replica.Identifier || VerifyMessage(replica, attestation.unsigned(), attestation.Signature) != nil {
+			fmt.Println("[ERROR] incorrect signature of replica", replica.Identifier)
+			continue
+		}
+
+		key := signedPayload(attestation.Tally)
+		signed[key] = append(signed[key], attestation)
+	}
+
+	for _, attestations := range signed {
+		if len(attestations) < 2*f+1 {
+			continue
+		}
+
+		report := ResultsReport{Results: attestations[0].Tally, Attestations: attestations, Created: int(time.Now().Unix())}
+		for _, replica := range replicas {
+			report.Replicas = append(report.Replicas, ReportReplica{Identifier: replica.Identifier, PublicKey: replica.PublicKey})
+		}
+		return &report, nil
+	}
+
+	return nil, fmt.Errorf("less than %v replicas signed the same results at height %v", 2*f+1, height)
+}
+
+func VerifyReport(report ResultsReport, replicas []Node) (int, error) {
+	/*
+		Offline verification of a results report, returns the number of valid signatures.
+		The replica set has to come from a trusted source (the cluster config or node discovery) - the set listed
+		in the report is never used, whoever forged the signatures could have listed their own keys.
+	*/
+	if len(replicas) == 0 {
+		return 0, errors.New("no trusted replica set to verify the report against")
+	}
+	f := (len(replicas) - 1) / 3
+
+	valid := make(map[string]bool)
+	for _, attestation := range report.Attestations {
+		if signedPayload(attestation.Tally) != signedPayload(report.Results) {
+			continue
+		}
+		for _, replica := range replicas {
+			if replica.Identifier == attestation.ReplicaId && VerifyMessage(replica, attestation.unsigned(), attestation.Signature) == nil {
+				valid[replica.Identifier] = true
+			}
+		}
+	}
+
+	if len(valid) < 2*f+1 {
+		return len(valid), fmt.Errorf("%v valid signatures, %v required", len(valid), 2*f+1)
+	}
+	return len(valid), nil
+}
@@ -1,17 +1,21 @@
 package pbft
 
 import (
-	"bytes"
-	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"evoting/transport"
+
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
@@ -19,52 +23,99 @@ import (
 // This will be the client that makes block requests.
 
 type Request struct {
+	RequestId    string        `json:"request-id"` // assigned by the client (or the connector), retransmissions keep the id
+	Timestamp    int           `json:"timestamp"`
 	Transactions []Transaction `json:"transactions"`
 	Client       Node          `json:"requesting-client"`
+	Callbacks    []string      `json:"callbacks,omitempty"` // webhook URLs invoked once the request is committed
+}
+
+type submittedRequest struct {
+	tokens    []string
+	callbacks []string
+	notified  bool
+}
+
+const defaultWaitTimeout = 10 * time.Second
+
+const (
+	retransmitTimeout  time.Duration = 5 * time.Second // doubled after every retransmission
+	retransmitAttempts int           = 4
+)
+
+const (
+	resultRetention  time.Duration = time.Hour // results and replies of a block are dropped this long after it was first seen
+	maxTrackedBlocks int           = 10000     // ... or earlier, oldest first, once more blocks are tracked
+)
+
+type trackedBlock struct {
+	blockId int
+	since   time.Time
 }
 
-type Commit struct {
-	From    string `json:"node-id"`
-	BlockId int    `json:"block-id"`
+type RequestResult struct {
+	BlockId   int            `json:"block-id"`
+	Status    string         `json:"status"` // pending / committed / rejected / failed (not decided after all retransmissions)
+	BlockHash string         `json:"block-hash,omitempty"`
+	Reasons   []RejectReason `json:"reasons,omitempty"`
 }
 
 type PendingRequests struct {
-	requests         map[int][]Commit // blockId -> slice containing all commits to a block
+	replies          map[int][]Reply // blockId -> replies of all replicas that executed / rejected the block
+	results          map[int]RequestResult
+	waiters          map[int][]chan RequestResult // blockId -> requests waiting for the final result
+	submitted        map[int]*submittedRequest
+	tracked          []trackedBlock // blocks with replies / results, in order they were first seen
+	trackedIds       map[int]bool
+	mutex            sync.Mutex
 	nodes            []Node
 	discoveryAddress string
+	cluster          *ClusterConfig // static cluster config, replaces node discovery if set
+	submitters       []PublicKey    // parties allowed to submit requests over TLS (the connector), see verifySubmitter
 	self             Node
 }
 
-func (pending PendingRequests) MaximumFaultyNodes() int {
+func NewPendingRequests() *PendingRequests {
+	var pending PendingRequests
+	pending.replies = make(map[int][]Reply)
+	pending.results = make(map[int]RequestResult)
+	pending.waiters = make(map[int][]chan RequestResult)
+	pending.submitted = make(map[int]*submittedRequest)
+	pending.trackedIds = make(map[int]bool)
+	return &pending
+}
+
+func (pending *PendingRequests) MaximumFaultyNodes() int {
 	// Max faulty nodes for PBFT is floor((n-1)/3).
 	// slight change compared to the same method in Blockchain struct - not counting self to n
 
 	return int((len(pending.nodes) - 1) / 3)
 }
 
-func (pending *PendingRequests) RegisterNode(addr string, port int, idnt string, pubKey *rsa.PublicKey, privKey *rsa.PrivateKey) {
-	self := Node{Address: addr, Port: port, Identifier: idnt, Type: "client", PublicKey: pubKey, privateKey: privKey}
+func (pending *PendingRequests) RegisterNode(addr string, port int, idnt string, signer Signer) {
+	self := Node{Address: addr, Port: port, Identifier: idnt, Type: "client", PublicKey: signer.Public(), signer: signer}
 	pending.self = self
 
-	messageBuffer, _ := json.Marshal(pending.self)
-	resp, err := http.Post(fmt.Sprintf("http://%v/register", pending.discoveryAddress), "application/json", bytes.NewBuffer(messageBuffer))
-
-	if err != nil || resp.StatusCode != 200 {
-		fmt.Println("[ERROR] failed to register node at node discovery service")
-		if err != nil {
-			fmt.Println("details:", err.Error())
-		} else {
-			bodyBytes, _ := ioutil.ReadAll(resp.Body)
-			fmt.Println("status code:", resp.StatusCode, ", discovery response:", string(bodyBytes))
-		}
-	} else {
-		fmt.Println("[INFO] Node registered")
+	if pending.cluster != nil {
+		// static cluster - nothing to register
+		return
 	}
+
+	RegisterAtDiscovery(pending.discoveryAddress, pending.self)
 }
 
 func (pending *PendingRequests) RefreshNodes() {
 	var newNodes []Node
-	resp, err := http.Get(fmt.Sprintf("http://%v/get-blockchain", pending.discoveryAddress))
+
+	if pending.cluster != nil {
+		newNodes = pending.cluster.BlockchainNodes()
+		pending.mutex.Lock()
+		pending.nodes = newNodes
+		pending.mutex.Unlock()
+		return
+	}
+
+	resp, err := transport.Get(pending.discoveryAddress, "get-blockchain")
 
 	if err != nil {
 		fmt.Println("[CLIENT] failed to refresh nodes")
@@ -78,10 +129,21 @@ func (pending *PendingRequests) RefreshNodes() {
 		return
 	}
 
+	pending.mutex.Lock()
 	pending.nodes = newNodes
+	pending.mutex.Unlock()
+}
+
+func (pending *PendingRequests) NodeById(id string) Node {
+	for _, n := range pending.nodes {
+		if n.Identifier == id {
+			return n
+		}
+	}
+	return Node{}
 }
 
-func (pending PendingRequests) SelectPrimaryReplica() Node {
+func (pending *PendingRequests) SelectPrimaryReplica() Node {
 	if len(pending.nodes) == 0 {
 		return Node{}
 	}
@@ -94,39 +156,260 @@ func (pending PendingRequests) SelectPrimaryReplica() Node {
 
 func (pending *PendingRequests) HttpHandler(port int) {
 	r := mux.NewRouter()
-	r.HandleFunc("/commit", pending.ReceiveCommitInfo).Methods("POST")
-	r.HandleFunc("/new-request", pending.CreateRequest).Methods("POST")
+	r.HandleFunc("/commit", pending.ReceiveReply).Methods("POST")
+	r.HandleFunc("/reject", pending.ReceiveReply).Methods("POST")
+	r.HandleFunc("/submit", pending.CreateRequest).Methods("POST")
+	r.HandleFunc("/new-request", pending.CreateRequest).Methods("POST") // older connectors
+	r.HandleFunc("/result/{block-id}", pending.GetResult).Methods("GET")
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), r))
+	log.Fatal(transport.ListenAndServe(port, r))
 }
 
-func (pendingRequests *PendingRequests) ReceiveCommitInfo(w http.ResponseWriter, r *http.Request) {
+func (pendingRequests *PendingRequests) ReceiveReply(w http.ResponseWriter, r *http.Request) {
+	/*
+		Replicas send a signed reply once the requested block is executed (/commit) or rejected (/reject).
+		The result is accepted once f+1 distinct replicas sent matching replies (result, block hash and request ids)
+		- at least one of them is correct.
+	*/
 	w.Header().Set("Content-Type", "application/json")
-	var newCommit Commit
-	decodingErr := json.NewDecoder(r.Body).Decode(&newCommit)
-	if decodingErr != nil {
+	var reply Reply
+	decodingErr := json.NewDecoder(r.Body).Decode(&reply)
+	if decodingErr != nil || (reply.Result != "committed" && reply.Result != "rejected") {
 		http.Error(w, JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
 		return
 	}
 
-	commits := pendingRequests.requests[newCommit.BlockId]
-	commits = append(commits, newCommit)
-	pendingRequests.requests[newCommit.BlockId] = commits
+	pendingRequests.mutex.Lock()
+	defer pendingRequests.mutex.Unlock()
+
+	replica := pendingRequests.NodeById(reply.ReplicaId)
+	if replica == (Node{}) {
+		http.Error(w, JsonBodyPadding("replica not found"), http.StatusForbidden)
+		return
+	}
+
+	if err := VerifyPeer(r, replica); err != nil {
+		http.Error(w, JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
 
-	f := pendingRequests.MaximumFaultyNodes()
-	if len(pendingRequests.requests[newCommit.BlockId]) > f {
-		delete(pendingRequests.requests, newCommit.BlockId)
-		// maybe notify the web server about successful request submission
+	if err := VerifyMessage(replica, reply.unsigned(), reply.Signature); err != nil {
+		http.Error(w, JsonBodyPadding("incorrect signature"), http.StatusForbidden)
+		return
+	}
+
+	if result, exists := pendingRequests.results[reply.BlockId]; exists && (result.Status == "committed" || result.Status == "rejected") {
+		// late reply, the block has already been decided
+		json.NewEncoder(w).Encode(JsonBodyPadding("ok"))
+		return
+	}
+	pendingRequests.track(reply.BlockId)
+
+	replies := pendingRequests.replies[reply.BlockId]
+	for _, existing := range replies {
+		if existing.ReplicaId == reply.ReplicaId {
+			json.NewEncoder(w).Encode(JsonBodyPadding("ok"))
+			return
+		}
+	}
+	replies = append(replies, reply)
+	pendingRequests.replies[reply.BlockId] = replies
+
+	matching := 0
+	for _, existing := range replies {
+		if existing.matches(reply) {
+			matching++
+		}
+	}
+
+	// f+1 replicas can't all be faulty
+	if matching > pendingRequests.MaximumFaultyNodes() {
+		if reply.Result == "rejected" {
+			fmt.Println("[CLIENT] block", reply.BlockId, "rejected, reasons:", reply.Reasons)
+		}
+		delete(pendingRequests.replies, reply.BlockId)
+		pendingRequests.decide(RequestResult{BlockId: reply.BlockId, Status: reply.Result, BlockHash: reply.BlockHash, Reasons: reply.Reasons})
 	}
 
 	json.NewEncoder(w).Encode(JsonBodyPadding("ok"))
 }
 
-func (pendingRequests *PendingRequests) CreateRequest(w http.ResponseWriter, r *http.Request) {
-	// TODO: perhaps validate if the request is coming from a trusted party?
+func (reply Reply) matches(other Reply) bool {
+	// Replies match if they report the same result for the same block containing the same requests.
+	if reply.Result != other.Result || reply.BlockHash != other.BlockHash || len(reply.RequestIds) != len(other.RequestIds) {
+		return false
+	}
+	for i, requestId := range reply.RequestIds {
+		if other.RequestIds[i] != requestId {
+			return false
+		}
+	}
+	return true
+}
+
+func (pendingRequests *PendingRequests) track(blockId int) {
+	/*
+		Starts tracking replies / results of the block and drops the blocks tracked for too long,
+		so the status maps don't grow without bound.
+		Called with the mutex held.
+	*/
+	if !pendingRequests.trackedIds[blockId] {
+		pendingRequests.trackedIds[blockId] = true
+		pendingRequests.tracked = append(pendingRequests.tracked, trackedBlock{blockId: blockId, since: time.Now()})
+	}
+
+	for len(pendingRequests.tracked) > 0 {
+		oldest := pendingRequests.tracked[0]
+		if len(pendingRequests.tracked) <= maxTrackedBlocks && time.Since(oldest.since) < resultRetention {
+			return
+		}
+
+		pendingRequests.tracked = pendingRequests.tracked[1:]
+		delete(pendingRequests.trackedIds, oldest.blockId)
+		delete(pendingRequests.replies, oldest.blockId)
+		delete(pendingRequests.results, oldest.blockId)
+		delete(pendingRequests.waiters, oldest.blockId)
+		delete(pendingRequests.submitted, oldest.blockId)
+	}
+}
+
+func (pendingRequests *PendingRequests) decide(result RequestResult) {
+	// Stores the final result of a request and wakes up everyone waiting for it.
+	// A request given up on ("failed") can still be decided by replies that arrive later.
+	// Called with the mutex held.
+	if existing, exists := pendingRequests.results[result.BlockId]; exists && existing.Status != "pending" && existing.Status != "failed" {
+		return
+	}
+	pendingRequests.results[result.BlockId] = result
+
+	for _, waiter := range pendingRequests.waiters[result.BlockId] {
+		waiter <- result
+	}
+	delete(pendingRequests.waiters, result.BlockId)
+
+	pendingRequests.notifyWebhooks(result.BlockId)
+}
+
+func (pendingRequests *PendingRequests) notifyWebhooks(blockId int) {
+	/*
+		Invokes callbacks of a committed request.
+		Commit replies may arrive before the primary's response (which contains the block id),
+		so this is called both when the result is decided and when the request is submitted.
+		Called with the mutex held.
+	*/
+	result, decided := pendingRequests.results[blockId]
+	submitted, exists := pendingRequests.submitted[blockId]
+
+	if !decided || !exists || submitted.notified || result.Status != "committed" {
+		return
+	}
+	submitted.notified = true
+
+	payload := WebhookPayload{Event: "committed", BlockId: blockId, BlockHash: result.BlockHash, Tokens: submitted.tokens, Timestamp: int(time.Now().Unix())}
+	for _, url := range submitted.callbacks {
+		go DeliverWebhook(url, payload)
+	}
+}
+
+func (pendingRequests *PendingRequests) WaitForResult(blockId int, timeout time.Duration) RequestResult {
+	// Blocks until the request is committed / rejected, returns the pending result after timeout.
+	pendingRequests.mutex.Lock()
+	if result, exists := pendingRequests.results[blockId]; exists && result.Status != "pending" {
+		pendingRequests.mutex.Unlock()
+		return result
+	}
+
+	waiter := make(chan RequestResult, 1) // buffered - decide never blocks on a waiter that timed out
+	pendingRequests.waiters[blockId] = append(pendingRequests.waiters[blockId], waiter)
+	pendingRequests.mutex.Unlock()
+
+	select {
+	case result := <-waiter:
+		return result
+	case <-time.After(timeout):
+		return RequestResult{BlockId: blockId, Status: "pending"}
+	}
+}
+
+func (pendingRequests *PendingRequests) GetResult(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	blockId, err := strconv.Atoi(mux.Vars(r)["block-id"])
+	if err != nil {
+		http.Error(w, JsonBodyPadding("incorrect block id"), http.StatusBadRequest)
+		return
+	}
+
+	pendingRequests.mutex.Lock()
+	result, exists := pendingRequests.results[blockId]
+	pendingRequests.mutex.Unlock()
+
+	if !exists {
+		http.Error(w, JsonBodyPadding("request not found"), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+func SubmitterKeys() ([]PublicKey, error) {
+	// Public keys listed in SUBMITTER_KEYS (comma separated, encoded as in the cluster config).
+	var keys []PublicKey
+	for _, encoded := range strings.Split(os.Getenv("SUBMITTER_KEYS"), ",") {
+		if encoded = strings.TrimSpace(encoded); encoded == "" {
+			continue
+		}
+		key, err := ParsePublicKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("SUBMITTER_KEYS: %v", err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (pendingRequests *PendingRequests) loadSubmitters() error {
+	keys, err := SubmitterKeys()
+	if err != nil {
+		return err
+	}
+	if transport.Enabled() && len(keys) == 0 {
+		fmt.Println("[CLIENT] SUBMITTER_KEYS is not set, all submitted requests are refused")
+	}
+	pendingRequests.submitters = keys
+	return nil
+}
+
+func (pendingRequests *PendingRequests) verifySubmitter(r *http.Request) error {
+	/*
+		Requests may be submitted only by the parties listed in SUBMITTER_KEYS (the connector), identified by their
+		TLS certificate. Always succeeds if TLS is disabled.
+	*/
+	if !transport.Enabled() {
+		return nil
+	}
+
+	key, ok := PeerPublicKey(r)
+	if !ok {
+		return errors.New("peer certificate missing")
+	}
 
+	for _, submitter := range pendingRequests.submitters {
+		if submitter == key {
+			return nil
+		}
+	}
+	return errors.New("peer certificate does not match any trusted submitter (SUBMITTER_KEYS)")
+}
+
+func (pendingRequests *PendingRequests) CreateRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	if err := pendingRequests.verifySubmitter(r); err != nil {
+		http.Error(w, JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
 	var request Request
 	request.Client = pendingRequests.self
 
@@ -136,49 +419,240 @@ func (pendingRequests *PendingRequests) CreateRequest(w http.ResponseWriter, r *
 		return
 	}
 
-	bodyBuffer, bufferErr := json.Marshal(request)
+	for _, callback := range request.Callbacks {
+		if err := ValidateCallback(callback); err != nil {
+			http.Error(w, JsonBodyPadding(err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
 
-	if bufferErr != nil {
-		http.Error(w, JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
-		return
+	if request.RequestId == "" {
+		request.RequestId = uuid.NewString()
 	}
+	request.Timestamp = int(time.Now().Unix())
 
-	// get new primary replica
 	pendingRequests.RefreshNodes()
-	node := pendingRequests.SelectPrimaryReplica()
-	fmt.Println("[DEBUG] primary replica:", node.Identifier)
-	fmt.Println("[DEBUG] rqeuest:", request)
 
-	response, httpErr := http.Post(fmt.Sprintf("http://%v/request", node.String()), "application/json", bytes.NewBuffer(bodyBuffer))
-	if httpErr != nil {
-		http.Error(w, JsonBodyPadding("failed to connect to blockchain"), http.StatusBadRequest)
+	votingInfo, err := pendingRequests.sendRequest(request)
+	if err != nil {
+		http.Error(w, JsonBodyPadding("blockchain error: "+err.Error()), http.StatusBadRequest)
 		return
 	}
 
-	if response.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(response.Body)
-		http.Error(w, JsonBodyPadding("blockchain error: "+string(body)), http.StatusBadRequest)
-		return
+	blockId := votingInfo.BlockData.Identifier
+	pendingRequests.mutex.Lock()
+	pendingRequests.track(blockId)
+	if _, decided := pendingRequests.results[blockId]; !decided {
+		// replies might have arrived before the primary's response
+		pendingRequests.results[blockId] = RequestResult{BlockId: blockId, Status: "pending"}
 	}
+	if len(request.Callbacks) > 0 {
+		submitted := &submittedRequest{callbacks: request.Callbacks}
+		for _, t := range request.Transactions {
+			submitted.tokens = append(submitted.tokens, t.TokenId)
+		}
+		pendingRequests.submitted[blockId] = submitted
+		pendingRequests.notifyWebhooks(blockId)
+	}
+	pendingRequests.mutex.Unlock()
 
-	var block Block
-	decodingErr := json.NewDecoder(response.Body).Decode(&block)
+	go pendingRequests.retransmit(request, blockId)
 
-	if decodingErr != nil {
-		http.Error(w, JsonBodyPadding("blockchain error: "+decodingErr.Error()), http.StatusBadRequest)
+	if r.URL.Query().Get("wait") != "true" {
+		// a retransmitted request might have been decided already
+		pendingRequests.mutex.Lock()
+		result := pendingRequests.results[blockId]
+		pendingRequests.mutex.Unlock()
+		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	json.NewEncoder(w).Encode(JsonBodyPadding("request submitted to the blockchain"))
+	// blocking mode - wait for f+1 replies
+	timeout := defaultWaitTimeout
+	if seconds, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	json.NewEncoder(w).Encode(pendingRequests.WaitForResult(blockId, timeout))
 }
 
-func StartClient(httpPort int) {
-	var pending PendingRequests
+func postRequest(node Node, endpoint string, body []byte) (VotingInfo, error) {
+	// Sends the request to a replica, returns the pre-prepare message of the block the request was assigned to.
+	var votingInfo VotingInfo
+
+	response, err := transport.Post(node.String(), endpoint, body)
+	if err != nil {
+		return votingInfo, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(response.Body)
+		return votingInfo, fmt.Errorf("status code %v: %v", response.StatusCode, string(respBody))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&votingInfo)
+	return votingInfo, err
+}
+
+func (pendingRequests *PendingRequests) sendRequest(request Request) (VotingInfo, error) {
+	/*
+		Sends the request to a random replica (backups forward it to the primary).
+		If the replica fails, the same request is sent to the other replicas - replicas that already know the request
+		respond with the pre-prepare message of its block instead of creating another one.
+	*/
+	body, _ := json.Marshal(request)
+
+	pendingRequests.mutex.Lock()
+	nodes := append([]Node{pendingRequests.SelectPrimaryReplica()}, pendingRequests.nodes...)
+	pendingRequests.mutex.Unlock()
+
+	lastErr := errors.New("no replicas found")
+	tried := make(map[string]bool)
+
+	for _, node := range nodes {
+		if node == (Node{}) || tried[node.Identifier] {
+			continue
+		}
+		tried[node.Identifier] = true
+
+		votingInfo, err := postRequest(node, "request", body)
+		if err == nil && votingInfo.VotingData.RequestId != request.RequestId {
+			err = errors.New("response does not match the request")
+		}
+		if err == nil {
+			return votingInfo, nil
+		}
+
+		fmt.Println("[CLIENT] request", request.RequestId, "to replica", node.Identifier, "failed:", err.Error())
+		lastErr = err
+	}
+	return VotingInfo{}, lastErr
+}
+
+func (pendingRequests *PendingRequests) retransmit(request Request, blockId int) {
+	/*
+		PBFT: if the client doesn't receive f+1 replies in time, it broadcasts the request to all replicas.
+		Replicas that have already executed the request repeat their reply, others relay it to the primary.
+		There are no view changes, so a request is never decided if the primary has crashed - once all attempts
+		are used up the request is reported as failed instead of staying pending.
+	*/
+	body, _ := json.Marshal(request)
+	timeout := retransmitTimeout
+
+	for attempt := 1; attempt <= retransmitAttempts; attempt++ {
+		time.Sleep(timeout)
+		timeout *= 2
+
+		pendingRequests.mutex.Lock()
+		result := pendingRequests.results[blockId]
+		pendingRequests.mutex.Unlock()
+
+		if result.Status != "pending" {
+			return
+		}
+
+		fmt.Println("[CLIENT] no reply to request", request.RequestId, "(block", blockId, "), retransmitting to all replicas")
+		pendingRequests.RefreshNodes()
+
+		pendingRequests.mutex.Lock()
+		nodes := pendingRequests.nodes
+		pendingRequests.mutex.Unlock()
+
+		for _, node := range nodes {
+			go func(node Node) {
+				if _, err := postRequest(node, "request", body); err != nil {
+					fmt.Println("[CLIENT] retransmission to replica", node.Identifier, "failed:", err.Error())
+				}
+			}(node)
+		}
+	}
+
+	time.Sleep(timeout)
+
+	pendingRequests.mutex.Lock()
+	defer pendingRequests.mutex.Unlock()
+
+	if result, exists := pendingRequests.results[blockId]; exists && result.Status == "pending" {
+		fmt.Println("[CLIENT] request", request.RequestId, "(block", blockId, ") not decided after", retransmitAttempts, "retransmissions, the primary might be down")
+		pendingRequests.decide(RequestResult{BlockId: blockId, Status: "failed"})
+	}
+}
+
+func clientKey(keystore string, scheme string) (Signer, string, error) {
+	// returns the signing key and the identifier of a client node
+	if keystore == "" {
+		signer, err := GenerateSigningKey(scheme)
+		return signer, uuid.NewString(), err
+	}
+
+	signer, err := LoadOrCreateKeystore(keystore, KeystorePassword(), scheme)
+	if err != nil {
+		return nil, "", err
+	}
+	return signer, NodeIdFromKey(signer.Public()), nil
+}
+
+func StartClient(httpPort int, keystore string, scheme string) error {
+	pending := NewPendingRequests()
 	pending.discoveryAddress = os.Getenv("DISCOVERY_ADDR")
+	if err := pending.loadSubmitters(); err != nil {
+		return err
+	}
 
-	priv, pub := GenerateSigningKeyPair()
-	pending.RegisterNode(os.Getenv("HOSTNAME"), httpPort, uuid.NewString(), pub, &priv)
+	signer, identifier, err := clientKey(keystore, scheme)
+	if err != nil {
+		return err
+	}
+	if err := CheckTLSIdentity(Node{Identifier: identifier, PublicKey: signer.Public()}); err != nil {
+		return err
+	}
+	pending.RegisterNode(os.Getenv("HOSTNAME"), httpPort, identifier, signer)
 
 	fmt.Println("[CLIENT] Starting HTTP Listener")
 	pending.HttpHandler(httpPort)
+	return nil
+}
+
+func StartStaticClient(cluster *ClusterConfig, identifier string, keystore string, scheme string) error {
+	/*
+		Starts a client node described by the static cluster config (node discovery is not used).
+		If identifier is empty it is derived from the keystore's public key.
+	*/
+	signer, keyId, err := clientKey(keystore, scheme)
+	if err != nil {
+		return err
+	}
+
+	if identifier == "" {
+		identifier = keyId
+	}
+
+	self, err := cluster.NodeById(identifier)
+	if err != nil {
+		return err
+	}
+
+	if self.Type != "client" {
+		return fmt.Errorf("node %v is not a client node", identifier)
+	}
+
+	if signer.Public() != self.PublicKey {
+		return fmt.Errorf("private key does not match the public key of node %v", identifier)
+	}
+
+	pending := NewPendingRequests()
+	pending.cluster = cluster
+	if err := pending.loadSubmitters(); err != nil {
+		return err
+	}
+
+	if err := CheckTLSIdentity(Node{Identifier: self.Identifier, PublicKey: signer.Public()}); err != nil {
+		return err
+	}
+	pending.RegisterNode(self.Address, self.Port, self.Identifier, signer)
+
+	fmt.Println("[CLIENT] Starting HTTP Listener")
+	pending.HttpHandler(self.Port)
+	return nil
 }
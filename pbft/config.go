@@ -0,0 +1,116 @@
+package pbft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+/*
+Static cluster configuration.
+Used instead of the node discovery service when the set of replicas and clients is known upfront.
+*/
+
+type NodeConfig struct {
+	Identifier string `json:"node-id"`
+	Address    string `json:"address"`
+	Port       int    `json:"port"`
+	Type       string `json:"node-type"`  // blockchain / client
+	PublicKey  string `json:"public-key"` // "<scheme>:<base64 key>" or PEM encoded public key
+}
+
+type ClusterConfig struct {
+	Nodes []NodeConfig `json:"nodes"`
+}
+
+func LoadClusterConfig(path string) (*ClusterConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cluster ClusterConfig
+	if err := json.Unmarshal(data, &cluster); err != nil {
+		return nil, fmt.Errorf("cluster config %v: %v", path, err.Error())
+	}
+
+	if err := cluster.Validate(); err != nil {
+		return nil, fmt.Errorf("cluster config %v: %v", path, err.Error())
+	}
+
+	return &cluster, nil
+}
+
+func (c *ClusterConfig) Validate() error {
+	if len(c.Nodes) == 0 {
+		return errors.New("no nodes defined")
+	}
+
+	seen := make(map[string]bool)
+	for _, n := range c.Nodes {
+		if n.Identifier == "" {
+			return errors.New("node without an identifier")
+		}
+		if seen[n.Identifier] {
+			return fmt.Errorf("duplicate node identifier %v", n.Identifier)
+		}
+		seen[n.Identifier] = true
+
+		if n.Type != "blockchain" && n.Type != "client" {
+			return fmt.Errorf("node %v: incorrect node type %v", n.Identifier, n.Type)
+		}
+		if n.Type == "blockchain" && n.PublicKey == "" {
+			// replica votes can't be verified without the key
+			return fmt.Errorf("node %v: public key required for blockchain nodes", n.Identifier)
+		}
+	}
+	return nil
+}
+
+func (nc NodeConfig) Node() (Node, error) {
+	node := Node{Address: nc.Address, Port: nc.Port, Identifier: nc.Identifier, Type: nc.Type}
+
+	if nc.PublicKey != "" {
+		pub, err := ParsePublicKey(nc.PublicKey)
+		if err != nil {
+			return Node{}, fmt.Errorf("node %v: %v", nc.Identifier, err.Error())
+		}
+		node.PublicKey = pub
+	}
+
+	return node, nil
+}
+
+func (c *ClusterConfig) NodeById(id string) (Node, error) {
+	for _, nc := range c.Nodes {
+		if nc.Identifier == id {
+			return nc.Node()
+		}
+	}
+	return Node{}, fmt.Errorf("node %v not found in cluster config", id)
+}
+
+func (c *ClusterConfig) nodesOfType(nodeType string) []Node {
+	var nodes []Node
+	for _, nc := range c.Nodes {
+		if nc.Type != nodeType {
+			continue
+		}
+		node, err := nc.Node()
+		if err != nil {
+			fmt.Println("[ERROR] skipping node from cluster config:", err.Error())
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (c *ClusterConfig) BlockchainNodes() []Node {
+	return c.nodesOfType("blockchain")
+}
+
+func (c *ClusterConfig) ClientNodes() []Node {
+	return c.nodesOfType("client")
+}
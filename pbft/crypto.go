@@ -2,29 +2,171 @@ package pbft
 
 import (
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
 )
 
-func GenerateSigningKeyPair() (rsa.PrivateKey, *rsa.PublicKey) {
-	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+/*
+Signature schemes.
+Public keys are exchanged as "<scheme>:<base64 key>" strings so that nodes using different schemes
+can verify each other (e.g. while a cluster is migrated from RSA to Ed25519).
+*/
 
-	return *privateKey, &privateKey.PublicKey
+const (
+	SchemeEd25519 string = "ed25519"
+	SchemeRSA     string = "rsa" // 2048-bit RSA PKCS#1 v1.5, kept for compatibility
+
+	DefaultScheme string = SchemeEd25519
+)
+
+type PublicKey string
+
+type Signer interface {
+	Sign(message []byte) ([]byte, error)
+	Public() PublicKey
+}
+
+type Verifier interface {
+	Verify(message []byte, signature []byte) error
+}
+
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+type ed25519Verifier struct {
+	key ed25519.PublicKey
+}
+
+type rsaSigner struct {
+	key *rsa.PrivateKey
+}
+
+type rsaVerifier struct {
+	key *rsa.PublicKey
+}
+
+func (s *ed25519Signer) Sign(message []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, message), nil
+}
+
+func (s *ed25519Signer) Public() PublicKey {
+	return encodePublicKey(SchemeEd25519, s.key.Public().(ed25519.PublicKey))
 }
 
-func SignData(message []byte, priv *rsa.PrivateKey) ([]byte, error) {
+func (v *ed25519Verifier) Verify(message []byte, signature []byte) error {
+	if !ed25519.Verify(v.key, message, signature) {
+		return errors.New("ed25519: invalid signature")
+	}
+	return nil
+}
+
+func (s *rsaSigner) Sign(message []byte) ([]byte, error) {
 	hash := sha256.Sum256(message)
 
-	return rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hash[:])
+	return rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
 }
 
-func VerifySignature(pub *rsa.PublicKey, signed []byte, message string) error {
-	// sigHash := sha256.Sum256(signed)
-	msgHash := sha256.Sum256([]byte(message))
-	// unhexlify string
+func (s *rsaSigner) Public() PublicKey {
+	return encodePublicKey(SchemeRSA, x509.MarshalPKCS1PublicKey(&s.key.PublicKey))
+}
+
+func (v *rsaVerifier) Verify(message []byte, signature []byte) error {
+	hash := sha256.Sum256(message)
+
+	return rsa.VerifyPKCS1v15(v.key, crypto.SHA256, hash[:], signature)
+}
+
+func encodePublicKey(scheme string, key []byte) PublicKey {
+	return PublicKey(scheme + ":" + base64.StdEncoding.EncodeToString(key))
+}
+
+func (k PublicKey) decode() (scheme string, key []byte, err error) {
+	parts := strings.SplitN(string(k), ":", 2)
+	if len(parts) != 2 {
+		return "", nil, errors.New("public key without a scheme")
+	}
+
+	key, err = base64.StdEncoding.DecodeString(parts[1])
+	return parts[0], key, err
+}
+
+func (k PublicKey) Scheme() string {
+	scheme, _, _ := k.decode()
+	return scheme
+}
 
+func (k PublicKey) Verifier() (Verifier, error) {
+	scheme, key, err := k.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	switch scheme {
+	case SchemeEd25519:
+		if len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("ed25519: incorrect public key length")
+		}
+		return &ed25519Verifier{ed25519.PublicKey(key)}, nil
+	case SchemeRSA:
+		pub, err := x509.ParsePKCS1PublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &rsaVerifier{pub}, nil
+	}
+	return nil, fmt.Errorf("unsupported signature scheme %v", scheme)
+}
+
+func NewSigner(key crypto.PrivateKey) (Signer, error) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return &ed25519Signer{k}, nil
+	case *rsa.PrivateKey:
+		return &rsaSigner{k}, nil
+	}
+	return nil, errors.New("unsupported private key type")
+}
+
+func GenerateSigningKey(scheme string) (Signer, error) {
+	switch scheme {
+	case SchemeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &ed25519Signer{priv}, nil
+	case SchemeRSA:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return &rsaSigner{priv}, nil
+	}
+	return nil, fmt.Errorf("unsupported signature scheme %v", scheme)
+}
+
+func privateKey(s Signer) crypto.PrivateKey {
+	switch k := s.(type) {
+	case *ed25519Signer:
+		return k.key
+	case *rsaSigner:
+		return k.key
+	}
+	return nil
+}
+
+func VerifySignature(pub PublicKey, signed []byte, message string) error {
+	// unhexlify string
 	signUnhexed := make([]byte, hex.DecodedLen(len(signed)))
 	_, err := hex.Decode(signUnhexed, signed)
 
@@ -32,5 +174,53 @@ func VerifySignature(pub *rsa.PublicKey, signed []byte, message string) error {
 		return err
 	}
 
-	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, msgHash[:], signUnhexed)
+	verifier, err := pub.Verifier()
+	if err != nil {
+		return err
+	}
+
+	return verifier.Verify([]byte(message), signUnhexed)
+}
+
+func ParsePublicKey(encoded string) (PublicKey, error) {
+	/*
+		Accepts "<scheme>:<base64 key>" strings as well as PEM encoded PKIX ("PUBLIC KEY")
+		or PKCS#1 ("RSA PUBLIC KEY") keys.
+	*/
+	if !strings.HasPrefix(encoded, "-----BEGIN") {
+		key := PublicKey(encoded)
+		if _, err := key.Verifier(); err != nil {
+			return "", err
+		}
+		return key, nil
+	}
+
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return "", errors.New("public key is not PEM encoded")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		if _, err := x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return "", err
+		}
+		return encodePublicKey(SchemeRSA, block.Bytes), nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return publicKeyFromCrypto(key)
+}
+
+func publicKeyFromCrypto(key crypto.PublicKey) (PublicKey, error) {
+	switch pub := key.(type) {
+	case ed25519.PublicKey:
+		return encodePublicKey(SchemeEd25519, pub), nil
+	case *rsa.PublicKey:
+		return encodePublicKey(SchemeRSA, x509.MarshalPKCS1PublicKey(pub)), nil
+	}
+	return "", errors.New("unsupported public key type")
 }
@@ -0,0 +1,39 @@
+package pbft
+
+import "evoting/consensus"
+
+/*
+Commit events, streamed to subscribers (the connector) by the shared API (see consensus/events.go).
+Every committed block is sent together with the tally after the block.
+*/
+
+func (l *Ledger) publish() {
+	// Sends the event of the last appended block to all subscribers.
+	// Called with the mutex held.
+	l.subscribers.Publish(consensus.NewCommitEvent(l.block(len(l.Chain)-1), l.tally))
+}
+
+func (l *Ledger) Subscribe(from int) ([]consensus.CommitEvent, <-chan consensus.CommitEvent, func()) {
+	// Returns events of the blocks already committed (starting at block id from) and the channel of new events.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var backlog []consensus.CommitEvent
+	tally := consensus.NewTally()
+
+	for position := range l.Chain {
+		block := l.block(position)
+		tally.Count(block)
+		if block.Identifier >= from {
+			backlog = append(backlog, consensus.NewCommitEvent(block, tally))
+		}
+	}
+
+	events := l.subscribers.Add()
+	cancel := func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.subscribers.Remove(events)
+	}
+	return backlog, events, cancel
+}
@@ -1,23 +1,20 @@
 package pbft
 
-import (
-	"fmt"
-	"log"
-	"net/http"
+import "github.com/gorilla/mux"
 
-	"github.com/gorilla/mux"
-)
-
-func HandleRequests(port int, blockchain *Blockchain) {
-	r := mux.NewRouter()
-
-	r.HandleFunc("/pre-prepare", blockchain.HttpPrePrepare).Methods("POST")
-	r.HandleFunc("/prepare", blockchain.HttpPrepare).Methods("POST")
-	r.HandleFunc("/chain", blockchain.HttpGetChain).Methods("GET")
-	r.HandleFunc("/request", blockchain.HttpRequest).Methods("POST")
-	r.HandleFunc("/pending", blockchain.HttpGetPending).Methods("GET")
-	r.HandleFunc("/peers", blockchain.HttpGetPeers).Methods("GET")
-	r.HandleFunc("/refresh", blockchain.HttpTriggerRefresh).Methods("GET")
+func (bc *Blockchain) Routes(r *mux.Router) {
+	// Engine specific endpoints, the shared API is registered by consensus.HandleApi (see main.go).
+	r.HandleFunc("/pre-prepare", bc.HttpPrePrepare).Methods("POST")
+	r.HandleFunc("/prepare", bc.HttpPrepare).Methods("POST")
+	r.HandleFunc("/commit", bc.HttpCommit).Methods("POST")
+	r.HandleFunc("/chain", bc.HttpGetChain).Methods("GET")
+	r.HandleFunc("/certify/{height:[0-9]+}", bc.HttpCertify).Methods("GET")
+	r.HandleFunc("/request", bc.HttpRequest).Methods("POST")
+	r.HandleFunc("/pending", bc.HttpGetPending).Methods("GET")
+	r.HandleFunc("/peers", bc.HttpGetPeers).Methods("GET")
+	r.HandleFunc("/refresh", bc.HttpTriggerRefresh).Methods("GET")
+}
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), r))
+func (bc *Blockchain) Port() int {
+	return bc.Self.Port
 }
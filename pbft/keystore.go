@@ -0,0 +1,220 @@
+package pbft
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+Persistent node identity.
+The signing key is kept in a keystore file (PEM, optionally password-encrypted) so that a restarted node
+keeps its key and its identifier, which is derived from the public key.
+*/
+
+const nodeIdLength int = 16 // hex characters of the public key hash
+
+func KeystorePassword() []byte {
+	// Password is never passed as a CLI flag so that it doesn't end up in the process list.
+	password := os.Getenv("KEYSTORE_PASSWORD")
+	if password == "" {
+		return nil
+	}
+	return []byte(password)
+}
+
+func LoadKeystore(path string, password []byte) (Signer, error) {
+	/*
+		Reads a PEM encoded PKCS#8 ("PRIVATE KEY") or PKCS#1 ("RSA PRIVATE KEY") key from disk.
+		Encrypted keys require the password.
+	*/
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("keystore is not PEM encoded")
+	}
+
+	der := block.Bytes
+	if block.Type == encryptedKeyType {
+		if password == nil {
+			return nil, errors.New("keystore is encrypted, password required")
+		}
+		der, err = decryptKey(block, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt keystore: %v", err.Error())
+		}
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		priv, err := x509.ParsePKCS1PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return NewSigner(priv)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(key)
+}
+
+func SaveKeystore(path string, signer Signer, password []byte) error {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey(signer))
+	if err != nil {
+		return err
+	}
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+
+	if password != nil {
+		block, err = encryptKey(der, password)
+		if err != nil {
+			return err
+		}
+	}
+
+	// O_EXCL - never overwrite an existing identity
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return pem.Encode(file, block)
+}
+
+/*
+Encrypted keystores.
+The PKCS#8 key is sealed with AES-256-GCM, the key is derived from the password with scrypt. The scrypt parameters,
+the salt and the nonce are kept in the PEM headers, the ciphertext in the PEM body.
+*/
+
+const (
+	encryptedKeyType = "SCRYPT ENCRYPTED PRIVATE KEY"
+	scryptN          = 1 << 15
+	scryptR          = 8
+	scryptP          = 1
+	scryptMaxN       = 1 << 20 // upper bound accepted from a keystore, keeps a tampered file from exhausting memory
+	saltLength       = 16
+)
+
+func keystoreCipher(password []byte, salt []byte, n int, r int, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(password, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	aesCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(aesCipher)
+}
+
+func encryptKey(der []byte, password []byte) (*pem.Block, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := keystoreCipher(password, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"Kdf":        "scrypt",
+			"Kdf-Params": fmt.Sprintf("N=%v,r=%v,p=%v", scryptN, scryptR, scryptP),
+			"Salt":       hex.EncodeToString(salt),
+			"Cipher":     "AES-256-GCM",
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, der, []byte(encryptedKeyType)),
+	}, nil
+}
+
+func decryptKey(block *pem.Block, password []byte) ([]byte, error) {
+	if block.Headers["Kdf"] != "scrypt" || block.Headers["Cipher"] != "AES-256-GCM" {
+		return nil, errors.New("unsupported keystore encryption")
+	}
+
+	var n, r, p int
+	if _, err := fmt.Sscanf(block.Headers["Kdf-Params"], "N=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return nil, errors.New("incorrect scrypt parameters")
+	}
+	if n > scryptMaxN {
+		return nil, fmt.Errorf("scrypt parameter N=%v too large", n)
+	}
+
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errors.New("incorrect salt")
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, errors.New("incorrect nonce")
+	}
+
+	aead, err := keystoreCipher(password, salt, n, r, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("incorrect nonce")
+	}
+
+	der, err := aead.Open(nil, nonce, block.Bytes, []byte(encryptedKeyType))
+	if err != nil {
+		return nil, errors.New("wrong password or corrupted keystore")
+	}
+	return der, nil
+}
+
+func LoadOrCreateKeystore(path string, password []byte, scheme string) (Signer, error) {
+	signer, err := LoadKeystore(path, password)
+	if err == nil {
+		return signer, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	fmt.Println("[INFO] keystore", path, "not found, generating a new", scheme, "key")
+	signer, err = GenerateSigningKey(scheme)
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveKeystore(path, signer, password); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+func NodeIdFromKey(pub PublicKey) string {
+	_, key, _ := pub.decode()
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:])[:nodeIdLength]
+}
@@ -0,0 +1,104 @@
+package pbft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempKeystore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "node.pem"), func() { os.RemoveAll(dir) }
+}
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		scheme   string
+		password []byte
+	}{
+		{"ed25519 plain", SchemeEd25519, nil},
+		{"ed25519 encrypted", SchemeEd25519, []byte("secret")},
+		{"rsa plain", SchemeRSA, nil},
+		{"rsa encrypted", SchemeRSA, []byte("secret")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, cleanup := tempKeystore(t)
+			defer cleanup()
+
+			created, err := LoadOrCreateKeystore(path, tt.password, tt.scheme)
+			if err != nil {
+				t.Fatalf("creating keystore: %v", err)
+			}
+			if scheme := created.Public().Scheme(); scheme != tt.scheme {
+				t.Fatalf("scheme = %v, want %v", scheme, tt.scheme)
+			}
+
+			loaded, err := LoadKeystore(path, tt.password)
+			if err != nil {
+				t.Fatalf("loading keystore: %v", err)
+			}
+			if loaded.Public() != created.Public() {
+				t.Fatalf("loaded key %v differs from created key %v", loaded.Public(), created.Public())
+			}
+			if NodeIdFromKey(loaded.Public()) != NodeIdFromKey(created.Public()) {
+				t.Fatal("node id changed after reload")
+			}
+
+			// a signature of the reloaded key verifies with the original public key
+			signature, err := loaded.Sign([]byte("message"))
+			if err != nil {
+				t.Fatalf("signing: %v", err)
+			}
+			verifier, err := created.Public().Verifier()
+			if err != nil {
+				t.Fatalf("verifier: %v", err)
+			}
+			if err := verifier.Verify([]byte("message"), signature); err != nil {
+				t.Fatalf("verifying: %v", err)
+			}
+
+			// an existing keystore is loaded, never replaced
+			again, err := LoadOrCreateKeystore(path, tt.password, tt.scheme)
+			if err != nil || again.Public() != created.Public() {
+				t.Fatalf("LoadOrCreateKeystore replaced the existing key (err %v)", err)
+			}
+			if err := SaveKeystore(path, created, tt.password); !os.IsExist(err) {
+				t.Fatalf("SaveKeystore overwrote an existing keystore (err %v)", err)
+			}
+		})
+	}
+}
+
+func TestKeystorePassword(t *testing.T) {
+	path, cleanup := tempKeystore(t)
+	defer cleanup()
+	if _, err := LoadOrCreateKeystore(path, []byte("secret"), SchemeEd25519); err != nil {
+		t.Fatalf("creating keystore: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password []byte
+		ok       bool
+	}{
+		{"correct password", []byte("secret"), true},
+		{"wrong password", []byte("wrong"), false},
+		{"missing password", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadKeystore(path, tt.password)
+			if (err == nil) != tt.ok {
+				t.Fatalf("LoadKeystore error = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package pbft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"evoting/transport"
+)
+
+/*
+Replica set of a node, taken from the static cluster config or from the node discovery service.
+Embedded by the replicas of every engine built on the PBFT node model (pbft, poa, raft, hotstuff), so registration,
+peer lookups and the authentication of incoming requests are the same everywhere.
+*/
+
+type Membership struct {
+	Peers            []Node         `json:"-"`
+	Self             Node           `json:"-"`
+	DiscoveryAddress string         `json:"-"`
+	Cluster          *ClusterConfig `json:"-"` // static cluster config, replaces node discovery if set
+	mutex            *sync.Mutex    // mutex of the replica, guards Peers
+}
+
+func NewMembership(self Node, cluster *ClusterConfig, discoveryAddress string, mutex *sync.Mutex) Membership {
+	return Membership{Self: self, Cluster: cluster, DiscoveryAddress: discoveryAddress, mutex: mutex}
+}
+
+func (m *Membership) RegisterNode() {
+	if m.Cluster != nil {
+		// static cluster - nothing to register
+		return
+	}
+
+	RegisterAtDiscovery(m.DiscoveryAddress, m.Self)
+}
+
+func (m *Membership) RefreshPeers() []Node {
+	var nodes []Node
+	if m.Cluster != nil {
+		nodes = m.Cluster.BlockchainNodes()
+	} else {
+		var err error
+		if nodes, err = DiscoverReplicas(m.DiscoveryAddress); err != nil {
+			fmt.Println("[ERROR] failed to refresh nodes:", err.Error())
+			return nil
+		}
+	}
+
+	// remove self from the peer list
+	var peers []Node
+	for _, peer := range nodes {
+		if peer.Identifier != m.Self.Identifier {
+			peers = append(peers, peer)
+		}
+	}
+
+	m.mutex.Lock()
+	m.Peers = peers
+	m.mutex.Unlock()
+	return peers
+}
+
+func (m *Membership) PeerById(id string) Node {
+	// Called with the mutex held.
+	for _, peer := range m.Peers {
+		if peer.Identifier == id {
+			return peer
+		}
+	}
+	return Node{}
+}
+
+func (m *Membership) PeerByKey(key PublicKey) Node {
+	// Called with the mutex held.
+	for _, peer := range m.Peers {
+		if peer.PublicKey == key {
+			return peer
+		}
+	}
+	return Node{}
+}
+
+func (m *Membership) VerifyReplica(r *http.Request) error {
+	// With TLS enabled, only registered replicas may take part in the protocol.
+	key, ok := PeerPublicKey(r)
+	if !ok {
+		return VerifyPeer(r, Node{}) // fails only if TLS is enabled
+	}
+
+	known := func() bool {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		return m.PeerByKey(key) != (Node{})
+	}
+
+	if !known() {
+		m.RefreshPeers() // peer might have joined recently
+		if !known() {
+			return errors.New("peer certificate does not match any registered replica")
+		}
+	}
+	return nil
+}
+
+func (m *Membership) VerifySubmitter(r *http.Request) error {
+	/*
+		Transactions may be submitted by client nodes and replicas only, the same nodes /request accepts.
+		Always succeeds if TLS is disabled.
+	*/
+	key, ok := PeerPublicKey(r)
+	if !ok {
+		return VerifyPeer(r, Node{}) // fails only if TLS is enabled
+	}
+
+	var clients []Node
+	if m.Cluster != nil {
+		clients = m.Cluster.ClientNodes()
+	} else {
+		var err error
+		if clients, err = DiscoverClients(m.DiscoveryAddress); err != nil {
+			return fmt.Errorf("failed to fetch client nodes: %v", err.Error())
+		}
+	}
+
+	for _, client := range clients {
+		if client.PublicKey == key {
+			return nil
+		}
+	}
+
+	if m.VerifyReplica(r) != nil {
+		return errors.New("peer certificate does not match any registered client node or replica")
+	}
+	return nil
+}
+
+func RegisterAtDiscovery(discoveryAddress string, node Node) {
+	messageBuffer, _ := json.Marshal(node)
+	resp, err := transport.Post(discoveryAddress, "register", messageBuffer)
+
+	if err != nil || resp.StatusCode != 200 {
+		fmt.Println("[ERROR] failed to register node at node discovery service")
+		if err != nil {
+			fmt.Println("details:", err.Error())
+		} else {
+			bodyBytes, _ := ioutil.ReadAll(resp.Body)
+			fmt.Println("status code:", resp.StatusCode, ", discovery response:", string(bodyBytes))
+		}
+	} else {
+		fmt.Println("[INFO] Node registered")
+	}
+}
+
+func DiscoverClients(discoveryAddress string) ([]Node, error) {
+	resp, err := transport.Get(discoveryAddress, "get-clients")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var nodes []Node
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return nil, fmt.Errorf("node discovery's response is ambiguous: %v", err.Error())
+	}
+	return nodes, nil
+}
+
+func RequestKey(clientId string, requestId string) string {
+	// Identifies a client request, retransmissions of a request have the same key.
+	return clientId + "/" + requestId
+}
+
+func SendReply(client Node, reply Reply) {
+	// Committed blocks are reported to the client's /commit endpoint, rejected ones to /reject.
+	endpoint := "commit"
+	if reply.Result == "rejected" {
+		endpoint = "reject"
+	}
+
+	messageBuffer, _ := json.Marshal(reply)
+	resp, err := transport.Post(client.String(), endpoint, messageBuffer)
+	if err != nil {
+		// the client retransmits the request if it doesn't receive enough replies
+		fmt.Println("[ERROR] failed to send reply to client", client.Identifier, err.Error())
+		return
+	}
+	resp.Body.Close()
+}
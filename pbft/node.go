@@ -1,17 +1,14 @@
 package pbft
 
-import (
-	"crypto/rsa"
-	"fmt"
-)
+import "fmt"
 
 type Node struct {
-	Address    string          `json:"address"`
-	Port       int             `json:"port"`
-	Identifier string          `json:"node-id"`
-	Type       string          `json:"node-type"`
-	PublicKey  *rsa.PublicKey  `json:"public-key"`
-	privateKey *rsa.PrivateKey // do not export private key
+	Address    string    `json:"address"`
+	Port       int       `json:"port"`
+	Identifier string    `json:"node-id"`
+	Type       string    `json:"node-type"`
+	PublicKey  PublicKey `json:"public-key"`
+	signer     Signer    // do not export private key
 }
 
 func (n Node) String() string {
@@ -0,0 +1,131 @@
+package pbft
+
+import (
+	"sync"
+
+	"evoting/consensus"
+)
+
+/*
+Chain queries of the replica, served by the shared API (see consensus/http.go).
+Blocks and transactions are looked up through indexes maintained whenever a block is appended,
+so clients don't have to download the whole chain.
+The ledger is embedded by the replicas of every engine storing PBFT blocks (pbft, raft, hotstuff).
+*/
+
+type Ledger struct {
+	Chain []Block `json:"chain"`
+
+	mutex      *sync.Mutex     // mutex of the replica, guards the chain
+	replicaId  string          // identifier of the replica signing attestations, see certify.go
+	signer     Signer          // signing key of the replica
+	blockIndex map[int]int     // block id -> position in the chain
+	hashIndex  map[string]int  // block hash -> position in the chain
+	tokenIndex map[string]int  // token -> position of the block containing the transaction
+	tally      consensus.Tally // votes counted so far, see tally.go
+
+	subscribers consensus.Subscribers // commit event streams, see events.go
+}
+
+func NewLedger(mutex *sync.Mutex, replicaId string, signer Signer) Ledger {
+	return Ledger{mutex: mutex, replicaId: replicaId, signer: signer, subscribers: make(consensus.Subscribers)}
+}
+
+func (l *Ledger) indexBlock(position int) {
+	// Called with the mutex held.
+	block := l.Chain[position]
+	l.blockIndex[block.Identifier] = position
+	l.hashIndex[CalculateHash(block)] = position
+	for _, t := range block.Transactions {
+		if _, used := l.tokenIndex[t.TokenId]; !used {
+			// the first use of a token counts, later ones are never accepted
+			l.tokenIndex[t.TokenId] = position
+		}
+	}
+}
+
+func (l *Ledger) Reindex() {
+	// Rebuilds all indexes and the tally, used whenever the chain is replaced.
+	l.blockIndex = make(map[int]int)
+	l.hashIndex = make(map[string]int)
+	l.tokenIndex = make(map[string]int)
+	for position := range l.Chain {
+		l.indexBlock(position)
+	}
+	l.recount()
+}
+
+func (l *Ledger) AppendBlock(block Block) {
+	// Called with the mutex held.
+	l.Chain = append(l.Chain, block)
+	l.indexBlock(len(l.Chain) - 1)
+	l.tally.CountTransactions(block.Transactions)
+	l.publish()
+}
+
+func (l *Ledger) TokenUsed(tokenId string) bool {
+	// Called with the mutex held.
+	_, used := l.tokenIndex[tokenId]
+	return used
+}
+
+func (l *Ledger) LastBlock() Block {
+	if len(l.Chain) < 1 { // chain empty
+		return Block{}
+	}
+	return l.Chain[len(l.Chain)-1]
+}
+
+func (l *Ledger) block(position int) consensus.Block {
+	// Block at the given position in the common model. Called with the mutex held.
+	block := l.Chain[position]
+	return consensus.Block{
+		Identifier:        block.Identifier,
+		Timestamp:         block.Timestamp,
+		Transactions:      block.Transactions,
+		PreviousBlockHash: block.PreviousBlockHash,
+		Height:            position,
+		Hash:              CalculateHash(block),
+	}
+}
+
+func (l *Ledger) lookup(position int, exists bool) (consensus.Block, bool) {
+	// Called with the mutex held.
+	if !exists || position < 0 || position >= len(l.Chain) {
+		return consensus.Block{}, false
+	}
+	return l.block(position), true
+}
+
+func (l *Ledger) Height() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.Chain) - 1
+}
+
+func (l *Ledger) BlockAt(height int) (consensus.Block, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.lookup(height, true)
+}
+
+func (l *Ledger) BlockById(id int) (consensus.Block, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	position, exists := l.blockIndex[id]
+	return l.lookup(position, exists)
+}
+
+func (l *Ledger) BlockByHash(hash string) (consensus.Block, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	position, exists := l.hashIndex[hash]
+	return l.lookup(position, exists)
+}
+
+func (l *Ledger) BlockByToken(token string) (consensus.Block, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	position, exists := l.tokenIndex[token]
+	return l.lookup(position, exists)
+}
@@ -0,0 +1,79 @@
+package pbft
+
+import "encoding/json"
+
+/*
+Client requests handled by the replica.
+Clients retransmit requests that haven't been answered in time, possibly to all replicas. Requests are identified
+by the client and the request id assigned by the client, so a retransmitted request is never assigned another block
+(replicas also vote against a pre-prepare assigning a known request to a different block).
+The log is kept in memory only - tokens can't be used twice anyway.
+*/
+
+type requestEntry struct {
+	PrePrepare VotingInfo // pre-prepare message of the block the request was assigned to
+	Reply      Reply      // reply sent once the block is executed / rejected, empty until then
+}
+
+func (v Voting) requestIds() []string {
+	if v.RequestId == "" {
+		return []string{}
+	}
+	return []string{v.RequestId}
+}
+
+func (bc *Blockchain) knownRequest(clientId string, requestId string) (*requestEntry, bool) {
+	// Requests without an id (older clients) are never deduplicated.
+	// Called with the mutex held.
+	if requestId == "" {
+		return nil, false
+	}
+	entry, exists := bc.requests[RequestKey(clientId, requestId)]
+	return entry, exists
+}
+
+func (bc *Blockchain) logRequest(votingInfo VotingInfo) {
+	// Called with the mutex held.
+	voting := votingInfo.VotingData
+	if voting.RequestId == "" {
+		return
+	}
+	if _, exists := bc.requests[RequestKey(voting.Client.Identifier, voting.RequestId)]; !exists {
+		bc.requests[RequestKey(voting.Client.Identifier, voting.RequestId)] = &requestEntry{PrePrepare: votingInfo}
+	}
+}
+
+func (bc *Blockchain) replyToClient(voting Voting, reply Reply) {
+	/*
+		Signs the reply, records it (so it can be sent again if the client retransmits the request)
+		and sends it to the client.
+		Called with the mutex held.
+	*/
+	if voting.Client.Identifier == "" {
+		// submitted through the shared API, nobody to reply to
+		return
+	}
+
+	reply.BlockId, reply.RequestIds, reply.ReplicaId = voting.BlockId, voting.requestIds(), bc.Self.Identifier
+	reply.Signature = bc.SignMessage(signedPayload(reply.unsigned()))
+
+	if entry, exists := bc.knownRequest(voting.Client.Identifier, voting.RequestId); exists && entry.PrePrepare.VotingData.BlockId == voting.BlockId {
+		entry.Reply = reply
+	}
+
+	go SendReply(voting.Client, reply)
+}
+
+func (bc *Blockchain) resendReply(entry *requestEntry) {
+	// The request has already been handled - repeat the reply instead of executing it again.
+	// Called with the mutex held.
+	if entry.Reply.Result != "" {
+		go SendReply(entry.PrePrepare.VotingData.Client, entry.Reply)
+	}
+}
+
+func ForwardRequest(replica Node, endpoint string, req Request) (VotingInfo, error) {
+	// Relays a client request to another replica (the primary / leader), returns the block the request was assigned to.
+	body, _ := json.Marshal(req)
+	return postRequest(replica, endpoint, body)
+}
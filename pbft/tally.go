@@ -0,0 +1,21 @@
+package pbft
+
+import "evoting/consensus"
+
+/*
+Running tally of the election.
+Updated whenever a block is appended, so results don't have to be recomputed from the whole chain.
+*/
+
+func (l *Ledger) recount() {
+	l.tally = consensus.NewTally()
+	for _, block := range l.Chain {
+		l.tally.CountTransactions(block.Transactions)
+	}
+}
+
+func (l *Ledger) Tally() consensus.Tally {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.tally.At(l.block(len(l.Chain) - 1))
+}
@@ -1,19 +1,55 @@
 package pbft
 
-type Transaction struct {
-	/*
-		not storing issuer ID for privacy reasons (tokenId instead)
-		not storing amount because it is always a single vote
-	*/
+import "evoting/consensus"
+
+type Transaction = consensus.Transaction // see consensus/model.go
+
+type RejectReason struct {
 	TokenId string `json:"Token"`
-	ToId    string `json:"ToId"`
+	Reason  string `json:"reason"`
 }
 
-func validateTransaction(ta Transaction) (valid bool, err string) {
+func ValidateTransaction(ta Transaction) (valid bool, err string) {
 	/*
 		Returns possible errors as string for more verbose output/log.
 	*/
 	valid = true
 
+	if ta.TokenId == "" {
+		return false, "missing token"
+	}
+
+	if ta.ToId == "" {
+		return false, "missing voting party"
+	}
+
 	return
 }
+
+func (bc *Blockchain) validateBlock(block Block) []RejectReason {
+	return ValidateTransactions(block.Transactions, bc.TokenUsed)
+}
+
+func ValidateTransactions(transactions []Transaction, tokenUsed func(tokenId string) bool) []RejectReason {
+	/*
+		Validates all transactions of a proposed block, returns the reasons of rejection (empty if the block is valid).
+		A token may be used only once - neither twice in a block nor again after it's been stored in the chain.
+	*/
+	var reasons []RejectReason
+	used := make(map[string]bool) // tokens used in the block
+
+	for _, t := range transactions {
+		if valid, err := ValidateTransaction(t); !valid {
+			reasons = append(reasons, RejectReason{t.TokenId, err})
+		} else if used[t.TokenId] || tokenUsed(t.TokenId) {
+			reasons = append(reasons, RejectReason{t.TokenId, "token already used"})
+		}
+		used[t.TokenId] = true
+	}
+
+	if len(transactions) == 0 {
+		reasons = append(reasons, RejectReason{"", "no transactions"})
+	}
+
+	return reasons
+}
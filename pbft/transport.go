@@ -0,0 +1,145 @@
+package pbft
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+
+	"evoting/transport"
+)
+
+/*
+Node identities over the shared transport (evoting/transport).
+Node certificates are tied to node identities: the certificate key has to be the node's signing key, so the peer
+of a TLS connection can be checked against the public key registered for the node it claims to be.
+*/
+
+func CheckTLSIdentity(self Node) error {
+	// The node certificate has to carry the node's signing key.
+	cert := transport.Certificate()
+	if cert == nil {
+		return nil
+	}
+
+	key, err := publicKeyFromCrypto(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	if key != self.PublicKey {
+		return fmt.Errorf("TLS certificate key does not match the signing key of node %v", self.Identifier)
+	}
+	return nil
+}
+
+func PeerPublicKey(r *http.Request) (PublicKey, bool) {
+	// Returns the key of the TLS peer, false if the request wasn't made over TLS.
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+
+	key, err := publicKeyFromCrypto(r.TLS.PeerCertificates[0].PublicKey)
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+func VerifyPeer(r *http.Request, node Node) error {
+	/*
+		Checks that the TLS peer is the given node.
+		Always succeeds if TLS is disabled.
+	*/
+	if !transport.Enabled() {
+		return nil
+	}
+
+	key, ok := PeerPublicKey(r)
+	if !ok {
+		return errors.New("peer certificate missing")
+	}
+
+	if key != node.PublicKey {
+		return fmt.Errorf("peer certificate does not match the registered key of node %v", node.Identifier)
+	}
+	return nil
+}
+
+func VerifyResponse(resp *http.Response, node Node) error {
+	/*
+		Checks that the TLS server which sent the response is the given node.
+		Always succeeds if the response wasn't received over TLS.
+	*/
+	if resp.TLS == nil {
+		return nil
+	}
+
+	if node.PublicKey == "" {
+		return fmt.Errorf("no public key registered for node %v", node.Identifier)
+	}
+	if len(resp.TLS.PeerCertificates) == 0 {
+		return errors.New("server certificate missing")
+	}
+
+	key, err := publicKeyFromCrypto(resp.TLS.PeerCertificates[0].PublicKey)
+	if err != nil {
+		return err
+	}
+	if key != node.PublicKey {
+		return fmt.Errorf("server certificate does not match the registered key of node %v", node.Identifier)
+	}
+	return nil
+}
+
+func IssueCertificate(signer Signer, identifier string, address string, caCertFile string, caKeyFile string) ([]byte, error) {
+	/*
+		Issues a PEM encoded node certificate for the signing key, signed by the given CA.
+		Used by the keygen command to provision nodes ahead of time.
+	*/
+	ca, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: identifier},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(2, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if ip := net.ParseIP(address); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{address}
+	}
+
+	pub := privateKey(signer).(crypto.Signer).Public()
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, pub, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
@@ -1,10 +1,16 @@
 package pbft
 
+import "encoding/json"
+
 type Voting struct {
-	BlockId  int           `json:"block-id"`
-	YesVotes []VoteRequest `json:"yes-votes"` // those who vote to append the block
-	NoVotes  []VoteRequest `json:"no-votes"`  // those who vote to reject the block
-	Client   Node          `json:"client"`    // requesting party
+	BlockId   int           `json:"block-id"`
+	Digest    string        `json:"digest"`     // hash of the pre-prepared block, empty until pre-prepare arrives
+	YesVotes  []VoteRequest `json:"yes-votes"`  // those who vote to append the block
+	NoVotes   []VoteRequest `json:"no-votes"`   // those who vote to reject the block
+	Commits   []CommitVote  `json:"commits"`    // commit messages of the replicas that consider the block prepared
+	Client    Node          `json:"client"`     // requesting party
+	RequestId string        `json:"request-id"` // assigned by the client, identifies retransmitted requests
+	Rejected  bool          `json:"rejected"`   // set once enough replicas voted against the block
 }
 
 func (v Voting) HasVoted(node Node) bool {
@@ -23,16 +29,134 @@ func (v Voting) HasVoted(node Node) bool {
 	return false
 }
 
+func (v Voting) HasCommitted(node Node) bool {
+	for _, c := range v.Commits {
+		if node.Identifier == c.ReplicaId {
+			return true
+		}
+	}
+	return false
+}
+
 func (v Voting) Results() (yes int, no int) {
-	// Returns two integers - the first one is YES votes, the second one is NO votes
-	yes = len(v.YesVotes)
-	no = len(v.NoVotes)
+	// Returns two integers - the first one is YES votes, the second one is NO votes.
+	// Only votes for the pre-prepared block are counted.
+	for _, vote := range v.YesVotes {
+		if vote.Digest == v.Digest {
+			yes++
+		}
+	}
+	for _, vote := range v.NoVotes {
+		if vote.Digest == v.Digest {
+			no++
+		}
+	}
 	return
 }
 
+func (v Voting) CommitResults() (commits int) {
+	for _, c := range v.Commits {
+		if c.Digest == v.Digest {
+			commits++
+		}
+	}
+	return
+}
+
+/*
+Protocol messages.
+Every message is signed by its sender over all of its fields (except the signature itself),
+the signature is hex encoded.
+*/
+
+type VotingInfo struct {
+	// PBFT pre-prepare message, sent by the primary
+	View       int    `json:"view"`
+	VotingData Voting `json:"voting-data"`
+	BlockData  Block  `json:"block-data"`
+	Digest     string `json:"digest"`
+	Sender     string `json:"sender-id"`
+	Signature  string `json:"signature"`
+}
+
 type VoteRequest struct {
-	BlockId int    `json:"block-id"`
-	Vote    string `json:"vote"` // this should be digitally signed by the voter
-	VoterId string `json:"voter-id"`
-	Client  Node   `json:"client"`
+	// PBFT prepare message
+	View      int            `json:"view"`
+	BlockId   int            `json:"block-id"`
+	Digest    string         `json:"digest"`
+	Vote      string         `json:"vote"`              // yes / no
+	Reasons   []RejectReason `json:"reasons,omitempty"` // why the voter rejects the block
+	VoterId   string         `json:"voter-id"`
+	Client    Node           `json:"client"`
+	Signature string         `json:"signature"`
+}
+
+type CommitVote struct {
+	// PBFT commit message
+	View      int    `json:"view"`
+	BlockId   int    `json:"block-id"`
+	Digest    string `json:"digest"`
+	ReplicaId string `json:"replica-id"`
+	Signature string `json:"signature"`
+}
+
+type Reply struct {
+	// Reply sent by a replica to the requesting client once the block is executed or rejected
+	BlockId    int            `json:"block-id"`
+	Result     string         `json:"result"`               // committed / rejected
+	BlockHash  string         `json:"block-hash,omitempty"` // hash of the executed block
+	RequestIds []string       `json:"request-ids"`          // client requests contained in the block
+	Reasons    []RejectReason `json:"reasons,omitempty"`
+	ReplicaId  string         `json:"replica-id"`
+	Signature  string         `json:"signature"`
+}
+
+func (v Voting) RejectReasons() []RejectReason {
+	// Reasons given by the replicas that voted against the block, one per transaction.
+	var reasons []RejectReason
+	seen := make(map[string]bool)
+
+	for _, vote := range v.NoVotes {
+		if vote.Digest != v.Digest {
+			continue
+		}
+		for _, reason := range vote.Reasons {
+			if !seen[reason.TokenId] {
+				seen[reason.TokenId] = true
+				reasons = append(reasons, reason)
+			}
+		}
+	}
+	return reasons
+}
+
+func (m VotingInfo) unsigned() VotingInfo {
+	m.Signature = ""
+	return m
+}
+
+func (m VoteRequest) unsigned() VoteRequest {
+	m.Signature = ""
+	return m
+}
+
+func (m Reply) unsigned() Reply {
+	m.Signature = ""
+	return m
+}
+
+func (m CommitVote) unsigned() CommitVote {
+	m.Signature = ""
+	return m
+}
+
+func signedPayload(message interface{}) string {
+	// Struct fields are always encoded in the same order, so the payload is the same on every node.
+	payload, _ := json.Marshal(message)
+	return string(payload)
+}
+
+func VerifyMessage(sender Node, message interface{}, signature string) error {
+	// message should be the unsigned copy of the received message
+	return VerifySignature(sender.PublicKey, []byte(signature), signedPayload(message))
 }
@@ -0,0 +1,118 @@
+package pbft
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+Webhook callbacks invoked by client nodes once a request is committed (f+1 commit replies received).
+Payloads are signed with HMAC-SHA256 using the WEBHOOK_SECRET environment variable,
+the hex encoded signature is sent in the X-Signature header ("sha256=<signature>").
+Callback URLs come from the public API, so they are restricted to http(s) URLs of the hosts listed in
+WEBHOOK_ALLOWED_HOSTS (comma separated, "host" or "host:port") - otherwise anyone could make client nodes
+post to internal services. Without WEBHOOK_SECRET callbacks are refused.
+*/
+
+const (
+	webhookAttempts int           = 5
+	webhookBackoff  time.Duration = 2 * time.Second // doubled after every failed attempt
+)
+
+// web application endpoints are not part of the cluster - plain client, no mutual TLS;
+// redirects are not followed, they could lead to a host that isn't allowed
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+type WebhookPayload struct {
+	Event     string   `json:"event"` // committed
+	BlockId   int      `json:"block-id"`
+	BlockHash string   `json:"block-hash"`
+	Tokens    []string `json:"tokens"`
+	Timestamp int      `json:"timestamp"`
+}
+
+func WebhookSignature(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookSecret() []byte {
+	return []byte(os.Getenv("WEBHOOK_SECRET"))
+}
+
+func ValidateCallback(callback string) error {
+	// Checks that callbacks are enabled and the URL points to an allowed host.
+	if len(webhookSecret()) == 0 {
+		return errors.New("callbacks are disabled, WEBHOOK_SECRET is not set")
+	}
+
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return errors.New("callback has to be an absolute http(s) url")
+	}
+
+	for _, allowed := range strings.Split(os.Getenv("WEBHOOK_ALLOWED_HOSTS"), ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "" {
+			continue
+		}
+		if strings.EqualFold(u.Host, allowed) || (!strings.Contains(allowed, ":") && strings.EqualFold(u.Hostname(), allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("callback host %v is not allowed", u.Host)
+}
+
+func DeliverWebhook(url string, payload WebhookPayload) {
+	/*
+		Posts the payload to the callback URL, retries with exponential backoff.
+		Should be called in a separate goroutine.
+	*/
+	if err := ValidateCallback(url); err != nil {
+		fmt.Println("[ERROR] webhook", url, "not delivered:", err.Error())
+		return
+	}
+
+	body, _ := json.Marshal(payload)
+	secret := webhookSecret()
+	backoff := webhookBackoff
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+		if err != nil {
+			fmt.Println("[ERROR] incorrect webhook url", url, err.Error())
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Signature", "sha256="+WebhookSignature(secret, body))
+
+		resp, err := webhookClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status code %v", resp.StatusCode)
+		}
+
+		fmt.Println("[ERROR] webhook", url, "attempt", attempt, "failed:", err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,181 @@
+package poa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"evoting/pbft"
+)
+
+/*
+Signer set.
+The initial signers are listed in the genesis block. Signers take turns: the block with identifier n is sealed by
+the n-th signer (modulo the number of signers, ordered by identifier). If the signer in turn can't be reached, the
+other signers may seal the block out of turn after a delay. Every block carries the priority of its signer as its
+difficulty - the number of signers for the signer in turn, one less for every position a signer is further behind
+it. A block with a higher difficulty replaces a buffered one with the same identifier, and replicas wait before
+executing an out-of-turn block, so the in-turn block wins unless the signer in turn is really offline.
+A signer may vote to add or remove a signer,
+the vote is carried in every block it seals until the change happens. A change is applied once more than half of the
+signers voted for it, pending votes for the candidate are discarded afterwards.
+The signer set is derived from the chain only, so every replica arrives at the same set.
+*/
+
+func sortAuthorities(authorities []Authority) {
+	sort.Slice(authorities, func(i, j int) bool { return authorities[i].Identifier < authorities[j].Identifier })
+}
+
+func (bc *Blockchain) inTurn(blockId int) Authority {
+	return bc.authorities[blockId%len(bc.authorities)]
+}
+
+func (bc *Blockchain) difficulty(blockId int, identifier string) int {
+	// Priority of the signer for the block, 0 if it's not a signer. Called with the mutex held.
+	n := len(bc.authorities)
+	for i, a := range bc.authorities {
+		if a.Identifier == identifier {
+			return n - (i-blockId%n+n)%n
+		}
+	}
+	return 0
+}
+
+func (bc *Blockchain) outOfTurn(blockId int) []Authority {
+	// Signers other than the one in turn, in order of their priority for the block. Called with the mutex held.
+	var signers []Authority
+	for distance := 1; distance < len(bc.authorities); distance++ {
+		signers = append(signers, bc.inTurn(blockId+distance))
+	}
+	return signers
+}
+
+func (bc *Blockchain) authority(identifier string) (Authority, bool) {
+	for _, a := range bc.authorities {
+		if a.Identifier == identifier {
+			return a, true
+		}
+	}
+	return Authority{}, false
+}
+
+func (bc *Blockchain) countVote(block Block) {
+	// Counts the vote carried in an appended block. Called with the mutex held.
+	vote := block.Vote
+	if vote == nil {
+		return
+	}
+
+	candidate := vote.Candidate.Identifier
+	if _, isSigner := bc.authority(candidate); isSigner == vote.Authorize {
+		// nothing to change
+		return
+	}
+	if !vote.Authorize && len(bc.authorities) == 1 {
+		// the last signer can't be removed
+		return
+	}
+
+	if bc.votes[candidate] == nil {
+		bc.votes[candidate] = make(map[string]bool)
+	}
+	bc.votes[candidate][block.Signer] = vote.Authorize
+
+	votes := 0
+	for _, authorize := range bc.votes[candidate] {
+		if authorize == vote.Authorize {
+			votes++
+		}
+	}
+	if votes <= len(bc.authorities)/2 {
+		return
+	}
+
+	if vote.Authorize {
+		bc.authorities = append(bc.authorities, vote.Candidate)
+		sortAuthorities(bc.authorities)
+		fmt.Println("[POA] signer", candidate, "authorized")
+	} else {
+		var remaining []Authority
+		for _, a := range bc.authorities {
+			if a.Identifier != candidate {
+				remaining = append(remaining, a)
+			}
+		}
+		bc.authorities = remaining
+		for _, voters := range bc.votes {
+			// votes of the removed signer don't count anymore
+			delete(voters, candidate)
+		}
+		fmt.Println("[POA] signer", candidate, "removed")
+	}
+
+	delete(bc.votes, candidate)
+	if bc.vote != nil && bc.vote.Candidate.Identifier == candidate {
+		bc.vote = nil
+	}
+}
+
+func (bc *Blockchain) replayAuthorities() {
+	// Rebuilds the signer set from the chain. Called with the mutex held.
+	bc.authorities = append([]Authority{}, bc.Chain[0].Signers...)
+	sortAuthorities(bc.authorities)
+	bc.votes = make(map[string]map[string]bool)
+	for _, block := range bc.Chain[1:] {
+		bc.countVote(block)
+	}
+}
+
+func (bc *Blockchain) HttpGetSigners(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	json.NewEncoder(w).Encode(struct {
+		Signers []Authority                `json:"signers"`
+		Votes   map[string]map[string]bool `json:"votes"` // candidate -> signer -> authorize
+		Vote    *SignerVote                `json:"own-vote"`
+	}{bc.authorities, bc.votes, bc.vote})
+}
+
+func (bc *Blockchain) HttpPropose(w http.ResponseWriter, r *http.Request) {
+	/*
+		POST /propose - sets the vote included in the blocks sealed by this node, {"authorize": false} with
+		an empty candidate withdraws the vote.
+		Administrative endpoint, only accepted from the node itself.
+	*/
+	w.Header().Set("Content-Type", "application/json")
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		http.Error(w, pbft.JsonBodyPadding("votes can only be proposed locally"), http.StatusForbidden)
+		return
+	}
+
+	var vote SignerVote
+	if err := json.NewDecoder(r.Body).Decode(&vote); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if vote.Candidate.Identifier == "" {
+		bc.vote = nil
+		json.NewEncoder(w).Encode(pbft.JsonBodyPadding("vote withdrawn"))
+		return
+	}
+
+	if vote.Authorize {
+		if _, err := vote.Candidate.PublicKey.Verifier(); err != nil {
+			http.Error(w, pbft.JsonBodyPadding("incorrect candidate public key"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	bc.vote = &vote
+	json.NewEncoder(w).Encode(pbft.JsonBodyPadding("ok"))
+}
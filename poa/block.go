@@ -0,0 +1,63 @@
+package poa
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"evoting/pbft"
+)
+
+type Authority struct {
+	// authorized signer
+	Identifier string         `json:"node-id"`
+	PublicKey  pbft.PublicKey `json:"public-key"`
+}
+
+type SignerVote struct {
+	// vote of a signer to add (authorize) or remove a signer, carried in the blocks sealed by the voter
+	Candidate Authority `json:"candidate"`
+	Authorize bool      `json:"authorize"`
+}
+
+type Block struct {
+	Identifier        int                `json:"id"`
+	Timestamp         int                `json:"timestamp"`
+	Transactions      []pbft.Transaction `json:"transactions"`
+	PreviousBlockHash string             `json:"previousHash"`
+	Signers           []Authority        `json:"signers,omitempty"` // initial signers, genesis block only
+	Signer            string             `json:"signer,omitempty"`
+	Difficulty        int                `json:"difficulty,omitempty"` // priority of the signer for the block, see authority.go
+	Vote              *SignerVote        `json:"vote,omitempty"`
+	Client            *pbft.Node         `json:"client,omitempty"`     // client of the request the block was sealed for
+	RequestId         string             `json:"request-id,omitempty"` // id of the client's request
+	Signature         string             `json:"signature,omitempty"`  // signer's signature over the block without the signature
+}
+
+func calculateHash(block Block) string {
+	// JSON instead of the default formatting - the block contains a pointer
+	encoded, _ := json.Marshal(block)
+	return fmt.Sprintf("%x", sha256.Sum256(encoded))
+}
+
+func (b Block) unsigned() Block {
+	b.Signature = ""
+	return b
+}
+
+func (b Block) client() pbft.Node {
+	// Blocks of requests submitted through the shared API have no client.
+	if b.Client == nil {
+		return pbft.Node{}
+	}
+	return *b.Client
+}
+
+func (b Block) votingInfo() pbft.VotingInfo {
+	// Response to the client's request, the client only needs the block id and the request id.
+	block := pbft.Block{Identifier: b.Identifier, Timestamp: b.Timestamp, Transactions: b.Transactions, PreviousBlockHash: b.PreviousBlockHash}
+	digest := calculateHash(b)
+	voting := pbft.Voting{BlockId: b.Identifier, Digest: digest, YesVotes: []pbft.VoteRequest{}, NoVotes: []pbft.VoteRequest{}, Client: b.client(), RequestId: b.RequestId}
+
+	return pbft.VotingInfo{VotingData: voting, BlockData: block, Digest: digest, Sender: b.Signer}
+}
@@ -0,0 +1,792 @@
+package poa
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"evoting/consensus"
+	"evoting/pbft"
+	"evoting/transport"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Proof of Authority.
+Replicas take the same requests as PBFT replicas (POST /request) and reply to the client the same way, so client
+nodes and the connector work unchanged. A request is turned into a block by the signer whose turn it is (see
+authority.go) - other replicas forward the request to it, or to the other signers in order of priority if it can't
+be reached. The signer seals (signs) the block, including the client and the id of the request, and sends it to all
+replicas, which check the seal and execute the block in order of block identifiers: blocks with invalid transactions
+are rejected and their identifier is skipped.
+An out-of-turn block is executed only once the signer in turn had outOfTurnDelay to send its block. A replica that
+doesn't receive the in-turn block in that time executes the out-of-turn one, and switches to the heavier fork once it
+sees a block that doesn't fit its chain. Signers that seal two different blocks for the same identifier are voted
+out (see fork.go).
+*/
+
+const maxForwardHops = 3 // replicas that disagree on the next block id forward the request at most this many times
+
+const outOfTurnDelay = time.Second // out-of-turn signers wait this long per position behind the signer in turn
+
+type Forward struct {
+	// request forwarded to the signer in turn
+	Request   pbft.Request `json:"request"`
+	BlockId   int          `json:"block-id"` // next block id as seen by the forwarding replica
+	Hops      int          `json:"hops"`
+	OutOfTurn bool         `json:"out-of-turn"` // the signer in turn can't be reached, seal out of turn
+}
+
+type Blockchain struct {
+	pbft.Membership         // peers (other signers and replicas), see pbft/membership.go
+	Chain           []Block `json:"chain"`
+	Identifier      string  `json:"node-id"`
+	Executed        int     `json:"-"` // identifier of the last executed or rejected block
+	mutex           *sync.Mutex
+	signer          pbft.Signer
+
+	authorities []Authority                // current signers ordered by identifier, see authority.go
+	votes       map[string]map[string]bool // candidate -> signer -> authorize
+	vote        *SignerVote                // own vote, carried in the blocks sealed by this node
+
+	proposals    map[int]Block      // executed (or rejected) blocks by block id
+	buffer       map[int]Block      // blocks received before the preceding ones, or out-of-turn blocks held back
+	bufferedAt   map[int]time.Time  // block id -> when the first block with the id was received
+	scheduled    bool               // execution of a held back out-of-turn block is scheduled
+	syncing      bool               // a chain is being fetched, see fork.go
+	equivocators map[string]int     // signer -> block id it sealed twice, see fork.go
+	replies      map[int]pbft.Reply // replies sent to the clients by block id
+	requests     map[string]int     // client requests -> block id
+	blockIndex   map[int]int        // block id -> position in the chain
+	hashIndex    map[string]int     // block hash -> position in the chain
+	tokenIndex   map[string]int     // token -> position of the block containing the transaction
+	tally        consensus.Tally    // votes counted so far
+	subscribers  consensus.Subscribers
+}
+
+func NewBlockchain(port int, keystore string, scheme string) (*Blockchain, error) {
+	/*
+		Creates a replica registered at the node discovery service.
+		The first replica creates the genesis block with itself as the only signer, further signers are voted in.
+	*/
+	hostname := os.Getenv("HOSTNAME")
+	self := pbft.Node{Address: hostname, Port: port, Identifier: hostname, Type: "blockchain"}
+
+	var signer pbft.Signer
+	var err error
+	if keystore == "" {
+		// generate a throwaway signing key
+		signer, err = pbft.GenerateSigningKey(scheme)
+	} else {
+		signer, err = pbft.LoadOrCreateKeystore(keystore, pbft.KeystorePassword(), scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	self.PublicKey = signer.Public()
+	if keystore != "" {
+		self.Identifier = pbft.NodeIdFromKey(self.PublicKey)
+	}
+
+	if err := pbft.CheckTLSIdentity(self); err != nil {
+		return nil, err
+	}
+
+	return newBlockchain(self, signer, nil)
+}
+
+func NewStaticBlockchain(cluster *pbft.ClusterConfig, identifier string, keystore string) (*Blockchain, error) {
+	/*
+		Creates a replica described by the static cluster config.
+		All blockchain nodes of the config are the initial signers.
+	*/
+	signer, err := pbft.LoadKeystore(keystore, pbft.KeystorePassword())
+	if err != nil {
+		return nil, err
+	}
+
+	if identifier == "" {
+		identifier = pbft.NodeIdFromKey(signer.Public())
+	}
+
+	self, err := cluster.NodeById(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.Type != "blockchain" {
+		return nil, fmt.Errorf("node %v is not a blockchain node", identifier)
+	}
+
+	if signer.Public() != self.PublicKey {
+		return nil, fmt.Errorf("private key does not match the public key of node %v", identifier)
+	}
+
+	if err := pbft.CheckTLSIdentity(self); err != nil {
+		return nil, err
+	}
+
+	return newBlockchain(self, signer, cluster)
+}
+
+func newBlockchain(self pbft.Node, signer pbft.Signer, cluster *pbft.ClusterConfig) (*Blockchain, error) {
+	var bc Blockchain
+	bc.Identifier = self.Identifier
+	bc.signer = signer
+	bc.mutex = &sync.Mutex{}
+	bc.Membership = pbft.NewMembership(self, cluster, os.Getenv("DISCOVERY_ADDR"), bc.mutex)
+	bc.proposals = make(map[int]Block)
+	bc.buffer = make(map[int]Block)
+	bc.bufferedAt = make(map[int]time.Time)
+	bc.equivocators = make(map[string]int)
+	bc.replies = make(map[int]pbft.Reply)
+	bc.requests = make(map[string]int)
+	bc.subscribers = make(consensus.Subscribers)
+
+	bc.RegisterNode()
+	bc.RefreshPeers()
+
+	if bc.Cluster != nil {
+		// replicas of a static cluster share the same genesis block
+		var signers []Authority
+		for _, n := range bc.Cluster.BlockchainNodes() {
+			signers = append(signers, Authority{Identifier: n.Identifier, PublicKey: n.PublicKey})
+		}
+		sortAuthorities(signers)
+		bc.Chain = []Block{{Identifier: 0, Timestamp: 0, Transactions: []pbft.Transaction{}, Signers: signers}}
+		bc.reindex()
+		bc.FetchChain()
+	} else if len(bc.Peers) < 1 {
+		fmt.Println("[INFO] too few peers, creating genesis block with this node as the only signer")
+		signers := []Authority{{Identifier: self.Identifier, PublicKey: self.PublicKey}}
+		bc.Chain = []Block{{Identifier: 0, Timestamp: int(time.Now().Unix()), Transactions: []pbft.Transaction{}, Signers: signers}}
+		bc.reindex()
+	} else if !bc.FetchChain() {
+		return nil, errors.New("failed to fetch the chain from peers")
+	}
+
+	return &bc, nil
+}
+
+func (bc *Blockchain) peer(id string) (pbft.Node, error) {
+	// Looks up a replica, peers are refreshed if it isn't known (it might have joined recently).
+	bc.mutex.Lock()
+	peer := bc.PeerById(id)
+	bc.mutex.Unlock()
+
+	if peer == (pbft.Node{}) {
+		bc.RefreshPeers()
+		bc.mutex.Lock()
+		peer = bc.PeerById(id)
+		bc.mutex.Unlock()
+	}
+
+	if peer == (pbft.Node{}) {
+		return peer, fmt.Errorf("replica %v not found", id)
+	}
+	return peer, nil
+}
+
+func (bc *Blockchain) LastBlock() Block {
+	return bc.Chain[len(bc.Chain)-1]
+}
+
+func (bc *Blockchain) sign(message interface{}) string {
+	// Signature over the JSON encoded message, verifiable with pbft.VerifyMessage.
+	payload, _ := json.Marshal(message)
+	signed, _ := bc.signer.Sign(payload)
+	return hex.EncodeToString(signed)
+}
+
+func (bc *Blockchain) FetchChain() bool {
+	/*
+		Switches to the (verified) chain of a random peer if the peer's chain is heavier, see fork.go.
+		Returns false if the chain could not be fetched.
+	*/
+	if len(bc.Peers) < 1 {
+		return false
+	}
+
+	fmt.Println("[INFO] fetching blockchain from a peer")
+	if err := bc.fetchChain(pbft.RandomNode(bc.Peers)); err != nil {
+		fmt.Println("[ERROR]", err.Error())
+		return false
+	}
+	return true
+}
+
+func verifyChain(chain []Block) error {
+	// Replays the chain, checking the seal and transactions of every block.
+	if len(chain) == 0 || len(chain[0].Signers) == 0 {
+		return errors.New("missing genesis block")
+	}
+
+	replay := Blockchain{Chain: chain[:1], mutex: &sync.Mutex{}}
+	replay.reindex()
+
+	for _, block := range chain[1:] {
+		if block.Identifier <= replay.LastBlock().Identifier {
+			return fmt.Errorf("block %v out of order", block.Identifier)
+		}
+		if err := replay.checkSeal(block); err != nil {
+			return err
+		}
+		if reasons := replay.validateBlock(block); len(reasons) > 0 {
+			return fmt.Errorf("block %v contains invalid transactions", block.Identifier)
+		}
+		replay.appendBlock(block)
+	}
+	return nil
+}
+
+func (bc *Blockchain) verifySeal(block Block) error {
+	/*
+		The block has to be sealed by a signer with the difficulty of its position (see authority.go).
+		Called with the mutex held.
+	*/
+	sealer, isSigner := bc.authority(block.Signer)
+	if !isSigner {
+		return fmt.Errorf("block %v sealed by %v, not a signer", block.Identifier, block.Signer)
+	}
+	if expected := bc.difficulty(block.Identifier, block.Signer); block.Difficulty != expected {
+		return fmt.Errorf("block %v sealed by %v with difficulty %v, expected %v", block.Identifier, block.Signer, block.Difficulty, expected)
+	}
+
+	if err := pbft.VerifySignature(sealer.PublicKey, []byte(block.Signature), signedPayload(block.unsigned())); err != nil {
+		return fmt.Errorf("incorrect seal of block %v", block.Identifier)
+	}
+
+	if len(block.Signers) > 0 {
+		return fmt.Errorf("block %v redefines the signers", block.Identifier)
+	}
+	return nil
+}
+
+func (bc *Blockchain) checkSeal(block Block) error {
+	// The block has to be sealed correctly and linked to the last block. Called with the mutex held.
+	if err := bc.verifySeal(block); err != nil {
+		return err
+	}
+
+	if block.PreviousBlockHash != calculateHash(bc.LastBlock()) {
+		return fmt.Errorf("block %v does not follow the last block", block.Identifier)
+	}
+	return nil
+}
+
+func signedPayload(message interface{}) string {
+	payload, _ := json.Marshal(message)
+	return string(payload)
+}
+
+func (bc *Blockchain) validateBlock(block Block) []pbft.RejectReason {
+	return pbft.ValidateTransactions(block.Transactions, bc.tokenUsed)
+}
+
+func (bc *Blockchain) knownRequest(req pbft.Request) (Block, bool) {
+	// Requests without an id are never deduplicated. Called with the mutex held.
+	if req.RequestId == "" {
+		return Block{}, false
+	}
+
+	key := pbft.RequestKey(req.Client.Identifier, req.RequestId)
+	id, exists := bc.requests[key]
+	if !exists {
+		return Block{}, false
+	}
+
+	block, executed := bc.proposals[id]
+	if !executed {
+		block, exists = bc.buffer[id]
+	}
+	if !executed && !exists || block.RequestId != req.RequestId || block.client().Identifier != req.Client.Identifier {
+		// the block of the request was replaced by a block with a higher difficulty or dropped with its fork,
+		// the request needs another one
+		delete(bc.requests, key)
+		return Block{}, false
+	}
+
+	if executed {
+		if reply, replied := bc.replies[id]; replied {
+			// retransmitted request - repeat the reply
+			go pbft.SendReply(block.client(), reply)
+		}
+	}
+	return block, true
+}
+
+func (bc *Blockchain) seal(blockId int, req pbft.Request) Block {
+	// Creates the block of the request, called by the signer in turn with the mutex held.
+	block := Block{
+		Identifier:        blockId,
+		Timestamp:         int(time.Now().Unix()),
+		Transactions:      append([]pbft.Transaction{}, req.Transactions...),
+		PreviousBlockHash: calculateHash(bc.LastBlock()),
+		Signer:            bc.Self.Identifier,
+		Difficulty:        bc.difficulty(blockId, bc.Self.Identifier),
+		Vote:              bc.vote,
+		RequestId:         req.RequestId,
+	}
+	if req.Client != (pbft.Node{}) {
+		client := req.Client
+		block.Client = &client
+	}
+	block.Signature = bc.sign(block.unsigned())
+
+	fmt.Println("[POA] sealed block", blockId, "with difficulty", block.Difficulty)
+	bc.receive(block)
+	return block
+}
+
+func (bc *Blockchain) submit(req pbft.Request, hops int) (Block, error) {
+	// Seals the request if this node is the signer in turn, forwards it to the signer in turn otherwise.
+	bc.mutex.Lock()
+
+	if block, known := bc.knownRequest(req); known {
+		bc.mutex.Unlock()
+		return block, nil
+	}
+
+	next := bc.Executed + 1
+	sealer := bc.inTurn(next)
+	buffered, exists := bc.buffer[next]
+	if sealer.Identifier == bc.Self.Identifier && (!exists || buffered.Signer != sealer.Identifier) {
+		// an out-of-turn block held back is replaced by the in-turn one
+		block := bc.seal(next, req)
+		bc.mutex.Unlock()
+		go bc.broadcast(block)
+		return block, nil
+	}
+	bc.mutex.Unlock()
+
+	if hops >= maxForwardHops {
+		return Block{}, errors.New("replicas disagree on the signer in turn")
+	}
+
+	block, err := bc.forward(sealer.Identifier, Forward{Request: req, BlockId: next, Hops: hops + 1})
+	if err == nil {
+		return block, nil
+	}
+
+	fmt.Println("[POA] signer in turn unreachable, trying out-of-turn signers:", err.Error())
+	bc.mutex.Lock()
+	signers := bc.outOfTurn(next)
+	bc.mutex.Unlock()
+
+	for _, signer := range signers {
+		if signer.Identifier == bc.Self.Identifier {
+			return bc.sealOutOfTurn(req, next, hops+1)
+		}
+		block, err = bc.forward(signer.Identifier, Forward{Request: req, BlockId: next, Hops: hops + 1, OutOfTurn: true})
+		if err == nil {
+			return block, nil
+		}
+	}
+	return Block{}, fmt.Errorf("no signer could seal block %v: %v", next, err.Error())
+}
+
+func (bc *Blockchain) sealOutOfTurn(req pbft.Request, blockId int, hops int) (Block, error) {
+	/*
+		Seals the block out of turn, once the signers with a higher priority had time to seal it.
+		If a block arrives in the meantime, the request is submitted again for the next block.
+	*/
+	bc.mutex.Lock()
+	priority := len(bc.authorities) - bc.difficulty(blockId, bc.Self.Identifier) // positions behind the signer in turn
+	isSigner := bc.difficulty(blockId, bc.Self.Identifier) > 0
+	bc.mutex.Unlock()
+
+	if !isSigner {
+		return Block{}, errors.New("not a signer")
+	}
+	time.Sleep(time.Duration(priority) * outOfTurnDelay)
+
+	bc.mutex.Lock()
+	if block, known := bc.knownRequest(req); known {
+		bc.mutex.Unlock()
+		return block, nil
+	}
+	if _, buffered := bc.buffer[blockId]; buffered || bc.Executed+1 != blockId {
+		bc.mutex.Unlock()
+		if hops >= maxForwardHops {
+			return Block{}, errors.New("replicas disagree on the signer in turn")
+		}
+		return bc.submit(req, hops)
+	}
+
+	block := bc.seal(blockId, req)
+	bc.mutex.Unlock()
+	go bc.broadcast(block)
+	return block, nil
+}
+
+func (bc *Blockchain) forward(signerId string, forward Forward) (Block, error) {
+	// Forwards the request to a signer, the response is the sealed block.
+	peer, err := bc.peer(signerId)
+	if err != nil {
+		return Block{}, err
+	}
+
+	// an out-of-turn signer waits for the signers before it, see sealOutOfTurn
+	timeout := 10 * time.Second
+	if forward.OutOfTurn {
+		bc.mutex.Lock()
+		timeout += time.Duration(len(bc.authorities)) * outOfTurnDelay
+		bc.mutex.Unlock()
+	}
+
+	body, _ := json.Marshal(forward)
+	resp, err := transport.ClientWithTimeout(timeout).Post(transport.NodeURL(peer.String(), "forward"), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return Block{}, fmt.Errorf("failed to forward request to signer %v: %v", signerId, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return Block{}, fmt.Errorf("signer %v: status code %v: %v", signerId, resp.StatusCode, string(respBody))
+	}
+
+	var block Block
+	if err := json.NewDecoder(resp.Body).Decode(&block); err != nil {
+		return Block{}, err
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if err := bc.receive(block); err != nil {
+		return Block{}, fmt.Errorf("signer %v: %v", signerId, err.Error())
+	}
+	return block, nil
+}
+
+func (bc *Blockchain) broadcast(block Block) {
+	messageBuffer, _ := json.Marshal(block)
+	for _, peer := range bc.RefreshPeers() {
+		go func(peer pbft.Node) {
+			resp, err := transport.Post(peer.String(), "seal", messageBuffer)
+			if err != nil {
+				fmt.Println("[ERROR] failed to send block", block.Identifier, "to", peer.Identifier, err.Error())
+				return
+			}
+			resp.Body.Close()
+		}(peer)
+	}
+}
+
+func (bc *Blockchain) receive(block Block) error {
+	/*
+		Checks the seal of a block, buffers it and executes all blocks that are next in order. The seal is checked
+		first, so a forged block never takes the place of the real one. A buffered block is replaced by a block with
+		a higher difficulty (see authority.go), a block that doesn't fit the chain may belong to a heavier fork (see
+		fork.go). Called with the mutex held.
+	*/
+	blockId := block.Identifier
+	if err := bc.verifySeal(block); err != nil {
+		return err
+	}
+
+	bc.checkEquivocation(block)
+	if bc.excluded(block) {
+		return fmt.Errorf("block %v sealed by %v, which equivocated", blockId, block.Signer)
+	}
+
+	if blockId <= bc.Executed || blockId == bc.Executed+1 && block.PreviousBlockHash != calculateHash(bc.LastBlock()) {
+		if executed, exists := bc.proposals[blockId]; !exists || calculateHash(executed) != calculateHash(block) {
+			go bc.resolveFork(block.Signer)
+		}
+		return nil
+	}
+
+	if buffered, exists := bc.buffer[blockId]; !exists {
+		bc.buffer[blockId] = block
+		bc.bufferedAt[blockId] = time.Now()
+	} else if block.Difficulty > buffered.Difficulty {
+		fmt.Println("[POA] block", blockId, "of", buffered.Signer, "replaced by the block of", block.Signer)
+		bc.buffer[blockId] = block
+	}
+	if block.RequestId != "" {
+		key := pbft.RequestKey(block.client().Identifier, block.RequestId)
+		if _, exists := bc.requests[key]; !exists {
+			bc.requests[key] = blockId
+		}
+	}
+
+	bc.execute()
+	return nil
+}
+
+func (bc *Blockchain) execute() {
+	/*
+		Executes buffered blocks in order of their identifiers. Out-of-turn blocks are held back until outOfTurnDelay
+		after the first block with the identifier was received, so that the in-turn block can replace them.
+		Called with the mutex held.
+	*/
+	for {
+		blockId := bc.Executed + 1
+		block, exists := bc.buffer[blockId]
+		if !exists {
+			return
+		}
+
+		if wait := outOfTurnDelay - time.Since(bc.bufferedAt[blockId]); block.Signer != bc.inTurn(blockId).Identifier && wait > 0 {
+			if !bc.scheduled {
+				bc.scheduled = true
+				time.AfterFunc(wait, func() {
+					bc.mutex.Lock()
+					defer bc.mutex.Unlock()
+					bc.scheduled = false
+					bc.execute()
+				})
+			}
+			return
+		}
+		delete(bc.buffer, blockId)
+		delete(bc.bufferedAt, blockId)
+
+		if err := bc.checkSeal(block); err != nil {
+			// the signer set changed since the block was buffered, or the block belongs to another fork
+			fmt.Println("[ERROR]", err.Error())
+			go bc.resolveFork(block.Signer)
+			return
+		}
+
+		bc.Executed = blockId
+		bc.proposals[blockId] = block
+
+		if reasons := bc.validateBlock(block); len(reasons) > 0 {
+			fmt.Println("[INFO] block", blockId, "rejected, reasons:", reasons)
+			bc.replyToClient(block, pbft.Reply{Result: "rejected", Reasons: reasons})
+			continue
+		}
+
+		bc.appendBlock(block)
+		bc.replyToClient(block, pbft.Reply{Result: "committed", BlockHash: calculateHash(block)})
+	}
+}
+
+func (bc *Blockchain) replyToClient(block Block, reply pbft.Reply) {
+	// Signs the reply, records it and sends it to the client. Called with the mutex held.
+	client := block.client()
+	if client.Identifier == "" {
+		return
+	}
+
+	reply.BlockId, reply.ReplicaId, reply.RequestIds = block.Identifier, bc.Self.Identifier, []string{}
+	if block.RequestId != "" {
+		reply.RequestIds = []string{block.RequestId}
+	}
+	reply.Signature = bc.sign(reply)
+	bc.replies[reply.BlockId] = reply
+
+	go pbft.SendReply(client, reply)
+}
+
+func (bc *Blockchain) catchUp(from pbft.Node, blockId int) {
+	// Fetches the blocks preceding the given block id from another replica.
+	for {
+		bc.mutex.Lock()
+		next := bc.Executed + 1
+		_, buffered := bc.buffer[next]
+		bc.mutex.Unlock()
+
+		if next >= blockId || buffered {
+			return
+		}
+
+		resp, err := transport.Get(from.String(), fmt.Sprintf("proposal/%v", next))
+		if err != nil {
+			fmt.Println("[ERROR] failed to fetch block", next, "from", from.Identifier, err.Error())
+			return
+		}
+
+		var block Block
+		decodingErr := json.NewDecoder(resp.Body).Decode(&block)
+		resp.Body.Close()
+		if decodingErr != nil || resp.StatusCode != http.StatusOK || block.Identifier != next {
+			fmt.Println("[ERROR] replica", from.Identifier, "did not send block", next)
+			return
+		}
+
+		bc.mutex.Lock()
+		err = bc.receive(block)
+		bc.mutex.Unlock()
+		if err != nil {
+			fmt.Println("[ERROR] replica", from.Identifier, "sent an invalid block:", err.Error())
+			return
+		}
+	}
+}
+
+func (bc *Blockchain) HttpRequest(w http.ResponseWriter, r *http.Request) {
+	// A client requests a new block, the response contains the block id the request was assigned to.
+	w.Header().Set("Content-Type", "application/json")
+
+	var req pbft.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if pbft.VerifyPeer(r, req.Client) != nil && bc.VerifyReplica(r) != nil {
+		http.Error(w, pbft.JsonBodyPadding("request must come from the client or a replica"), http.StatusForbidden)
+		return
+	}
+
+	block, err := bc.submit(req, 0)
+	if err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusBadGateway)
+		return
+	}
+
+	json.NewEncoder(w).Encode(block.votingInfo())
+}
+
+func (bc *Blockchain) Submit(requestId string, transactions []consensus.Transaction) (consensus.Receipt, error) {
+	// Request submitted through the shared API (see consensus/http.go) - there is no client to send the replies to.
+	block, err := bc.submit(pbft.Request{RequestId: requestId, Timestamp: int(time.Now().Unix()), Transactions: transactions}, 0)
+	if err != nil {
+		return consensus.Receipt{}, err
+	}
+	return consensus.Receipt{RequestId: requestId, Status: "pending", BlockId: block.Identifier}, nil
+}
+
+func (bc *Blockchain) HttpForward(w http.ResponseWriter, r *http.Request) {
+	// A replica forwards a request to the signer in turn, the response is the sealed block.
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := bc.VerifyReplica(r); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	var forward Forward
+	if err := json.NewDecoder(r.Body).Decode(&forward); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	behind := forward.BlockId > bc.Executed+1
+	bc.mutex.Unlock()
+
+	if behind {
+		// the forwarding replica has seen blocks this node missed
+		if peer, err := bc.peer(bc.forwardedBy(r, forward)); err == nil {
+			bc.catchUp(peer, forward.BlockId)
+		}
+	}
+
+	var block Block
+	var err error
+	if forward.OutOfTurn {
+		block, err = bc.sealOutOfTurn(forward.Request, forward.BlockId, forward.Hops)
+	} else {
+		block, err = bc.submit(forward.Request, forward.Hops)
+	}
+	if err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusBadGateway)
+		return
+	}
+
+	json.NewEncoder(w).Encode(block)
+}
+
+func (bc *Blockchain) forwardedBy(r *http.Request, forward Forward) string {
+	// Identifier of the forwarding replica, known only with TLS. Otherwise the signer of the preceding block is asked,
+	// it has sealed (and so executed) the blocks before the expected one.
+	if key, ok := pbft.PeerPublicKey(r); ok {
+		bc.mutex.Lock()
+		defer bc.mutex.Unlock()
+		for _, peer := range bc.Peers {
+			if peer.PublicKey == key {
+				return peer.Identifier
+			}
+		}
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.inTurn(forward.BlockId - 1).Identifier
+}
+
+func (bc *Blockchain) HttpSeal(w http.ResponseWriter, r *http.Request) {
+	// A signer sends a sealed block.
+	w.Header().Set("Content-Type", "application/json")
+
+	var block Block
+	if err := json.NewDecoder(r.Body).Decode(&block); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	signer, err := bc.peer(block.Signer)
+	if err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+	if err := pbft.VerifyPeer(r, signer); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	bc.mutex.Lock()
+	err = bc.receive(block)
+	behind := block.Identifier > bc.Executed+1
+	bc.mutex.Unlock()
+
+	if err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+	json.NewEncoder(w).Encode(pbft.JsonBodyPadding("ok"))
+
+	if behind {
+		bc.catchUp(signer, block.Identifier)
+	}
+}
+
+func (bc *Blockchain) HttpGetProposal(w http.ResponseWriter, r *http.Request) {
+	// Executed (or rejected) block, used by replicas that missed it.
+	w.Header().Set("Content-Type", "application/json")
+
+	blockId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect block id"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	block, exists := bc.proposals[blockId]
+	if !exists {
+		http.Error(w, pbft.JsonBodyPadding("block not found"), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(block)
+}
+
+func (bc *Blockchain) HttpGetChain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	json.NewEncoder(w).Encode(bc)
+}
+
+func (bc *Blockchain) HttpGetPeers(w http.ResponseWriter, r *http.Request) {
+	// Debug endpoint
+	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	json.NewEncoder(w).Encode(bc.Peers)
+}
@@ -0,0 +1,37 @@
+package poa
+
+import "evoting/consensus"
+
+/*
+Commit events, streamed to subscribers (the connector) by the shared API (see consensus/events.go).
+*/
+
+func (bc *Blockchain) publish() {
+	// Sends the event of the last appended block to all subscribers. Called with the mutex held.
+	bc.subscribers.Publish(consensus.NewCommitEvent(bc.block(len(bc.Chain)-1), bc.tally))
+}
+
+func (bc *Blockchain) Subscribe(from int) ([]consensus.CommitEvent, <-chan consensus.CommitEvent, func()) {
+	// Returns events of the blocks already committed (starting at block id from) and the channel of new events.
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	var backlog []consensus.CommitEvent
+	tally := consensus.NewTally()
+
+	for position := range bc.Chain {
+		block := bc.block(position)
+		tally.Count(block)
+		if block.Identifier >= from {
+			backlog = append(backlog, consensus.NewCommitEvent(block, tally))
+		}
+	}
+
+	events := bc.subscribers.Add()
+	cancel := func() {
+		bc.mutex.Lock()
+		defer bc.mutex.Unlock()
+		bc.subscribers.Remove(events)
+	}
+	return backlog, events, cancel
+}
@@ -0,0 +1,250 @@
+package poa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"evoting/pbft"
+	"evoting/transport"
+)
+
+/*
+Fork choice and equivocation.
+Replicas may execute different blocks with the same identifier, a replica that doesn't receive the in-turn block in
+time executes an out-of-turn one. A replica that receives a block that doesn't fit its chain fetches the chain of the
+block's signer and switches to it if it's heavier: the sum of the block difficulties after the last common block is
+higher, ties are broken by the lower hash of the first differing block. The blocks dropped with the old fork are
+submitted again by their signer.
+A signer that seals two different blocks with the same identifier and the same parent equivocates. The two blocks
+prove it, so they are sent to all replicas. Blocks the signer seals after the equivocation are rejected, and the
+other signers vote to remove it (see authority.go).
+*/
+
+type Equivocation struct {
+	// two blocks sealed by the same signer for the same identifier and parent
+	Blocks [2]Block `json:"blocks"`
+}
+
+func heavier(branch []Block, other []Block) bool {
+	// Fork choice rule, compares two branches starting after the same block.
+	difficulty := func(blocks []Block) int {
+		total := 0
+		for _, block := range blocks {
+			total += block.Difficulty
+		}
+		return total
+	}
+
+	if d, o := difficulty(branch), difficulty(other); d != o {
+		return d > o
+	}
+	return len(branch) > 0 && len(other) > 0 && calculateHash(branch[0]) < calculateHash(other[0])
+}
+
+func (bc *Blockchain) resolveFork(signerId string) {
+	// Fetches the chain of the signer of a block that doesn't fit the local chain.
+	peer, err := bc.peer(signerId)
+	if err == nil {
+		err = bc.fetchChain(peer)
+	}
+	if err != nil {
+		fmt.Println("[ERROR] failed to resolve fork:", err.Error())
+	}
+}
+
+func (bc *Blockchain) fetchChain(peer pbft.Node) error {
+	// Switches to the (verified) chain of the peer if it's heavier. Only one chain is fetched at a time.
+	bc.mutex.Lock()
+	if bc.syncing {
+		bc.mutex.Unlock()
+		return nil
+	}
+	bc.syncing = true
+	bc.mutex.Unlock()
+
+	defer func() {
+		bc.mutex.Lock()
+		bc.syncing = false
+		bc.mutex.Unlock()
+	}()
+
+	resp, err := transport.Get(peer.String(), "chain")
+	if err != nil {
+		return fmt.Errorf("failed to fetch blockchain data from %v: %v", peer.Identifier, err.Error())
+	}
+	defer resp.Body.Close()
+
+	var peerBc Blockchain
+	if err := json.NewDecoder(resp.Body).Decode(&peerBc); err != nil {
+		return fmt.Errorf("erroring parsing blockchain of %v: %v", peer.Identifier, err.Error())
+	}
+
+	if err := verifyChain(peerBc.Chain); err != nil {
+		return fmt.Errorf("chain of peer %v is not valid: %v", peer.Identifier, err.Error())
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if len(bc.Chain) > 0 && calculateHash(bc.Chain[0]) != calculateHash(peerBc.Chain[0]) {
+		return fmt.Errorf("chain of peer %v has a different genesis block", peer.Identifier)
+	}
+
+	bc.adopt(peerBc.Chain)
+	return nil
+}
+
+func (bc *Blockchain) adopt(chain []Block) {
+	// Switches to the (verified) chain if it's heavier than the local one. Called with the mutex held.
+	if len(bc.Chain) == 0 {
+		// new replica
+		bc.Chain = chain
+		bc.reindex()
+		for _, block := range chain {
+			bc.proposals[block.Identifier] = block
+		}
+		bc.Executed = bc.LastBlock().Identifier
+		return
+	}
+
+	fork := 0 // position of the last common block
+	for fork+1 < len(chain) && fork+1 < len(bc.Chain) && calculateHash(chain[fork+1]) == calculateHash(bc.Chain[fork+1]) {
+		fork++
+	}
+
+	branch, dropped := chain[fork+1:], append([]Block{}, bc.Chain[fork+1:]...)
+	for _, block := range branch {
+		bc.checkEquivocation(block)
+		if bc.excluded(block) {
+			return
+		}
+	}
+	if !heavier(branch, dropped) {
+		return
+	}
+
+	forkId := bc.Chain[fork].Identifier
+	bc.Chain = append([]Block{}, bc.Chain[:fork+1]...)
+	bc.reindex()
+	for id := range bc.proposals {
+		// includes the rejected blocks of the old fork
+		if id > forkId {
+			delete(bc.proposals, id)
+			delete(bc.replies, id)
+		}
+	}
+
+	for _, block := range branch {
+		bc.appendBlock(block)
+		bc.proposals[block.Identifier] = block
+	}
+	bc.Executed = bc.LastBlock().Identifier
+
+	for id := range bc.buffer {
+		if id <= bc.Executed {
+			delete(bc.buffer, id)
+			delete(bc.bufferedAt, id)
+		}
+	}
+
+	if len(dropped) > 0 {
+		fmt.Println("[POA] switched to a heavier fork after block", forkId, "-", len(dropped), "blocks dropped")
+	}
+	for _, block := range dropped {
+		if block.Signer == bc.Self.Identifier && len(bc.validateBlock(block)) == 0 {
+			go bc.resubmit(block)
+		}
+	}
+	bc.execute()
+}
+
+func (bc *Blockchain) resubmit(block Block) {
+	// Submits the request of a block dropped with its fork again.
+	req := pbft.Request{Client: block.client(), RequestId: block.RequestId, Timestamp: block.Timestamp, Transactions: block.Transactions}
+	if _, err := bc.submit(req, 0); err != nil {
+		fmt.Println("[ERROR] failed to resubmit the request of dropped block", block.Identifier, err.Error())
+	}
+}
+
+func (bc *Blockchain) checkEquivocation(block Block) {
+	// Compares a block with the known block of the same id. Called with the mutex held.
+	hash := calculateHash(block)
+	for _, other := range []Block{bc.proposals[block.Identifier], bc.buffer[block.Identifier]} {
+		if other.Signer == block.Signer && other.PreviousBlockHash == block.PreviousBlockHash && calculateHash(other) != hash {
+			bc.recordEquivocation(Equivocation{Blocks: [2]Block{other, block}})
+			return
+		}
+	}
+}
+
+func (bc *Blockchain) recordEquivocation(evidence Equivocation) {
+	// Called with the mutex held.
+	signer, blockId := evidence.Blocks[0].Signer, evidence.Blocks[0].Identifier
+	if _, known := bc.equivocators[signer]; known {
+		return
+	}
+
+	fmt.Println("[POA] signer", signer, "sealed two blocks with id", blockId)
+	bc.equivocators[signer] = blockId
+	if authority, isSigner := bc.authority(signer); isSigner && bc.vote == nil && signer != bc.Self.Identifier {
+		bc.vote = &SignerVote{Candidate: authority, Authorize: false}
+	}
+
+	go bc.broadcastEquivocation(evidence)
+}
+
+func (bc *Blockchain) excluded(block Block) bool {
+	// Blocks an equivocating signer sealed after the equivocation are rejected. Called with the mutex held.
+	blockId, equivocated := bc.equivocators[block.Signer]
+	return equivocated && block.Identifier > blockId
+}
+
+func (bc *Blockchain) broadcastEquivocation(evidence Equivocation) {
+	messageBuffer, _ := json.Marshal(evidence)
+	for _, peer := range bc.RefreshPeers() {
+		go func(peer pbft.Node) {
+			resp, err := transport.Post(peer.String(), "equivocation", messageBuffer)
+			if err != nil {
+				fmt.Println("[ERROR] failed to send equivocation of", evidence.Blocks[0].Signer, "to", peer.Identifier, err.Error())
+				return
+			}
+			resp.Body.Close()
+		}(peer)
+	}
+}
+
+func (bc *Blockchain) HttpEquivocation(w http.ResponseWriter, r *http.Request) {
+	// A replica sends the proof that a signer sealed two blocks with the same id.
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := bc.VerifyReplica(r); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	var evidence Equivocation
+	if err := json.NewDecoder(r.Body).Decode(&evidence); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	first, second := evidence.Blocks[0], evidence.Blocks[1]
+	if first.Identifier != second.Identifier || first.Signer != second.Signer || first.PreviousBlockHash != second.PreviousBlockHash || calculateHash(first) == calculateHash(second) {
+		http.Error(w, pbft.JsonBodyPadding("blocks are not an equivocation"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	for _, block := range evidence.Blocks {
+		if err := bc.verifySeal(block); err != nil {
+			http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	bc.recordEquivocation(evidence)
+	json.NewEncoder(w).Encode(pbft.JsonBodyPadding("ok"))
+}
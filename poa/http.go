@@ -0,0 +1,21 @@
+package poa
+
+import "github.com/gorilla/mux"
+
+func (bc *Blockchain) Routes(r *mux.Router) {
+	// Engine specific endpoints, the shared API is registered by consensus.HandleApi (see main.go).
+	r.HandleFunc("/forward", bc.HttpForward).Methods("POST")
+	r.HandleFunc("/seal", bc.HttpSeal).Methods("POST")
+	r.HandleFunc("/equivocation", bc.HttpEquivocation).Methods("POST")
+	r.HandleFunc("/proposal/{id:[0-9]+}", bc.HttpGetProposal).Methods("GET")
+	r.HandleFunc("/chain", bc.HttpGetChain).Methods("GET")
+	r.HandleFunc("/certify/{height:[0-9]+}", bc.HttpCertify).Methods("GET")
+	r.HandleFunc("/request", bc.HttpRequest).Methods("POST")
+	r.HandleFunc("/signers", bc.HttpGetSigners).Methods("GET")
+	r.HandleFunc("/propose", bc.HttpPropose).Methods("POST")
+	r.HandleFunc("/peers", bc.HttpGetPeers).Methods("GET")
+}
+
+func (bc *Blockchain) Port() int {
+	return bc.Self.Port
+}
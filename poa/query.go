@@ -0,0 +1,145 @@
+package poa
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"evoting/consensus"
+	"evoting/pbft"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Chain queries of the replica, served by the shared API (see consensus/http.go) like those of the PBFT replicas,
+so the connector reads PoA chains unchanged.
+*/
+
+func (bc *Blockchain) indexBlock(position int) {
+	// Called with the mutex held.
+	block := bc.Chain[position]
+	bc.blockIndex[block.Identifier] = position
+	bc.hashIndex[calculateHash(block)] = position
+	for _, t := range block.Transactions {
+		bc.tokenIndex[t.TokenId] = position
+	}
+}
+
+func (bc *Blockchain) reindex() {
+	// Rebuilds all indexes, the tally and the signer set, used whenever the chain is replaced.
+	bc.blockIndex = make(map[int]int)
+	bc.hashIndex = make(map[string]int)
+	bc.tokenIndex = make(map[string]int)
+	bc.tally = consensus.NewTally()
+	for position, block := range bc.Chain {
+		bc.indexBlock(position)
+		bc.tally.CountTransactions(block.Transactions)
+	}
+	bc.replayAuthorities()
+}
+
+func (bc *Blockchain) appendBlock(block Block) {
+	// Called with the mutex held.
+	bc.Chain = append(bc.Chain, block)
+	bc.indexBlock(len(bc.Chain) - 1)
+	bc.tally.CountTransactions(block.Transactions)
+	bc.countVote(block)
+	bc.publish()
+}
+
+func (bc *Blockchain) tokenUsed(tokenId string) bool {
+	// Called with the mutex held.
+	_, used := bc.tokenIndex[tokenId]
+	return used
+}
+
+func (bc *Blockchain) block(position int) consensus.Block {
+	// Block at the given position in the common model. Called with the mutex held.
+	block := bc.Chain[position]
+	return consensus.Block{
+		Identifier:        block.Identifier,
+		Timestamp:         block.Timestamp,
+		Transactions:      block.Transactions,
+		PreviousBlockHash: block.PreviousBlockHash,
+		Height:            position,
+		Hash:              calculateHash(block),
+	}
+}
+
+func (bc *Blockchain) lookup(position int, exists bool) (consensus.Block, bool) {
+	// Called with the mutex held.
+	if !exists || position < 0 || position >= len(bc.Chain) {
+		return consensus.Block{}, false
+	}
+	return bc.block(position), true
+}
+
+func (bc *Blockchain) Height() int {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return len(bc.Chain) - 1
+}
+
+func (bc *Blockchain) BlockAt(height int) (consensus.Block, bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.lookup(height, true)
+}
+
+func (bc *Blockchain) BlockById(id int) (consensus.Block, bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	position, exists := bc.blockIndex[id]
+	return bc.lookup(position, exists)
+}
+
+func (bc *Blockchain) BlockByHash(hash string) (consensus.Block, bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	position, exists := bc.hashIndex[hash]
+	return bc.lookup(position, exists)
+}
+
+func (bc *Blockchain) BlockByToken(token string) (consensus.Block, bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	position, exists := bc.tokenIndex[token]
+	return bc.lookup(position, exists)
+}
+
+func (bc *Blockchain) Tally() consensus.Tally {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.tally.At(bc.block(len(bc.Chain) - 1))
+}
+
+func (bc *Blockchain) HttpCertify(w http.ResponseWriter, r *http.Request) {
+	// GET /certify/{height} - signed tally of the chain up to the given height, see pbft/certify.go.
+	w.Header().Set("Content-Type", "application/json")
+
+	height, err := strconv.Atoi(mux.Vars(r)["height"])
+	if err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect height"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if height >= len(bc.Chain) {
+		http.Error(w, pbft.JsonBodyPadding("height not reached yet"), http.StatusNotFound)
+		return
+	}
+
+	tally := consensus.NewTally()
+	for _, block := range bc.Chain[:height+1] {
+		tally.CountTransactions(block.Transactions)
+	}
+	tally.Height, tally.BlockId, tally.BlockHash = height, bc.Chain[height].Identifier, calculateHash(bc.Chain[height])
+
+	attestation := pbft.Attestation{Tally: tally, ReplicaId: bc.Self.Identifier}
+	attestation.Signature = bc.sign(attestation)
+
+	json.NewEncoder(w).Encode(attestation)
+}
@@ -2,53 +2,133 @@ package pow
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"strings"
+	"math/bits"
+	"runtime"
+	"strconv"
+	"sync"
 )
 
 type Block struct {
 	Timestamp         int           `json:"timestamp"`
+	Difficulty        int           `json:"difficulty"` // number of leading zero bits required in the block hash
 	Nonce             int           `json:"nonce"`
 	Transactions      []Transaction `json:"transactions"`
+	TransactionsHash  string        `json:"transactionsHash"`
 	PreviousBlockHash string        `json:"previousHash"`
 }
 
+/*
+Only the block header is hashed - the transactions are committed to by the transactions hash, which has to be checked
+separately (validBody). Mining hashes the fixed part of the header followed by the nonce, so the transactions
+are not serialized for every attempt.
+*/
+
+func transactionsHash(transactions []Transaction) string {
+	encoded, _ := json.Marshal(transactions)
+	return fmt.Sprintf("%x", sha256.Sum256(encoded))
+}
+
+func (b Block) headerPrefix() []byte {
+	// header without the nonce
+	return []byte(fmt.Sprintf("%v %v %v %v ", b.Timestamp, b.Difficulty, b.PreviousBlockHash, b.TransactionsHash))
+}
+
 func calculateHash(block Block) string {
-	hash := sha256.New()
-	hash.Write([]byte(fmt.Sprintf("%v", block)))
+	hash := sha256.Sum256(strconv.AppendInt(block.headerPrefix(), int64(block.Nonce), 10))
+
+	return fmt.Sprintf("%x", hash) // return string representing hex formatted hash
+}
 
-	return fmt.Sprintf("%x", hash.Sum(nil)) // return string representing hex formatted hash
+func validBody(block Block) bool {
+	return block.TransactionsHash == transactionsHash(block.Transactions)
 }
 
 func (b *Block) ProofOfWork(difficulty int) string {
 	/*
-		Calculates the PoW for the block with given difficulty.
-		As a byproduct also modifies the block nonce.
+		Calculates the PoW for the block with given difficulty (leading zero bits).
+		As a byproduct also modifies the block nonce and sets the block difficulty and transactions hash.
 	*/
-	hash := calculateHash(*b)
-
-	for !strings.HasPrefix(hash, strings.Repeat("0", difficulty)) {
-		b.Nonce += 1
-		hash = calculateHash(*b)
-	}
-
+	hash, _ := b.mine(difficulty, nil)
 	return hash
 }
 
-func (b Block) AddTransaction(ta Transaction) {
-	valid, error := validateTransaction(ta)
+func (b *Block) mine(difficulty int, abort <-chan struct{}) (string, bool) {
+	/*
+		Proof of work searched by a worker per CPU, every worker tries every n-th nonce.
+		Gives up once the abort channel is closed.
+	*/
+	b.Difficulty = difficulty
+	b.TransactionsHash = transactionsHash(b.Transactions)
+	prefix := b.headerPrefix()
 
-	if !valid {
-		fmt.Println(error)
-		return
+	workers := runtime.GOMAXPROCS(0)
+	found := make(chan int, workers)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(nonce int) {
+			defer wg.Done()
+			searchNonce(prefix, difficulty, nonce, workers, stop, found)
+		}(b.Nonce + w)
 	}
 
-	b.Transactions = append(b.Transactions, ta)
+	mined := true
+	select {
+	case b.Nonce = <-found:
+	case <-abort:
+		mined = false
+	}
+	close(stop)
+	wg.Wait()
 
-	// reset nonce when block changes
-	b.Nonce = 0
+	if !mined {
+		return "", false
+	}
+	return calculateHash(*b), true
 }
 
-func InitBlock() {
+func searchNonce(prefix []byte, difficulty int, nonce int, step int, stop <-chan struct{}, found chan<- int) {
+	header := make([]byte, len(prefix), len(prefix)+20)
+	copy(header, prefix)
 
+	for attempt := 0; ; attempt++ {
+		if attempt%abortCheckInterval == 0 {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+
+		hash := sha256.Sum256(strconv.AppendInt(header, int64(nonce), 10))
+		if leadingZeroBits(hash[:]) >= difficulty {
+			found <- nonce
+			return
+		}
+		nonce += step
+	}
+}
+
+func leadingZeroBits(hash []byte) int {
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
+func meetsDifficulty(hash string, difficulty int) bool {
+	decoded, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	return leadingZeroBits(decoded) >= difficulty
 }
@@ -1,56 +1,69 @@
 package pow
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
-)
 
-const DEBUG_MODE bool = false // TODO: set this dynamically in main.go
+	"evoting/consensus"
+	"evoting/pbft"
+	"evoting/transport"
+)
 
 type Blockchain struct {
-	Chain               []Block       `json:"chain"`
-	Difficulty          int           `json:"difficulty"`
-	pendingTransactions []Transaction // no need to export this field
-	blockHashes         []string      // maintained so that hashes are not calculated all the time
-	Peers               []Node        `json:"peers"` // used to propagate new peers
-	Self                Node          `json:"-"`
-}
-
-func NewBlockchain(difficulty int, hostname string, port int) *Blockchain {
-	var initBlock Block
-	if DEBUG_MODE {
-		initBlock = Block{Timestamp: 0, Nonce: 0, Transactions: []Transaction{}}
-	} else {
-		initBlock = Block{Timestamp: int(time.Now().Unix()), Nonce: 0, Transactions: []Transaction{}}
-	}
+	mutex       sync.Mutex
+	mempool     *Mempool
+	included    map[string]bool       // tokens used in the chain
+	newTip      chan struct{}         // closed when the chain tip changes
+	mempoolFull chan struct{}         // wakes up the miner
+	blockSize   int                   // transactions per mined block
+	tally       consensus.Tally       // votes counted so far
+	subscribers consensus.Subscribers // commit event streams, see events.go
+
+	Chain            []Block        `json:"chain"`
+	blockHashes      []string       // maintained so that hashes are not calculated all the time
+	Peers            []Node         `json:"peers"` // used to propagate new peers
+	Self             Node           `json:"-"`
+	DiscoveryAddress string         `json:"-"` // node discovery service, see discovery.go; empty if peers are configured
+	PublicKey        pbft.PublicKey `json:"-"` // key registered at node discovery, see discovery.go
+	TargetBlockTime  int            `json:"-"` // seconds, see difficulty.go
+	RetargetInterval int            `json:"-"` // blocks between difficulty adjustments
+}
+
+func NewBlockchain(difficulty int, targetBlockTime int, retargetInterval int, hostname string, port int) *Blockchain {
+	// difficulty is the initial difficulty (of the genesis block), later blocks follow the difficulty adjustment
+	initBlock := Block{Timestamp: int(time.Now().Unix()), Nonce: 0, Transactions: []Transaction{}}
 	initBlock.ProofOfWork(difficulty) // only solve the hash (modify nonce), no need to store its value
 
 	return &Blockchain{
-		Chain:               []Block{initBlock},
-		Difficulty:          difficulty,
-		pendingTransactions: []Transaction{},
-		Self:                Node{Port: port, Address: hostname},
+		Chain:            []Block{initBlock},
+		blockHashes:      []string{calculateHash(initBlock)},
+		tally:            consensus.NewTally(),
+		subscribers:      make(consensus.Subscribers),
+		mempool:          NewMempool(),
+		included:         make(map[string]bool),
+		newTip:           make(chan struct{}),
+		mempoolFull:      make(chan struct{}, 1),
+		Self:             Node{Port: port, Address: hostname},
+		TargetBlockTime:  targetBlockTime,
+		RetargetInterval: retargetInterval,
 	}
 }
 
-func (bc Blockchain) length() int {
+func (bc *Blockchain) length() int {
 	return len(bc.Chain)
 }
 
-func (bc Blockchain) LastBlock() Block {
+func (bc *Blockchain) LastBlock() Block {
 	if bc.length() == 0 {
 		return Block{}
 	}
 	return bc.Chain[bc.length()-1]
 }
 
-func (bc Blockchain) GenesisBlock() Block {
+func (bc *Blockchain) GenesisBlock() Block {
 	if bc.length() == 0 {
 		return Block{}
 	}
@@ -58,46 +71,66 @@ func (bc Blockchain) GenesisBlock() Block {
 }
 
 func (bc *Blockchain) AddTransaction(t Transaction) string {
-	// first verify and return error so that the user can be notified
-	error := ""
-	bc.pendingTransactions = append(bc.pendingTransactions, t)
-
-	return error
+	_, err := bc.AddTransactions([]Transaction{t})
+	return err
 }
 
-func (bc *Blockchain) ValidateTransactions() {
-	// validate pending transactions and append them to the blockchain
-	bc.Update(false)
-	newBlock := Block{}
-	lastBlock := bc.LastBlock()
-
-	// use the commented way if validation is required
+func (bc *Blockchain) AddTransactions(transactions []Transaction) (string, string) {
+	/*
+		Adds all transactions to the mempool or none of them, so a rejected submission leaves no votes behind.
+		Returns the token of the first invalid transaction and the error, both empty if the transactions were added.
+	*/
+	for _, t := range transactions {
+		if valid, err := validateTransaction(t); !valid {
+			return t.TokenId, err
+		}
+	}
 
-	newBlock.Transactions = append(newBlock.Transactions, bc.pendingTransactions...)
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
 
-	// for _, t := range bc.pendingTransactions {
-	// 	// validate here?
-	// 	newBlock.transactions = append(newBlock.transactions, t)
-	// }
+	used := make(map[string]bool) // tokens of the submission
+	for _, t := range transactions {
+		if bc.included[t.TokenId] || used[t.TokenId] {
+			return t.TokenId, "token already used"
+		}
+		if bc.mempool.pending[t.TokenId] {
+			return t.TokenId, "transaction already pending"
+		}
+		used[t.TokenId] = true
+	}
 
-	bc.pendingTransactions = []Transaction{} // clear pending transactions
-	newBlock.PreviousBlockHash = calculateHash(lastBlock)
+	for _, t := range transactions {
+		bc.mempool.add(t)
+	}
 
-	if DEBUG_MODE {
-		newBlock.Timestamp = 0
-	} else {
-		newBlock.Timestamp = int(time.Now().Unix())
+	if bc.mempool.size() >= bc.blockSize {
+		select {
+		case bc.mempoolFull <- struct{}{}:
+		default:
+		}
 	}
+	return "", ""
+}
 
-	newBlock.ProofOfWork(bc.Difficulty)
-	bc.Chain = append(bc.Chain, newBlock)
-	bc.blockHashes = append(bc.blockHashes, calculateHash(newBlock))
-	bc.PropagateChain()
+func (bc *Blockchain) appendBlock(block Block) {
+	// Called with the mutex held.
+	bc.Chain = append(bc.Chain, block)
+	bc.blockHashes = append(bc.blockHashes, calculateHash(block))
+	for _, t := range block.Transactions {
+		bc.included[t.TokenId] = true
+	}
+	bc.mempool.remove(block.Transactions)
+	bc.tally.Count(bc.block(len(bc.Chain) - 1))
+	bc.tipChanged()
+	bc.publish(len(bc.Chain) - 1)
 }
 
 func (bc *Blockchain) HttpGetChain(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	// fmt.Println("GET /chain Request from:", r.RemoteAddr)
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
 	json.NewEncoder(w).Encode(bc)
 }
 
@@ -111,94 +144,36 @@ func (bc *Blockchain) HttpCreateTransaction(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// bc.Update called inside of bc.ValidateTransactions
-	bc.AddTransaction(t)
-
-	// in the future ValidateTransactions should not be called separately for each transaction
-	// might need to add a database to store the transactions in
-	bc.ValidateTransactions()
-	json.NewEncoder(w).Encode(bc)
-}
-
-func (bc *Blockchain) HttpUpdate(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	newChain, err := ReconstructBlockchain(r.Body)
-
-	if err != "" {
-		http.Error(w, err, http.StatusBadRequest)
+	// the transaction is mined by the background miner
+	if err := bc.AddTransaction(t); err != "" {
+		http.Error(w, fmt.Sprintf(`{"detail": %q}`, err), http.StatusBadRequest)
 		return
 	}
-	bc.Consensus(newChain)
-	json.NewEncoder(w).Encode(`{"detail":"ok"}`)
-}
 
-func (bc Blockchain) IsValid() bool {
-	for _, block := range bc.Chain {
-		if !strings.HasPrefix(calculateHash(block), strings.Repeat("0", bc.Difficulty)) {
-			return false
-		}
-	}
-	return true
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, `{"detail": "transaction added to mempool"}`)
 }
 
-func (bc *Blockchain) Consensus(outsideChain Blockchain) {
-	/*
-		Verifies if outside chain is correct, if so, appends new blocks
-	*/
-	if !outsideChain.IsValid() || bc.length() >= outsideChain.length() {
-		return
-	}
-
-	for _, peer := range outsideChain.Peers {
-		if peer != bc.Self && !Exists(bc.Peers, peer) {
-			bc.Peers = append(bc.Peers, peer)
-		}
-	}
-
-	if calculateHash(bc.GenesisBlock()) == calculateHash(outsideChain.GenesisBlock()) {
-		// genesis blocks are the same and outside chain is valid => bc is a subchain of the outside chain
-		bc.Chain = outsideChain.Chain
-	}
+func (bc *Blockchain) IsValid() bool {
+	return bc.validChain(bc.Chain)
 }
 
-func ReconstructBlockchain(r io.ReadCloser) (Blockchain, string) {
-	var bc Blockchain
-	decodingErr := json.NewDecoder(r).Decode(&bc)
-
-	if decodingErr != nil {
-		return Blockchain{}, decodingErr.Error()
-	}
-
-	// fill this as blockHashes are not transmitted over network
-	bc.blockHashes = nil // assert blockHashes is an empty slice
-	for _, block := range bc.Chain {
-		bc.blockHashes = append(bc.blockHashes, calculateHash(block))
+func (bc *Blockchain) returnPending(orphaned []Transaction) {
+	// Orphaned transactions are mined again, unless their tokens are already pending or used in the adopted chain.
+	for _, t := range orphaned {
+		if !bc.included[t.TokenId] {
+			bc.mempool.add(t)
+		}
 	}
-
-	return bc, ""
 }
 
 func (bc *Blockchain) Update(initialize bool) {
-	// TODO: check if pending transactions have not already been validated and appended by other nodes
-	for _, peer := range bc.Peers {
-		resp, err := http.Get(fmt.Sprintf("http://%v/chain", peer.String()))
-		if err != nil {
-			fmt.Println("[ERR]", err, "Peer chain check failed, skipping peer", peer)
-			continue
-		}
+	bc.mutex.Lock()
+	peers := append([]Node{}, bc.Peers...)
+	bc.mutex.Unlock()
 
-		peerBc, reconstructErr := ReconstructBlockchain(resp.Body)
-		if reconstructErr != "" {
-			fmt.Println("[ERR] Peer chain check failed, skipping peer", peer, "error:", reconstructErr)
-			continue
-		}
-		if initialize {
-			bc.Chain = peerBc.Chain
-			bc.Difficulty = peerBc.Difficulty
-		} else {
-			bc.Consensus(peerBc)
-		}
+	for _, peer := range peers {
+		bc.syncFrom(peer, initialize)
 	}
 }
 
@@ -222,55 +197,31 @@ func (bc *Blockchain) HttpRegisterPeer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if peer != bc.Self && !Exists(bc.Peers, peer) {
-		bc.Peers = append(bc.Peers, peer)
-	}
+	bc.mutex.Lock()
+	bc.addPeer(peer)
+	bc.mutex.Unlock()
 
 	fmt.Fprint(w, `{"detail": "ok"}`)
 }
 
-func PropagateRequest(url string, bodyBytes []byte) {
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(bodyBytes))
-
-	if err != nil {
-		fmt.Println("[ERR] Propagation failed to", url, ", error:", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		body, respErr := ioutil.ReadAll(resp.Body)
-		if respErr != nil {
-			fmt.Println("[ERR]", respErr.Error())
-		}
-		fmt.Println("[ERR] Response from", url, ": status code:", resp.StatusCode, ", response:", string(body))
-	}
-}
-
-func (bc Blockchain) PropagateChain() {
-	bcBuffer, jsonErr := json.Marshal(bc)
-
-	if jsonErr != nil {
-		fmt.Println("[ERR] Chain encoding error", jsonErr.Error())
-		return
-	}
-
-	for _, peer := range bc.Peers {
-		// fmt.Println("Propagating to", peer)
-		url := fmt.Sprintf("http://%v/update", peer.String())
-
-		go PropagateRequest(url, bcBuffer)
+func (bc *Blockchain) addPeer(peer Node) {
+	if peer != bc.Self && !Exists(bc.Peers, peer) {
+		bc.Peers = append(bc.Peers, peer)
 	}
 }
 
-func (bc Blockchain) PropagateSelf() {
+func (bc *Blockchain) PropagateSelf() {
 	/*
 		Usually called after startup.
 	*/
 	bodyBytes, _ := json.Marshal(bc.Self)
 
 	for _, peer := range bc.Peers {
-		resp, err := http.Post(fmt.Sprintf("http://%v/register-peer", peer), "application/json", bytes.NewBuffer([]byte(bodyBytes)))
-		if resp.StatusCode != http.StatusOK || err != nil {
+		resp, err := transport.Post(peer.String(), "register-peer", bodyBytes)
+		if err != nil || resp.StatusCode != http.StatusOK {
 			fmt.Println("[INFO] Failed to propagate self to", peer)
+			continue
 		}
+		resp.Body.Close()
 	}
 }
@@ -0,0 +1,57 @@
+package pow
+
+import "time"
+
+/*
+Difficulty adjustment.
+Every block carries the difficulty (leading zero bits of its hash) it was mined with. Every RetargetInterval blocks
+the difficulty is adjusted so that blocks are found every TargetBlockTime seconds on average - the time the last
+RetargetInterval blocks took is compared to the target. One step doubles (or halves) the expected work, a retarget
+changes the difficulty by at most maxRetargetStep steps.
+Peers recompute the expected difficulty of every block, so all nodes of a network must use the same parameters.
+*/
+
+const (
+	minDifficulty   = 1
+	maxRetargetStep = 2       // at most 4 times more (or less) work after a retarget
+	maxClockDrift   = 10 * 60 // seconds a block timestamp may be ahead of local time
+)
+
+func retarget(difficulty int, observed int, expected int) int {
+	for step := 0; step < maxRetargetStep && observed*2 <= expected; step++ {
+		// blocks found too fast
+		difficulty++
+		observed *= 2
+	}
+	for step := 0; step < maxRetargetStep && observed >= expected*2 && difficulty > minDifficulty; step++ {
+		// blocks found too slow
+		difficulty--
+		observed /= 2
+	}
+	return difficulty
+}
+
+func (bc *Blockchain) nextDifficulty(chain []Block) int {
+	// Difficulty of the block following the given chain.
+	last := chain[len(chain)-1]
+	height := len(chain)
+
+	if bc.RetargetInterval < 2 || height%bc.RetargetInterval != 0 {
+		return last.Difficulty
+	}
+
+	first := chain[height-bc.RetargetInterval]
+	observed := last.Timestamp - first.Timestamp
+	expected := (bc.RetargetInterval - 1) * bc.TargetBlockTime
+
+	return retarget(last.Difficulty, observed, expected)
+}
+
+func (bc *Blockchain) NextDifficulty() int {
+	return bc.nextDifficulty(bc.Chain)
+}
+
+func validTimestamp(block Block, previous Block) bool {
+	// Timestamps drive the difficulty adjustment - they may not go back in time or too far into the future.
+	return block.Timestamp >= previous.Timestamp && block.Timestamp <= int(time.Now().Unix())+maxClockDrift
+}
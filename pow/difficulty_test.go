@@ -0,0 +1,91 @@
+package pow
+
+import "testing"
+
+func TestRetarget(t *testing.T) {
+	tests := []struct {
+		name       string
+		difficulty int
+		observed   int
+		expected   int
+		want       int
+	}{
+		{"on target", 10, 100, 100, 10},
+		{"slightly fast", 10, 60, 100, 10},
+		{"slightly slow", 10, 190, 100, 10},
+		{"twice as fast", 10, 50, 100, 11},
+		{"four times as fast", 10, 25, 100, 12},
+		{"step limit when fast", 10, 1, 100, 12},
+		{"all blocks at once", 10, 0, 100, 12},
+		{"twice as slow", 10, 200, 100, 9},
+		{"four times as slow", 10, 400, 100, 8},
+		{"step limit when slow", 10, 10000, 100, 8},
+		{"never below minimum", minDifficulty, 10000, 100, minDifficulty},
+		{"one step above minimum", minDifficulty + 1, 10000, 100, minDifficulty},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retarget(tt.difficulty, tt.observed, tt.expected); got != tt.want {
+				t.Fatalf("retarget(%v, %v, %v) = %v, want %v", tt.difficulty, tt.observed, tt.expected, got, tt.want)
+			}
+		})
+	}
+}
+
+func chainWithTimestamps(difficulty int, timestamps ...int) []Block {
+	chain := make([]Block, len(timestamps))
+	for i, timestamp := range timestamps {
+		chain[i] = Block{Timestamp: timestamp, Difficulty: difficulty}
+	}
+	return chain
+}
+
+func TestNextDifficulty(t *testing.T) {
+	// target 10 seconds per block, a retarget every 4 blocks compares the 3 block intervals to 30 seconds
+	tests := []struct {
+		name     string
+		interval int
+		chain    []Block
+		want     int
+	}{
+		{"between retargets", 4, chainWithTimestamps(8, 0, 1, 2), 8},
+		{"on target", 4, chainWithTimestamps(8, 0, 10, 20, 30), 8},
+		{"too fast", 4, chainWithTimestamps(8, 0, 5, 10, 15), 9},
+		{"too slow", 4, chainWithTimestamps(8, 0, 20, 40, 60), 7},
+		{"only the last interval counts", 4, chainWithTimestamps(8, 0, 100, 200, 300, 301, 302, 303, 304), 10},
+		{"retargeting disabled", 0, chainWithTimestamps(8, 0, 1, 2, 3), 8},
+		{"interval of one block", 1, chainWithTimestamps(8, 0, 1, 2, 3), 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := &Blockchain{TargetBlockTime: 10, RetargetInterval: tt.interval}
+			if got := bc.nextDifficulty(tt.chain); got != tt.want {
+				t.Fatalf("nextDifficulty = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidTimestamp(t *testing.T) {
+	previous := Block{Timestamp: 1000}
+	tests := []struct {
+		name      string
+		timestamp int
+		want      bool
+	}{
+		{"same second", 1000, true},
+		{"later", 1001, true},
+		{"earlier", 999, false},
+		{"far in the future", 1 << 40, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validTimestamp(Block{Timestamp: tt.timestamp}, previous); got != tt.want {
+				t.Fatalf("validTimestamp = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
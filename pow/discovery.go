@@ -0,0 +1,100 @@
+package pow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"evoting/pbft"
+	"evoting/transport"
+)
+
+/*
+Node discovery.
+Instead of a fixed peer, PoW nodes may register at the node discovery service shared with the PBFT replicas, so
+other nodes and the connector find them there. Nodes register as blockchain nodes and identify themselves by their
+address and the public key of their keystore, which has to be the key of the node's TLS certificate (the discovery
+service checks it). PoW nodes don't sign anything, the key only identifies the node. The discovery service asks all
+registered nodes to refresh their peers whenever a node registers.
+*/
+
+type registration struct {
+	// the node as known to the node discovery service
+	Address    string         `json:"address"`
+	Port       int            `json:"port"`
+	Type       string         `json:"node-type"`
+	Identifier string         `json:"node-id"`
+	PublicKey  pbft.PublicKey `json:"public-key"`
+}
+
+func (bc *Blockchain) LoadKey(keystore string, scheme string) error {
+	// If keystore is empty a throwaway key is generated, as with the replicas.
+	var signer pbft.Signer
+	var err error
+	if keystore == "" {
+		signer, err = pbft.GenerateSigningKey(scheme)
+	} else {
+		signer, err = pbft.LoadOrCreateKeystore(keystore, pbft.KeystorePassword(), scheme)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := pbft.CheckTLSIdentity(pbft.Node{Identifier: bc.Self.String(), PublicKey: signer.Public()}); err != nil {
+		return err
+	}
+	bc.PublicKey = signer.Public()
+	return nil
+}
+
+func (bc *Blockchain) RegisterNode() error {
+	bodyBytes, _ := json.Marshal(registration{Address: bc.Self.Address, Port: bc.Self.Port, Type: "blockchain", Identifier: bc.Self.String(), PublicKey: bc.PublicKey})
+
+	resp, err := transport.Post(bc.DiscoveryAddress, "register", bodyBytes)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node discovery responded with status code %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func (bc *Blockchain) RefreshPeers() error {
+	// Adds the blockchain nodes registered at the node discovery service to the peers.
+	if bc.DiscoveryAddress == "" {
+		return errors.New("node discovery not used")
+	}
+
+	resp, err := transport.Get(bc.DiscoveryAddress, "get-blockchain")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var nodes []Node
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return err
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	for _, node := range nodes {
+		bc.addPeer(node)
+	}
+	return nil
+}
+
+func (bc *Blockchain) HttpTriggerRefresh(w http.ResponseWriter, r *http.Request) {
+	// Called by the node discovery service when a node registers.
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := bc.RefreshPeers(); err != nil {
+		http.Error(w, fmt.Sprintf(`{"detail": %q}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, `{"detail": "ok"}`)
+}
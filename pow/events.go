@@ -0,0 +1,56 @@
+package pow
+
+import "evoting/consensus"
+
+/*
+Commit events, streamed to subscribers by the shared API (see consensus/events.go).
+Blocks are reported as soon as they are appended. After a reorganization the blocks of the adopted chain are reported
+again from the fork point on, the height of the event tells subscribers which blocks have been replaced.
+*/
+
+func (bc *Blockchain) publish(from int) {
+	// Sends the events of the blocks from the given height to the tip to all subscribers. Called with the mutex held.
+	if len(bc.subscribers) == 0 {
+		return
+	}
+
+	if from == len(bc.Chain)-1 {
+		// appended block, the running tally already counts it
+		bc.subscribers.Publish(consensus.NewCommitEvent(bc.block(from), bc.tally))
+		return
+	}
+
+	tally := consensus.NewTally()
+	for height := range bc.Chain {
+		block := bc.block(height)
+		tally.Count(block)
+		if height >= from {
+			bc.subscribers.Publish(consensus.NewCommitEvent(block, tally))
+		}
+	}
+}
+
+func (bc *Blockchain) Subscribe(from int) ([]consensus.CommitEvent, <-chan consensus.CommitEvent, func()) {
+	// Returns events of the blocks already in the chain (starting at height from) and the channel of new events.
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	var backlog []consensus.CommitEvent
+	tally := consensus.NewTally()
+
+	for height := range bc.Chain {
+		block := bc.block(height)
+		tally.Count(block)
+		if height >= from {
+			backlog = append(backlog, consensus.NewCommitEvent(block, tally))
+		}
+	}
+
+	events := bc.subscribers.Add()
+	cancel := func() {
+		bc.mutex.Lock()
+		defer bc.mutex.Unlock()
+		bc.subscribers.Remove(events)
+	}
+	return backlog, events, cancel
+}
@@ -0,0 +1,133 @@
+package pow
+
+import (
+	"math/big"
+
+	"evoting/consensus"
+)
+
+/*
+Fork choice.
+Nodes follow the chain with the most cumulative work (not necessarily the longest one). When another chain wins,
+blocks after the fork point are orphaned and their transactions are returned to the pending transactions,
+unless the winning chain already contains them.
+*/
+
+func blockWork(difficulty int) *big.Int {
+	// expected number of hashes to find a block - every leading zero bit doubles it
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+func chainWork(chain []Block) *big.Int {
+	work := new(big.Int)
+	for _, block := range chain {
+		work.Add(work, blockWork(block.Difficulty))
+	}
+	return work
+}
+
+func (bc *Blockchain) validChain(chain []Block) bool {
+	/*
+		Checks the proof of work of every block, that every block links to the one before it,
+		that it was mined with the difficulty given by the difficulty adjustment and that no token is used twice.
+	*/
+	if len(chain) == 0 || chain[0].Difficulty < minDifficulty {
+		return false
+	}
+
+	if !validBody(chain[0]) || !meetsDifficulty(calculateHash(chain[0]), chain[0].Difficulty) || len(chain[0].Transactions) != 0 {
+		return false
+	}
+
+	used := make(map[string]bool)
+	for i := 1; i < len(chain); i++ {
+		if !bc.validNextBlock(chain[:i], used, chain[i]) {
+			return false
+		}
+		for _, t := range chain[i].Transactions {
+			used[t.TokenId] = true
+		}
+	}
+	return true
+}
+
+func validTransactions(block Block, used map[string]bool) bool {
+	// Every transaction has to be valid and use a token that is used neither in the chain nor elsewhere in the block.
+	inBlock := make(map[string]bool)
+	for _, t := range block.Transactions {
+		if valid, _ := validateTransaction(t); !valid || used[t.TokenId] || inBlock[t.TokenId] {
+			return false
+		}
+		inBlock[t.TokenId] = true
+	}
+	return true
+}
+
+func (bc *Blockchain) validNextBlock(chain []Block, used map[string]bool, block Block) bool {
+	// Checks a block appended to the given (valid) chain, used holds the tokens used in the chain.
+	previous := chain[len(chain)-1]
+	return validBody(block) &&
+		validTransactions(block, used) &&
+		block.PreviousBlockHash == calculateHash(previous) &&
+		validTimestamp(block, previous) &&
+		block.Difficulty == bc.nextDifficulty(chain) &&
+		meetsDifficulty(calculateHash(block), block.Difficulty)
+}
+
+func forkPoint(chain []Block, other []Block) int {
+	// Returns the number of blocks both chains have in common.
+	common := 0
+	for common < len(chain) && common < len(other) && calculateHash(chain[common]) == calculateHash(other[common]) {
+		common++
+	}
+	return common
+}
+
+func orphanedTransactions(orphaned []Block, adopted []Block) []Transaction {
+	// Transactions of the orphaned blocks whose tokens are not used in the adopted blocks.
+	included := make(map[string]bool)
+	for _, block := range adopted {
+		for _, t := range block.Transactions {
+			included[t.TokenId] = true
+		}
+	}
+
+	var transactions []Transaction
+	for _, block := range orphaned {
+		for _, t := range block.Transactions {
+			if !included[t.TokenId] {
+				included[t.TokenId] = true
+				transactions = append(transactions, t)
+			}
+		}
+	}
+	return transactions
+}
+
+func (bc *Blockchain) Reorganize(chain []Block) []Transaction {
+	/*
+		Replaces the chain with the given one (already validated), returns the transactions of orphaned blocks
+		that have to be mined again.
+	*/
+	common := forkPoint(bc.Chain, chain)
+	orphaned := orphanedTransactions(bc.Chain[common:], chain[common:])
+
+	bc.Chain = chain
+	bc.blockHashes = nil
+	bc.included = make(map[string]bool)
+	bc.tally = consensus.NewTally()
+	for height, block := range bc.Chain {
+		bc.blockHashes = append(bc.blockHashes, calculateHash(block))
+		for _, t := range block.Transactions {
+			bc.included[t.TokenId] = true
+		}
+		bc.tally.Count(bc.block(height))
+	}
+	for _, block := range chain[common:] {
+		bc.mempool.remove(block.Transactions)
+	}
+	bc.tipChanged()
+	bc.publish(common)
+
+	return orphaned
+}
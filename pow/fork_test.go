@@ -0,0 +1,179 @@
+package pow
+
+import "testing"
+
+const testDifficulty = 4
+
+func mineOn(bc *Blockchain, chain []Block, transactions ...Transaction) []Block {
+	// Returns the chain extended by a block with the given transactions and the expected difficulty.
+	previous := chain[len(chain)-1]
+	block := Block{
+		Timestamp:         previous.Timestamp + 1,
+		Transactions:      append([]Transaction{}, transactions...),
+		PreviousBlockHash: calculateHash(previous),
+	}
+	block.ProofOfWork(bc.nextDifficulty(chain))
+	return append(append([]Block{}, chain...), block)
+}
+
+func vote(token string, party string) Transaction {
+	return Transaction{TokenId: token, ToId: party}
+}
+
+func TestChainWork(t *testing.T) {
+	tests := []struct {
+		name   string
+		chain  []Block
+		other  []Block
+		winner string // chain with more work, "" if equal
+	}{
+		{"longer chain of the same difficulty", chainWithTimestamps(4, 0, 1, 2), chainWithTimestamps(4, 0, 1), "chain"},
+		{"same length and difficulty", chainWithTimestamps(4, 0, 1), chainWithTimestamps(4, 0, 1), ""},
+		{"shorter chain with more work", chainWithTimestamps(6, 0, 1), chainWithTimestamps(4, 0, 1, 2), "chain"},
+		{"longer chain with less work", chainWithTimestamps(2, 0, 1, 2, 3), chainWithTimestamps(5, 0, 1), "other"},
+		{"one step equals two blocks", chainWithTimestamps(5, 0), chainWithTimestamps(4, 0, 1), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			winner := ""
+			switch chainWork(tt.chain).Cmp(chainWork(tt.other)) {
+			case 1:
+				winner = "chain"
+			case -1:
+				winner = "other"
+			}
+			if winner != tt.winner {
+				t.Fatalf("chain with more work = %q, want %q", winner, tt.winner)
+			}
+		})
+	}
+}
+
+func TestValidChain(t *testing.T) {
+	bc := NewBlockchain(testDifficulty, 10, 0, "localhost", 0)
+	chain := mineOn(bc, bc.Chain, vote("t1", "a"))
+	chain = mineOn(bc, chain, vote("t2", "b"))
+
+	tampered := append([]Block{}, chain...)
+	tampered[1].Transactions = []Transaction{vote("t1", "b")}
+
+	relinked := append([]Block{}, chain...)
+	relinked[2].PreviousBlockHash = calculateHash(chain[0])
+
+	easier := append([]Block{}, chain[:2]...)
+	block := Block{Timestamp: chain[1].Timestamp, Transactions: []Transaction{vote("t2", "b")}, PreviousBlockHash: calculateHash(chain[1])}
+	block.ProofOfWork(testDifficulty - 1)
+	easier = append(easier, block)
+
+	tests := []struct {
+		name  string
+		chain []Block
+		want  bool
+	}{
+		{"valid chain", chain, true},
+		{"genesis block only", chain[:1], true},
+		{"empty chain", nil, false},
+		{"token used twice", mineOn(bc, chain, vote("t1", "c")), false},
+		{"token used twice in a block", mineOn(bc, chain, vote("t3", "a"), vote("t3", "b")), false},
+		{"invalid transaction", mineOn(bc, chain, vote("", "a")), false},
+		{"transactions changed after mining", tampered, false},
+		{"block linked to the wrong parent", relinked, false},
+		{"block below the expected difficulty", easier, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bc.validChain(tt.chain); got != tt.want {
+				t.Fatalf("validChain = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReorganize(t *testing.T) {
+	tests := []struct {
+		name     string
+		own      [][]Transaction // blocks mined on the genesis block
+		fork     [][]Transaction // blocks of the winning chain after the genesis block
+		orphaned []Transaction
+		tally    map[string]int
+	}{
+		{
+			name:     "transactions of orphaned blocks are returned",
+			own:      [][]Transaction{{vote("t1", "a"), vote("t2", "b")}},
+			fork:     [][]Transaction{{vote("t3", "a")}, {vote("t4", "a")}},
+			orphaned: []Transaction{vote("t1", "a"), vote("t2", "b")},
+			tally:    map[string]int{"a": 2},
+		},
+		{
+			name:     "transactions in the winning chain are not returned",
+			own:      [][]Transaction{{vote("t1", "a"), vote("t2", "b")}},
+			fork:     [][]Transaction{{vote("t2", "b")}, {vote("t3", "c")}},
+			orphaned: []Transaction{vote("t1", "a")},
+			tally:    map[string]int{"b": 1, "c": 1},
+		},
+		{
+			name:     "extension of the own chain orphans nothing",
+			own:      [][]Transaction{{vote("t1", "a")}},
+			fork:     [][]Transaction{{vote("t1", "a")}, {vote("t2", "b")}},
+			orphaned: nil,
+			tally:    map[string]int{"a": 1, "b": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := NewBlockchain(testDifficulty, 10, 0, "localhost", 0)
+			genesis := bc.Chain
+
+			own := genesis
+			for _, transactions := range tt.own {
+				own = mineOn(bc, own, transactions...)
+			}
+			fork := genesis
+			for i, transactions := range tt.fork {
+				if i < len(tt.own) && transactionsHash(transactions) == transactionsHash(tt.own[i]) {
+					// same block as the own chain
+					fork = own[:i+2]
+					continue
+				}
+				fork = mineOn(bc, fork, transactions...)
+			}
+
+			bc.mutex.Lock()
+			for _, block := range own[1:] {
+				bc.appendBlock(block)
+			}
+			orphaned := bc.Reorganize(fork)
+			bc.mutex.Unlock()
+
+			if len(orphaned) != len(tt.orphaned) {
+				t.Fatalf("orphaned = %v, want %v", orphaned, tt.orphaned)
+			}
+			for i := range orphaned {
+				if orphaned[i] != tt.orphaned[i] {
+					t.Fatalf("orphaned = %v, want %v", orphaned, tt.orphaned)
+				}
+			}
+
+			if height := bc.Height(); height != len(fork)-1 {
+				t.Fatalf("height = %v, want %v", height, len(fork)-1)
+			}
+			tally := bc.Tally()
+			if len(tally.Votes) != len(tt.tally) {
+				t.Fatalf("tally = %v, want %v", tally.Votes, tt.tally)
+			}
+			for party, votes := range tt.tally {
+				if tally.Votes[party] != votes {
+					t.Fatalf("tally = %v, want %v", tally.Votes, tt.tally)
+				}
+			}
+			for _, transaction := range orphaned {
+				if _, found := bc.BlockByToken(transaction.TokenId); found {
+					t.Fatalf("orphaned token %v still found in the chain", transaction.TokenId)
+				}
+			}
+		})
+	}
+}
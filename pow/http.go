@@ -1,20 +1,19 @@
 package pow
 
-import (
-	"fmt"
-	"log"
-	"net/http"
+import "github.com/gorilla/mux"
 
-	"github.com/gorilla/mux"
-)
-
-func HandleRequests(blockchain *Blockchain) {
-	r := mux.NewRouter()
+func (bc *Blockchain) Routes(r *mux.Router) {
+	// Engine specific endpoints, the shared API is registered by consensus.HandleApi (see main.go).
+	r.HandleFunc("/chain", bc.HttpGetChain).Methods("GET")
+	r.HandleFunc("/transaction/create", bc.HttpCreateTransaction).Methods("POST")
+	r.HandleFunc("/inv", bc.HttpInventory).Methods("POST")
+	r.HandleFunc("/headers", bc.HttpHeaders).Methods("POST")
+	r.HandleFunc("/blocks", bc.HttpBlocks).Methods("POST")
+	r.HandleFunc("/debug/update", bc.HttpTriggerUpdate).Methods("GET")
+	r.HandleFunc("/register-peer", bc.HttpRegisterPeer).Methods("POST")
+	r.HandleFunc("/refresh", bc.HttpTriggerRefresh).Methods("GET")
+}
 
-	r.HandleFunc("/chain", blockchain.HttpGetChain).Methods("GET")
-	r.HandleFunc("/transaction/create", blockchain.HttpCreateTransaction).Methods("POST")
-	r.HandleFunc("/update", blockchain.HttpUpdate).Methods("POST")
-	r.HandleFunc("/debug/update", blockchain.HttpTriggerUpdate).Methods("GET")
-	r.HandleFunc("/register-peer", blockchain.HttpRegisterPeer).Methods("POST")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", blockchain.Self.Port), r))
+func (bc *Blockchain) Port() int {
+	return bc.Self.Port
 }
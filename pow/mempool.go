@@ -0,0 +1,61 @@
+package pow
+
+/*
+Mempool - transactions waiting to be mined, in the order they arrived.
+Transactions are keyed by their token - a transaction whose token is already pending or included in the chain is
+rejected, whatever the vote. Transactions of blocks appended to the chain are removed and transactions of orphaned
+blocks are returned. Like the rest of the blockchain state, the mempool is guarded
+by the blockchain mutex.
+*/
+
+type Mempool struct {
+	transactions []Transaction
+	pending      map[string]bool // tokens
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{pending: make(map[string]bool)}
+}
+
+func (m *Mempool) size() int {
+	return len(m.transactions)
+}
+
+func (m *Mempool) add(t Transaction) bool {
+	if m.pending[t.TokenId] {
+		return false
+	}
+	m.pending[t.TokenId] = true
+	m.transactions = append(m.transactions, t)
+	return true
+}
+
+func (m *Mempool) take(max int) []Transaction {
+	// The oldest transactions, they stay in the mempool until their block is appended.
+	if max > len(m.transactions) {
+		max = len(m.transactions)
+	}
+	return append([]Transaction{}, m.transactions[:max]...)
+}
+
+func (m *Mempool) remove(transactions []Transaction) {
+	// Removes the transactions using the same tokens, even if the pending vote differs.
+	removed := make(map[string]bool)
+	for _, t := range transactions {
+		if m.pending[t.TokenId] {
+			removed[t.TokenId] = true
+			delete(m.pending, t.TokenId)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	var remaining []Transaction
+	for _, t := range m.transactions {
+		if !removed[t.TokenId] {
+			remaining = append(remaining, t)
+		}
+	}
+	m.transactions = remaining
+}
@@ -0,0 +1,84 @@
+package pow
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+Background miner.
+A block is mined from the oldest mempool transactions every mining interval, or right away once the mempool holds
+a full block. Mining is aborted when the chain tip changes (a block of another node was appended or the chain was
+reorganized) - the transactions are still in the mempool and the next block is built on the new tip.
+*/
+
+const abortCheckInterval = 1000 // nonces tried between checks whether mining was aborted
+
+func (bc *Blockchain) tipChanged() {
+	// Aborts the block being mined. Called with the mutex held.
+	close(bc.newTip)
+	bc.newTip = make(chan struct{})
+}
+
+func (bc *Blockchain) Mine(blockSize int, interval time.Duration) {
+	bc.mutex.Lock()
+	bc.blockSize = blockSize
+	bc.mutex.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-bc.mempoolFull:
+		}
+
+		for bc.mineBlock() {
+		}
+	}
+}
+
+func (bc *Blockchain) mineBlock() bool {
+	// Mines one block on the current tip, returns true if another block should be mined right away.
+	bc.mutex.Lock()
+	if bc.mempool.size() == 0 {
+		bc.mutex.Unlock()
+		return false
+	}
+
+	lastBlock := bc.LastBlock()
+	newBlock := Block{
+		Transactions:      bc.mempool.take(bc.blockSize),
+		PreviousBlockHash: bc.blockHashes[len(bc.blockHashes)-1],
+	}
+
+	if now := int(time.Now().Unix()); now > lastBlock.Timestamp {
+		newBlock.Timestamp = now
+	} else {
+		// local clock is behind the last block
+		newBlock.Timestamp = lastBlock.Timestamp
+	}
+
+	difficulty := bc.NextDifficulty()
+	abort := bc.newTip
+	bc.mutex.Unlock()
+
+	if _, mined := newBlock.mine(difficulty, abort); !mined {
+		fmt.Println("[INFO] mining aborted, chain tip changed")
+		return true
+	}
+
+	bc.mutex.Lock()
+	if newBlock.PreviousBlockHash != bc.blockHashes[len(bc.blockHashes)-1] {
+		bc.mutex.Unlock()
+		return true
+	}
+	bc.appendBlock(newBlock)
+	tip := bc.header(len(bc.Chain) - 1)
+	again := bc.mempool.size() >= bc.blockSize
+	bc.mutex.Unlock()
+
+	bc.announce(tip)
+	return again
+}
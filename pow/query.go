@@ -0,0 +1,87 @@
+package pow
+
+import (
+	"fmt"
+
+	"evoting/consensus"
+)
+
+/*
+Chain queries and submission for the API shared with the other engines (see consensus/http.go).
+The identifier of a block is its height. Blocks are looked up by scanning the chain - PoW chains are short,
+a block takes minutes to mine.
+*/
+
+func (bc *Blockchain) block(height int) consensus.Block {
+	// Block at the given height in the common model. Called with the mutex held.
+	block := bc.Chain[height]
+	return consensus.Block{
+		Identifier:        height,
+		Timestamp:         block.Timestamp,
+		Transactions:      block.Transactions,
+		PreviousBlockHash: block.PreviousBlockHash,
+		Height:            height,
+		Hash:              bc.blockHashes[height],
+	}
+}
+
+func (bc *Blockchain) Submit(requestId string, transactions []consensus.Transaction) (consensus.Receipt, error) {
+	// Transactions are added to the mempool (all or none), the miner decides which blocks they end up in.
+	// Retries need no request id, a token already pending or mined is never added again.
+	if token, err := bc.AddTransactions(transactions); err != "" {
+		return consensus.Receipt{}, fmt.Errorf("%w: %v (token %v)", consensus.ErrInvalid, err, token)
+	}
+	return consensus.Receipt{RequestId: requestId, Status: "pending"}, nil
+}
+
+func (bc *Blockchain) Height() int {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.length() - 1
+}
+
+func (bc *Blockchain) BlockAt(height int) (consensus.Block, bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if height < 0 || height >= bc.length() {
+		return consensus.Block{}, false
+	}
+	return bc.block(height), true
+}
+
+func (bc *Blockchain) BlockById(id int) (consensus.Block, bool) {
+	return bc.BlockAt(id)
+}
+
+func (bc *Blockchain) BlockByHash(hash string) (consensus.Block, bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	for height, blockHash := range bc.blockHashes {
+		if blockHash == hash {
+			return bc.block(height), true
+		}
+	}
+	return consensus.Block{}, false
+}
+
+func (bc *Blockchain) BlockByToken(token string) (consensus.Block, bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	for height := bc.length() - 1; height >= 0; height-- {
+		for _, t := range bc.Chain[height].Transactions {
+			if t.TokenId == token {
+				return bc.block(height), true
+			}
+		}
+	}
+	return consensus.Block{}, false
+}
+
+func (bc *Blockchain) Tally() consensus.Tally {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.tally.At(bc.block(bc.length() - 1))
+}
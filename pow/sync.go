@@ -0,0 +1,399 @@
+package pow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"evoting/transport"
+)
+
+/*
+Block propagation.
+A node that appends a block announces its hash to the peers (POST /inv), peers that don't know the block request it
+(POST /blocks). A block that doesn't extend the chain tip (competing branch or missing parent) triggers a header-first
+sync with the announcing peer: headers after the last block both nodes have in common are requested (POST /headers with
+a block locator), the blocks are only downloaded if the headers claim more cumulative work than the own chain.
+New nodes sync the same way.
+*/
+
+const (
+	maxHeaders     = 2000   // headers per response
+	maxSyncHeaders = 100000 // headers fetched by one sync, so a peer can't keep a sync going forever
+	maxBlocks      = 100    // blocks per response
+	locatorDense   = 10     // the last blocks of a locator are listed one by one, then the step doubles
+)
+
+type BlockHeader struct {
+	Height            int    `json:"height"`
+	Hash              string `json:"hash"`
+	PreviousBlockHash string `json:"previous-block-hash"`
+	TransactionsHash  string `json:"transactions-hash"`
+	Timestamp         int    `json:"timestamp"`
+	Difficulty        int    `json:"difficulty"`
+	Nonce             int    `json:"nonce"`
+}
+
+type Inventory struct {
+	Node   Node   `json:"node"` // node the block can be requested from
+	Hash   string `json:"hash"`
+	Height int    `json:"height"`
+}
+
+type HeadersRequest struct {
+	Locator []string `json:"locator"` // own block hashes, from the tip back to the genesis block
+}
+
+type HeadersResponse struct {
+	Headers []BlockHeader `json:"headers"`
+	Peers   []Node        `json:"peers"` // used to propagate new peers
+}
+
+type BlocksRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+func (bc *Blockchain) heightOf(hash string) int {
+	for height, h := range bc.blockHashes {
+		if h == hash {
+			return height
+		}
+	}
+	return -1
+}
+
+func (bc *Blockchain) header(height int) BlockHeader {
+	block := bc.Chain[height]
+	return BlockHeader{
+		Height:            height,
+		Hash:              bc.blockHashes[height],
+		PreviousBlockHash: block.PreviousBlockHash,
+		TransactionsHash:  block.TransactionsHash,
+		Timestamp:         block.Timestamp,
+		Difficulty:        block.Difficulty,
+		Nonce:             block.Nonce,
+	}
+}
+
+func (h BlockHeader) valid() bool {
+	// The block hash only covers the header - its proof of work is checked before the block is downloaded.
+	block := Block{
+		Timestamp:         h.Timestamp,
+		Difficulty:        h.Difficulty,
+		Nonce:             h.Nonce,
+		TransactionsHash:  h.TransactionsHash,
+		PreviousBlockHash: h.PreviousBlockHash,
+	}
+	return calculateHash(block) == h.Hash && meetsDifficulty(h.Hash, h.Difficulty)
+}
+
+func (bc *Blockchain) locator() []string {
+	// Hashes of the last blocks, then exponentially fewer down to the genesis block.
+	var hashes []string
+	step := 1
+	for height := len(bc.blockHashes) - 1; height > 0; height -= step {
+		hashes = append(hashes, bc.blockHashes[height])
+		if len(hashes) >= locatorDense {
+			step *= 2
+		}
+	}
+	return append(hashes, bc.blockHashes[0])
+}
+
+func headersWork(headers []BlockHeader) *big.Int {
+	work := new(big.Int)
+	for _, h := range headers {
+		work.Add(work, blockWork(h.Difficulty))
+	}
+	return work
+}
+
+func postJson(peer Node, path string, body interface{}, response interface{}) error {
+	bodyBytes, _ := json.Marshal(body)
+	resp, err := transport.Post(peer.String(), path, bodyBytes)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code %v", resp.StatusCode)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func fetchHeaders(peer Node, locator []string) ([]BlockHeader, []Node, error) {
+	// Headers of all blocks the peer has after the locator, requested page by page.
+	var headers []BlockHeader
+	var peers []Node
+	for {
+		var resp HeadersResponse
+		if err := postJson(peer, "headers", HeadersRequest{Locator: locator}, &resp); err != nil {
+			return nil, nil, err
+		}
+
+		for _, h := range resp.Headers {
+			if !h.valid() {
+				return nil, nil, errors.New("header proof of work is not valid")
+			}
+			if len(headers) > 0 {
+				last := headers[len(headers)-1]
+				if h.PreviousBlockHash != last.Hash || h.Height != last.Height+1 {
+					return nil, nil, errors.New("headers are not linked")
+				}
+			}
+			headers = append(headers, h)
+		}
+		peers = resp.Peers
+		if len(resp.Headers) < maxHeaders || len(headers) >= maxSyncHeaders {
+			// the remaining headers are fetched by the next sync, after these blocks are applied
+			return headers, peers, nil
+		}
+		locator = []string{headers[len(headers)-1].Hash}
+	}
+}
+
+func fetchBlocks(peer Node, headers []BlockHeader) ([]Block, error) {
+	// Downloads the blocks of the given headers, checks that every block matches its header.
+	var blocks []Block
+	for start := 0; start < len(headers); start += maxBlocks {
+		end := start + maxBlocks
+		if end > len(headers) {
+			end = len(headers)
+		}
+
+		var request BlocksRequest
+		for _, h := range headers[start:end] {
+			request.Hashes = append(request.Hashes, h.Hash)
+		}
+
+		var batch []Block
+		if err := postJson(peer, "blocks", request, &batch); err != nil {
+			return nil, err
+		}
+		if len(batch) != end-start {
+			return nil, fmt.Errorf("requested %v blocks, received %v", end-start, len(batch))
+		}
+		for i, block := range batch {
+			if calculateHash(block) != request.Hashes[i] || !validBody(block) {
+				return nil, errors.New("block does not match its header")
+			}
+		}
+		blocks = append(blocks, batch...)
+	}
+	return blocks, nil
+}
+
+func (bc *Blockchain) syncFrom(peer Node, initialize bool) {
+	/*
+		Header-first sync with the peer, switches to the peer's chain if it has more cumulative work.
+		On initialization the peer's chain is adopted even if it doesn't share the genesis block.
+		The mutex is not held while waiting for the peer.
+	*/
+	bc.mutex.Lock()
+	locator := bc.locator()
+	bc.mutex.Unlock()
+
+	headers, peers, err := fetchHeaders(peer, locator)
+	if err != nil {
+		fmt.Println("[ERR] Header sync with peer", peer, "failed:", err)
+		return
+	}
+
+	bc.mutex.Lock()
+	for _, p := range peers {
+		bc.addPeer(p)
+	}
+	if len(headers) == 0 {
+		bc.mutex.Unlock()
+		return
+	}
+
+	fork := bc.heightOf(headers[0].PreviousBlockHash) // last common block, -1 if the peer sent its whole chain
+	if headers[0].Height != fork+1 || (fork < 0 && !initialize) {
+		// unknown parent or different genesis block (different network)
+		bc.mutex.Unlock()
+		return
+	}
+
+	claimed := headersWork(headers)
+	claimed.Add(claimed, chainWork(bc.Chain[:fork+1]))
+	if claimed.Cmp(chainWork(bc.Chain)) <= 0 && !(initialize && fork < 0) {
+		bc.mutex.Unlock()
+		return
+	}
+	bc.mutex.Unlock()
+
+	blocks, err := fetchBlocks(peer, headers)
+	if err != nil {
+		fmt.Println("[ERR] Block download from peer", peer, "failed:", err)
+		return
+	}
+
+	bc.mutex.Lock()
+	if fork >= len(bc.blockHashes) || (fork >= 0 && bc.blockHashes[fork] != headers[0].PreviousBlockHash) {
+		// own chain changed in the meantime
+		bc.mutex.Unlock()
+		return
+	}
+
+	candidate := append(append([]Block{}, bc.Chain[:fork+1]...), blocks...)
+	if !bc.validChain(candidate) {
+		fmt.Println("[ERR] Chain of peer", peer, "is not valid")
+		bc.mutex.Unlock()
+		return
+	}
+	if chainWork(candidate).Cmp(chainWork(bc.Chain)) <= 0 && !(initialize && fork < 0) {
+		bc.mutex.Unlock()
+		return
+	}
+
+	orphaned := bc.Reorganize(candidate)
+	if len(orphaned) > 0 {
+		fmt.Println("[INFO] chain reorganized,", len(orphaned), "orphaned transactions returned to pending transactions")
+	}
+	bc.returnPending(orphaned)
+	tip := bc.header(len(bc.Chain) - 1)
+	bc.mutex.Unlock()
+
+	bc.announce(tip)
+}
+
+func (bc *Blockchain) receiveBlock(block Block, from Node) {
+	// Appends a block extending the chain tip, other blocks are resolved by syncing with the node that announced it.
+	hash := calculateHash(block)
+
+	bc.mutex.Lock()
+	if bc.heightOf(hash) >= 0 {
+		bc.mutex.Unlock()
+		return
+	}
+
+	if block.PreviousBlockHash != bc.blockHashes[len(bc.blockHashes)-1] {
+		bc.mutex.Unlock()
+		bc.syncFrom(from, false)
+		return
+	}
+
+	if !bc.validNextBlock(bc.Chain, bc.included, block) {
+		fmt.Println("[ERR] Block", hash, "announced by", from, "is not valid")
+		bc.mutex.Unlock()
+		return
+	}
+
+	bc.appendBlock(block)
+	tip := bc.header(len(bc.Chain) - 1)
+	bc.mutex.Unlock()
+
+	bc.announce(tip)
+}
+
+func (bc *Blockchain) announce(h BlockHeader) {
+	inv := Inventory{Node: bc.Self, Hash: h.Hash, Height: h.Height}
+
+	bc.mutex.Lock()
+	peers := append([]Node{}, bc.Peers...)
+	bc.mutex.Unlock()
+
+	for _, peer := range peers {
+		go func(peer Node) {
+			if err := postJson(peer, "inv", inv, nil); err != nil {
+				fmt.Println("[ERR] Block announcement to", peer, "failed:", err)
+			}
+		}(peer)
+	}
+}
+
+func (bc *Blockchain) HttpInventory(w http.ResponseWriter, r *http.Request) {
+	// POST /inv - a peer announces a new block, it is requested if unknown.
+	w.Header().Set("Content-Type", "application/json")
+
+	var inv Inventory
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		http.Error(w, `{"detail": "failed to parse request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	isPeer := func() bool {
+		bc.mutex.Lock()
+		defer bc.mutex.Unlock()
+		return Exists(bc.Peers, inv.Node)
+	}
+	// blocks are only fetched from peers, never from an arbitrary node named in the request
+	if !isPeer() && (bc.RefreshPeers() != nil || !isPeer()) {
+		http.Error(w, `{"detail": "announcing node is not a known peer"}`, http.StatusForbidden)
+		return
+	}
+
+	bc.mutex.Lock()
+	known := bc.heightOf(inv.Hash) >= 0
+	bc.mutex.Unlock()
+
+	if !known {
+		go func() {
+			var blocks []Block
+			if err := postJson(inv.Node, "blocks", BlocksRequest{Hashes: []string{inv.Hash}}, &blocks); err != nil || len(blocks) != 1 {
+				fmt.Println("[ERR] Block", inv.Hash, "could not be fetched from", inv.Node)
+				return
+			}
+			bc.receiveBlock(blocks[0], inv.Node)
+		}()
+	}
+
+	fmt.Fprint(w, `{"detail": "ok"}`)
+}
+
+func (bc *Blockchain) HttpHeaders(w http.ResponseWriter, r *http.Request) {
+	// POST /headers - headers of the blocks after the highest locator block known, from the genesis block if none is known.
+	w.Header().Set("Content-Type", "application/json")
+
+	var request HeadersRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"detail": "failed to parse request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	start := 0
+	for _, hash := range request.Locator {
+		if height := bc.heightOf(hash); height >= 0 {
+			start = height + 1
+			break
+		}
+	}
+
+	resp := HeadersResponse{Headers: []BlockHeader{}, Peers: bc.Peers}
+	for height := start; height < len(bc.Chain) && len(resp.Headers) < maxHeaders; height++ {
+		resp.Headers = append(resp.Headers, bc.header(height))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (bc *Blockchain) HttpBlocks(w http.ResponseWriter, r *http.Request) {
+	// POST /blocks - blocks with the given hashes, unknown hashes are skipped.
+	w.Header().Set("Content-Type", "application/json")
+
+	var request BlocksRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Hashes) > maxBlocks {
+		http.Error(w, `{"detail": "failed to parse request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	blocks := []Block{}
+	for _, hash := range request.Hashes {
+		if height := bc.heightOf(hash); height >= 0 {
+			blocks = append(blocks, bc.Chain[height])
+		}
+	}
+	json.NewEncoder(w).Encode(blocks)
+}
@@ -1,16 +1,23 @@
 package pow
 
-type Transaction struct {
-	/*
-		not storing issuer ID for privacy reasons (tokenId instead)
-		not storing amount because it is always a single vote
-	*/
-	TokenId string `json:"Token"`
-	ToId    string `json:"ToId"`
-}
+import "evoting/consensus"
+
+type Transaction = consensus.Transaction // see consensus/model.go
 
 func validateTransaction(ta Transaction) (valid bool, err string) {
+	/*
+		Returns possible errors as string for more verbose output/log.
+		Token reuse is checked against the chain and the mempool, see AddTransaction and validNextBlock.
+	*/
 	valid = true
 
+	if ta.TokenId == "" {
+		return false, "missing token"
+	}
+
+	if ta.ToId == "" {
+		return false, "missing voting party"
+	}
+
 	return
 }
@@ -0,0 +1,214 @@
+package raft
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"evoting/pbft"
+	"evoting/transport"
+)
+
+/*
+Raft.
+Crash fault tolerant alternative to PBFT for deployments that don't need Byzantine fault tolerance: a leader elected
+by a majority of the replicas orders the client requests, a request is committed once a majority stored it. Messaging
+is linear in the number of replicas instead of PBFT's quadratic prepare and commit phases.
+Clients, the connector and the replica API are the same as with PBFT. Backups forward client requests to the leader
+and every replica replies to the client once it applies the request.
+Members change one replica at a time (see membership.go).
+The term, the vote, the members, the log and the snapshot are persisted in the data directory (see storage.go), a restarted
+replica continues from its persisted state and is brought up to date by the leader.
+*/
+
+const (
+	follower  = "follower"
+	candidate = "candidate"
+	leader    = "leader"
+)
+
+type Blockchain struct {
+	pbft.Ledger            // chain, indexes and tally, see pbft/query.go
+	pbft.Membership        // peers (other replicas), see pbft/membership.go
+	Identifier      string `json:"node-id"`
+	DataDir         string `json:"-"` // persistent state of this replica, see storage.go
+	mutex           *sync.Mutex
+	signer          pbft.Signer
+
+	term            int           // current term
+	votedFor        string        // candidate voted for in the current term
+	role            string        // follower / candidate / leader
+	leader          string        // leader of the current term, empty if not known yet
+	lastContact     time.Time     // last message from the leader (or vote granted), the election timeout starts here
+	electionTimeout time.Duration // randomized, see election.go
+
+	log           []Entry         // entries after the snapshot, see log.go
+	snapshotIndex int             // last compacted entry
+	snapshotTerm  int             // term of the last compacted entry
+	commitIndex   int             // last entry stored by a majority
+	lastApplied   int             // identifier of the last executed or rejected block
+	nextIndex     map[string]int  // leader: next entry to send to each follower
+	matchIndex    map[string]int  // leader: last entry known to be stored by each follower
+	replicating   map[string]bool // leader: followers with a request in flight
+
+	members      []string // replicas that vote, see membership.go
+	membersIndex int      // configuration entry the members were taken from, 0 if initial
+	logFile      *os.File // log entries are appended here, see storage.go
+
+	requests        map[string]*requestEntry // client requests by client and request id
+	trackedRequests []trackedRequest         // requests in the order they were logged, see requests.go
+}
+
+func NewBlockchain(port int, keystore string, scheme string, dataDir string) (*Blockchain, error) {
+	/*
+		Creates a replica registered at the node discovery service.
+		If keystore is empty a throwaway key is generated and the hostname is used as the identifier.
+	*/
+	hostname := os.Getenv("HOSTNAME")
+	self := pbft.Node{Address: hostname, Port: port, Identifier: hostname, Type: "blockchain"}
+
+	var signer pbft.Signer
+	var err error
+	if keystore == "" {
+		// generate a throwaway signing key
+		signer, err = pbft.GenerateSigningKey(scheme)
+	} else {
+		signer, err = pbft.LoadOrCreateKeystore(keystore, pbft.KeystorePassword(), scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	self.PublicKey = signer.Public()
+	if keystore != "" {
+		self.Identifier = pbft.NodeIdFromKey(self.PublicKey)
+	}
+
+	if err := pbft.CheckTLSIdentity(self); err != nil {
+		return nil, err
+	}
+
+	return newBlockchain(self, signer, nil, dataDir)
+}
+
+func NewStaticBlockchain(cluster *pbft.ClusterConfig, identifier string, keystore string, dataDir string) (*Blockchain, error) {
+	// Creates a replica described by the static cluster config.
+	signer, err := pbft.LoadKeystore(keystore, pbft.KeystorePassword())
+	if err != nil {
+		return nil, err
+	}
+
+	if identifier == "" {
+		identifier = pbft.NodeIdFromKey(signer.Public())
+	}
+
+	self, err := cluster.NodeById(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.Type != "blockchain" {
+		return nil, fmt.Errorf("node %v is not a blockchain node", identifier)
+	}
+
+	if signer.Public() != self.PublicKey {
+		return nil, fmt.Errorf("private key does not match the public key of node %v", identifier)
+	}
+
+	if err := pbft.CheckTLSIdentity(self); err != nil {
+		return nil, err
+	}
+
+	return newBlockchain(self, signer, cluster, dataDir)
+}
+
+func newBlockchain(self pbft.Node, signer pbft.Signer, cluster *pbft.ClusterConfig, dataDir string) (*Blockchain, error) {
+	var bc Blockchain
+	bc.DataDir = filepath.Join(dataDir, self.Identifier) // replicas started in the same directory don't share the state
+	bc.Identifier = self.Identifier
+	bc.signer = signer
+	bc.mutex = &sync.Mutex{}
+	bc.Ledger = pbft.NewLedger(bc.mutex, self.Identifier, signer)
+	bc.Membership = pbft.NewMembership(self, cluster, os.Getenv("DISCOVERY_ADDR"), bc.mutex)
+	bc.role = follower
+	bc.lastContact, bc.electionTimeout = time.Now(), randomTimeout()
+	bc.nextIndex = make(map[string]int)
+	bc.matchIndex = make(map[string]int)
+	bc.replicating = make(map[string]bool)
+	bc.requests = make(map[string]*requestEntry)
+
+	bc.RegisterNode()
+	bc.RefreshPeers()
+
+	// the log starts with the same genesis block on every replica, the chain is replicated by the leader
+	bc.Chain = []pbft.Block{{Identifier: 0, Timestamp: 0, Transactions: []pbft.Transaction{}, PreviousBlockHash: ""}}
+	bc.Reindex()
+
+	if err := bc.restore(); err != nil {
+		return nil, fmt.Errorf("failed to restore the persisted state: %v", err.Error())
+	}
+	bc.bootstrapMembers()
+
+	go bc.run()
+	return &bc, nil
+}
+
+func (bc *Blockchain) sign(message interface{}) string {
+	// Signature over the JSON encoded message, verifiable with pbft.VerifyMessage.
+	payload, _ := json.Marshal(message)
+	signed, _ := bc.signer.Sign(payload)
+	return hex.EncodeToString(signed)
+}
+
+func post(peer pbft.Node, endpoint string, message interface{}, response interface{}) error {
+	// Sends a protocol message to another replica and decodes its response.
+	body, _ := json.Marshal(message)
+	resp, err := transport.Post(peer.String(), endpoint, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code %v", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func (bc *Blockchain) HttpGetChain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	json.NewEncoder(w).Encode(bc)
+}
+
+func (bc *Blockchain) HttpGetPeers(w http.ResponseWriter, r *http.Request) {
+	// Debug endpoint
+	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	json.NewEncoder(w).Encode(bc.Peers)
+}
+
+func (bc *Blockchain) HttpGetState(w http.ResponseWriter, r *http.Request) {
+	// Debug endpoint - Raft state of the replica.
+	w.Header().Set("Content-Type", "application/json")
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	json.NewEncoder(w).Encode(struct {
+		Term          int      `json:"term"`
+		Role          string   `json:"role"`
+		Leader        string   `json:"leader"`
+		SnapshotIndex int      `json:"snapshot-index"`
+		LastIndex     int      `json:"last-index"`
+		CommitIndex   int      `json:"commit-index"`
+		LastApplied   int      `json:"last-applied"`
+		Members       []string `json:"members"`
+	}{bc.term, bc.role, bc.leader, bc.snapshotIndex, bc.lastIndex(), bc.commitIndex, bc.lastApplied, bc.members})
+}
@@ -0,0 +1,177 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"evoting/pbft"
+)
+
+/*
+Leader election.
+A follower that hasn't heard from a leader within the election timeout becomes a candidate: it starts a new term and
+asks the other members for their votes. Replicas vote for at most one candidate per term, and only for candidates
+whose log is at least as up to date as their own. A candidate with the votes of a majority of the members becomes the leader.
+Timeouts are randomized so that candidates rarely split the vote.
+*/
+
+const (
+	heartbeatInterval    = 500 * time.Millisecond
+	minElectionTimeout   = 2 * time.Second // election timeouts are random between the minimum and twice the minimum
+	peersRefreshInterval = 10 * time.Second
+)
+
+type VoteRequest struct {
+	Term         int    `json:"term"`
+	CandidateId  string `json:"candidate-id"`
+	LastLogIndex int    `json:"last-log-index"`
+	LastLogTerm  int    `json:"last-log-term"`
+}
+
+type VoteResponse struct {
+	Term    int  `json:"term"`
+	Granted bool `json:"vote-granted"`
+}
+
+func randomTimeout() time.Duration {
+	return minElectionTimeout + time.Duration(rand.Int63n(int64(minElectionTimeout)))
+}
+
+func (bc *Blockchain) run() {
+	// Sends heartbeats while the replica is the leader, starts an election once the leader stops sending them.
+	ticker := time.NewTicker(heartbeatInterval / 5)
+	defer ticker.Stop()
+
+	var lastHeartbeat time.Time
+	lastRefresh := time.Now()
+
+	for now := range ticker.C {
+		if now.Sub(lastRefresh) >= peersRefreshInterval {
+			// replicas may join through node discovery
+			bc.RefreshPeers()
+			lastRefresh = now
+		}
+
+		bc.mutex.Lock()
+		role := bc.role
+		timedOut := now.Sub(bc.lastContact) >= bc.electionTimeout
+		member := bc.isMember(bc.Self.Identifier) // learners don't start elections
+		bc.mutex.Unlock()
+
+		if role == leader && now.Sub(lastHeartbeat) >= heartbeatInterval {
+			lastHeartbeat = now
+			bc.mutex.Lock()
+			if bc.role == leader {
+				bc.reconfigure()
+			}
+			bc.mutex.Unlock()
+			bc.replicate()
+		} else if role != leader && timedOut && member {
+			bc.startElection()
+		}
+	}
+}
+
+func (bc *Blockchain) stepDown(term int) {
+	// Becomes a follower, a newer term resets the vote. Called with the mutex held.
+	if term > bc.term {
+		bc.term, bc.votedFor, bc.leader = term, "", ""
+		bc.saveState()
+	}
+	if bc.role != follower {
+		fmt.Println("[RAFT] stepping down, term", bc.term)
+	}
+	bc.role = follower
+}
+
+func (bc *Blockchain) startElection() {
+	bc.mutex.Lock()
+	bc.term++
+	bc.role, bc.votedFor, bc.leader = candidate, bc.Self.Identifier, ""
+	bc.lastContact, bc.electionTimeout = time.Now(), randomTimeout()
+	bc.saveState()
+
+	request := VoteRequest{Term: bc.term, CandidateId: bc.Self.Identifier, LastLogIndex: bc.lastIndex(), LastLogTerm: bc.termAt(bc.lastIndex())}
+	peers := bc.voters()
+	fmt.Println("[RAFT] starting election, term", request.Term)
+	votes := 1 // own vote
+	if votes >= bc.majority() {
+		bc.becomeLeader()
+	}
+	bc.mutex.Unlock()
+
+	for _, peer := range peers {
+		go func(peer pbft.Node) {
+			var response VoteResponse
+			if err := post(peer, "request-vote", request, &response); err != nil {
+				return
+			}
+
+			bc.mutex.Lock()
+			defer bc.mutex.Unlock()
+
+			if response.Term > bc.term {
+				bc.stepDown(response.Term)
+				return
+			}
+			if !response.Granted || bc.role != candidate || bc.term != request.Term {
+				return
+			}
+
+			votes++
+			if votes >= bc.majority() {
+				bc.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+func (bc *Blockchain) becomeLeader() {
+	// Called with the mutex held.
+	bc.role, bc.leader = leader, bc.Self.Identifier
+	bc.nextIndex = make(map[string]int)
+	bc.matchIndex = make(map[string]int)
+	fmt.Println("[RAFT] elected leader, term", bc.term)
+
+	// entries of previous terms are committed together with an entry of the current term
+	bc.appendEntry(Entry{Noop: true})
+	bc.advanceCommit()
+	go bc.replicate()
+}
+
+func (bc *Blockchain) HttpRequestVote(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := bc.VerifyReplica(r); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	var request VoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if request.Term > bc.term {
+		bc.stepDown(request.Term)
+	}
+
+	lastIndex := bc.lastIndex()
+	lastTerm := bc.termAt(lastIndex)
+	upToDate := request.LastLogTerm > lastTerm || (request.LastLogTerm == lastTerm && request.LastLogIndex >= lastIndex)
+
+	granted := request.Term == bc.term && upToDate && (bc.votedFor == "" || bc.votedFor == request.CandidateId)
+	if granted {
+		bc.votedFor, bc.lastContact = request.CandidateId, time.Now()
+		bc.saveState()
+	}
+
+	json.NewEncoder(w).Encode(VoteResponse{Term: bc.term, Granted: granted})
+}
@@ -0,0 +1,19 @@
+package raft
+
+import "github.com/gorilla/mux"
+
+func (bc *Blockchain) Routes(r *mux.Router) {
+	// Engine specific endpoints, the shared API is registered by consensus.HandleApi (see main.go).
+	r.HandleFunc("/request-vote", bc.HttpRequestVote).Methods("POST")
+	r.HandleFunc("/append-entries", bc.HttpAppendEntries).Methods("POST")
+	r.HandleFunc("/install-snapshot", bc.HttpInstallSnapshot).Methods("POST")
+	r.HandleFunc("/chain", bc.HttpGetChain).Methods("GET")
+	r.HandleFunc("/certify/{height:[0-9]+}", bc.HttpCertify).Methods("GET")
+	r.HandleFunc("/request", bc.HttpRequest).Methods("POST")
+	r.HandleFunc("/state", bc.HttpGetState).Methods("GET")
+	r.HandleFunc("/peers", bc.HttpGetPeers).Methods("GET")
+}
+
+func (bc *Blockchain) Port() int {
+	return bc.Self.Port
+}
@@ -0,0 +1,123 @@
+package raft
+
+import (
+	"fmt"
+
+	"evoting/pbft"
+)
+
+/*
+Replicated log.
+Every client request is a log entry, the index of the entry is the identifier of its block. Entries are applied in
+order once they are committed (stored by a majority of the replicas): valid blocks are appended to the chain, blocks
+with invalid transactions are rejected and their identifier is skipped - the same way PBFT skips rejected sequence
+numbers. The chain is the state machine, so log compaction just drops applied entries and the chain (together with
+the request log) serves as the snapshot sent to followers that fall behind and persisted for restarts.
+*/
+
+const (
+	maxLogEntries    = 1000 // applied entries kept in the log before it is compacted
+	maxAppendEntries = 100  // entries sent in a single append-entries request
+)
+
+type Entry struct {
+	Term      int        `json:"term"`
+	Index     int        `json:"index"`
+	Block     pbft.Block `json:"block"`
+	Client    pbft.Node  `json:"client"`
+	RequestId string     `json:"request-id"`
+	Noop      bool       `json:"noop,omitempty"`    // appended by a new leader to commit the entries of previous terms
+	Members   []string   `json:"members,omitempty"` // configuration entry - the members once it is committed, see membership.go
+}
+
+type Snapshot struct {
+	LastIndex int                        `json:"last-index"` // last entry applied to the chain
+	LastTerm  int                        `json:"last-term"`
+	Chain     []pbft.Block               `json:"chain"`
+	Requests  map[string]pbft.VotingInfo `json:"requests"` // client requests -> their block, so they aren't appended again
+
+	Members      []string `json:"members"` // members after the last applied configuration entry
+	MembersIndex int      `json:"members-index"`
+}
+
+func (bc *Blockchain) lastIndex() int {
+	return bc.snapshotIndex + len(bc.log)
+}
+
+func (bc *Blockchain) termAt(index int) int {
+	// Term of the entry at the given index, -1 if the entry was compacted or hasn't been received yet.
+	if index == bc.snapshotIndex {
+		return bc.snapshotTerm
+	}
+	if index < bc.snapshotIndex || index > bc.lastIndex() {
+		return -1
+	}
+	return bc.log[index-bc.snapshotIndex-1].Term
+}
+
+func (bc *Blockchain) entry(index int) Entry {
+	return bc.log[index-bc.snapshotIndex-1]
+}
+
+func (bc *Blockchain) entriesFrom(index int) []Entry {
+	entries := bc.log[index-bc.snapshotIndex-1:]
+	if len(entries) > maxAppendEntries {
+		entries = entries[:maxAppendEntries]
+	}
+	return append([]Entry{}, entries...)
+}
+
+func (bc *Blockchain) appendEntry(entry Entry) Entry {
+	// Appends a new entry of the current term, used by the leader. Called with the mutex held.
+	entry.Term, entry.Index = bc.term, bc.lastIndex()+1
+	entry.Block.Identifier = entry.Index
+	bc.log = append(bc.log, entry)
+	bc.logRequest(entry)
+	bc.appendLog([]Entry{entry})
+	return entry
+}
+
+func (bc *Blockchain) truncate(index int) {
+	// Removes conflicting entries starting at the given index, followers only. Called with the mutex held.
+	for _, entry := range bc.log[index-bc.snapshotIndex-1:] {
+		key := pbft.RequestKey(entry.Client.Identifier, entry.RequestId)
+		if known, exists := bc.requests[key]; exists && known.Info.VotingData.BlockId == entry.Index {
+			delete(bc.requests, key)
+		}
+	}
+	bc.log = bc.log[:index-bc.snapshotIndex-1]
+}
+
+func (bc *Blockchain) compact() {
+	// Drops applied entries once there are too many of them. Called with the mutex held.
+	if bc.lastApplied-bc.snapshotIndex <= maxLogEntries {
+		return
+	}
+
+	bc.snapshotTerm = bc.termAt(bc.lastApplied)
+	bc.log = append([]Entry{}, bc.log[bc.lastApplied-bc.snapshotIndex:]...)
+	bc.snapshotIndex = bc.lastApplied
+	bc.saveSnapshot()
+	bc.saveLog()
+	fmt.Println("[RAFT] log compacted up to entry", bc.snapshotIndex)
+}
+
+func (bc *Blockchain) snapshot() Snapshot {
+	// State of the replica after the last applied entry. Called with the mutex held.
+	requests := make(map[string]pbft.VotingInfo)
+	for key, known := range bc.requests {
+		if known.Info.VotingData.BlockId <= bc.lastApplied {
+			requests[key] = known.Info
+		}
+	}
+
+	return Snapshot{
+		LastIndex: bc.lastApplied,
+		LastTerm:  bc.termAt(bc.lastApplied),
+		Chain:     append([]pbft.Block{}, bc.Chain...),
+		Requests:  requests,
+
+		Members:      bc.members,
+		MembersIndex: bc.membersIndex,
+	}
+}
@@ -0,0 +1,128 @@
+package raft
+
+import (
+	"fmt"
+	"sort"
+
+	"evoting/pbft"
+)
+
+/*
+Cluster membership.
+The members are the replicas that vote and whose stored entries count towards a majority, other registered replicas
+receive the log as learners until they become members. Members change through configuration entries in the log: the
+leader adds or removes a single replica at a time and only once the previous configuration entry was applied, and
+every replica switches to the new members only once the entry is committed. Any majority of the old members and any
+majority of the new members therefore overlap, so two leaders can't be elected in the same term.
+The initial members are the blockchain nodes of a static cluster. With node discovery the first replica registered
+is the only initial member, replicas that find other replicas registered on their first start begin as learners and
+are added by the leader.
+*/
+
+func (bc *Blockchain) bootstrapMembers() {
+	// Initial members of a replica started for the first time. Called with the mutex held.
+	if bc.members != nil {
+		return
+	}
+
+	if bc.Cluster != nil {
+		for _, node := range bc.Cluster.BlockchainNodes() {
+			bc.members = append(bc.members, node.Identifier)
+		}
+	} else if len(bc.Peers) == 0 {
+		bc.members = []string{bc.Self.Identifier}
+	} else {
+		// the members are replicated by the leader
+		bc.members = []string{}
+	}
+	sort.Strings(bc.members)
+	bc.saveState()
+}
+
+func (bc *Blockchain) isMember(id string) bool {
+	for _, member := range bc.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (bc *Blockchain) voters() []pbft.Node {
+	// Peers that are members. Called with the mutex held.
+	var voters []pbft.Node
+	for _, peer := range bc.Peers {
+		if bc.isMember(peer.Identifier) {
+			voters = append(voters, peer)
+		}
+	}
+	return voters
+}
+
+func (bc *Blockchain) majority() int {
+	return len(bc.members)/2 + 1
+}
+
+func (bc *Blockchain) applyMembers(entry Entry) {
+	// Switches to the members of a committed configuration entry. Called with the mutex held.
+	if entry.Index <= bc.membersIndex {
+		// already applied before a restart
+		return
+	}
+
+	bc.members, bc.membersIndex = entry.Members, entry.Index
+	bc.saveState()
+	fmt.Println("[RAFT] members changed:", bc.members)
+
+	if bc.role == leader && !bc.isMember(bc.Self.Identifier) {
+		// a removed leader hands over once the change is committed
+		bc.stepDown(bc.term)
+	}
+}
+
+func (bc *Blockchain) reconfigure() {
+	/*
+		Adds a registered replica that isn't a member yet, or removes a member that is no longer registered - a single
+		replica per configuration entry.
+		Called with the mutex held by the leader.
+	*/
+	for index := bc.lastApplied + 1; index <= bc.lastIndex(); index++ {
+		if len(bc.entry(index).Members) > 0 {
+			// the previous change hasn't been applied yet
+			return
+		}
+	}
+
+	members := append([]string{}, bc.members...)
+	registered := map[string]bool{bc.Self.Identifier: true}
+	for _, peer := range bc.Peers {
+		registered[peer.Identifier] = true
+	}
+
+	for _, peer := range bc.Peers {
+		// a learner is added once it caught up, so the new majority doesn't have to wait for it
+		if !bc.isMember(peer.Identifier) && bc.matchIndex[peer.Identifier] >= bc.commitIndex {
+			members = append(members, peer.Identifier)
+			break
+		}
+	}
+
+	if len(members) == len(bc.members) {
+		for i, member := range members {
+			if !registered[member] {
+				members = append(members[:i], members[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if len(members) == len(bc.members) {
+		return
+	}
+
+	sort.Strings(members)
+	entry := bc.appendEntry(Entry{Members: members})
+	fmt.Println("[RAFT] changing members to", members, "entry:", entry.Index)
+	bc.advanceCommit()
+	go bc.replicate()
+}
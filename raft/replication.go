@@ -0,0 +1,327 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"evoting/pbft"
+)
+
+/*
+Log replication.
+The leader sends new entries to every follower together with the index and term of the preceding entry, a follower
+accepts them only if its log contains that entry - otherwise the leader backs up and retries. Followers that are
+behind the compacted part of the leader's log receive a snapshot instead. The same message, possibly without entries,
+serves as the leader's heartbeat.
+*/
+
+type AppendRequest struct {
+	Term         int     `json:"term"`
+	LeaderId     string  `json:"leader-id"`
+	PrevLogIndex int     `json:"prev-log-index"`
+	PrevLogTerm  int     `json:"prev-log-term"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit int     `json:"leader-commit"`
+}
+
+type AppendResponse struct {
+	Term      int  `json:"term"`
+	Success   bool `json:"success"`
+	LastIndex int  `json:"last-index"` // last entry of the follower's log, lets the leader back up quickly
+}
+
+type SnapshotRequest struct {
+	Term     int      `json:"term"`
+	LeaderId string   `json:"leader-id"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+func (bc *Blockchain) replicate() {
+	// Sends new entries (or a heartbeat) to all followers. Must not be called while holding the mutex.
+	bc.mutex.Lock()
+	peers := bc.Peers
+	bc.mutex.Unlock()
+
+	for _, peer := range peers {
+		go bc.replicateTo(peer)
+	}
+}
+
+func (bc *Blockchain) replicateTo(peer pbft.Node) {
+	id := peer.Identifier
+
+	bc.mutex.Lock()
+	if bc.role != leader || bc.replicating[id] {
+		// at most one request in flight per follower
+		bc.mutex.Unlock()
+		return
+	}
+
+	next, known := bc.nextIndex[id]
+	if !known {
+		next = bc.lastIndex() + 1
+		bc.nextIndex[id] = next
+	}
+
+	term := bc.term
+	bc.replicating[id] = true
+
+	if next <= bc.snapshotIndex {
+		request := SnapshotRequest{Term: term, LeaderId: bc.Self.Identifier, Snapshot: bc.snapshot()}
+		bc.mutex.Unlock()
+		bc.sendSnapshot(peer, request)
+		return
+	}
+
+	request := AppendRequest{
+		Term:         term,
+		LeaderId:     bc.Self.Identifier,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  bc.termAt(next - 1),
+		Entries:      bc.entriesFrom(next),
+		LeaderCommit: bc.commitIndex,
+	}
+	bc.mutex.Unlock()
+
+	var response AppendResponse
+	err := post(peer, "append-entries", request, &response)
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	delete(bc.replicating, id)
+
+	if err != nil {
+		// retried with the next heartbeat
+		return
+	}
+	if response.Term > bc.term {
+		bc.stepDown(response.Term)
+		return
+	}
+	if bc.role != leader || bc.term != term {
+		return
+	}
+
+	if response.Success {
+		match := request.PrevLogIndex + len(request.Entries)
+		if match > bc.matchIndex[id] {
+			bc.matchIndex[id] = match
+		}
+		bc.nextIndex[id] = match + 1
+		bc.advanceCommit()
+
+		if match < bc.lastIndex() {
+			go bc.replicateTo(peer)
+		}
+		return
+	}
+
+	// the follower's log doesn't contain the preceding entry - back up
+	next = request.PrevLogIndex
+	if response.LastIndex+1 < next {
+		next = response.LastIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	bc.nextIndex[id] = next
+	go bc.replicateTo(peer)
+}
+
+func (bc *Blockchain) sendSnapshot(peer pbft.Node, request SnapshotRequest) {
+	id := peer.Identifier
+	fmt.Println("[RAFT] sending snapshot up to entry", request.Snapshot.LastIndex, "to", id)
+
+	var response AppendResponse
+	err := post(peer, "install-snapshot", request, &response)
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	delete(bc.replicating, id)
+
+	if err != nil {
+		return
+	}
+	if response.Term > bc.term {
+		bc.stepDown(response.Term)
+		return
+	}
+	if bc.role != leader || bc.term != request.Term || !response.Success {
+		return
+	}
+
+	bc.matchIndex[id] = request.Snapshot.LastIndex
+	bc.nextIndex[id] = request.Snapshot.LastIndex + 1
+	go bc.replicateTo(peer)
+}
+
+func (bc *Blockchain) advanceCommit() {
+	/*
+		Commits the entries stored by a majority of the members. Only entries of the current term are committed
+		by counting replicas, preceding entries are committed together with them.
+		Called with the mutex held.
+	*/
+	for index := bc.lastIndex(); index > bc.commitIndex; index-- {
+		if bc.termAt(index) != bc.term {
+			break
+		}
+
+		stored := 0
+		if bc.isMember(bc.Self.Identifier) {
+			stored++ // the leader itself, unless it is being removed
+		}
+		for _, peer := range bc.voters() {
+			if bc.matchIndex[peer.Identifier] >= index {
+				stored++
+			}
+		}
+
+		if stored >= bc.majority() {
+			bc.commitIndex = index
+			break
+		}
+	}
+	bc.apply()
+}
+
+func (bc *Blockchain) acceptLeader(term int, leaderId string) bool {
+	// Returns false if the message comes from the leader of an older term. Called with the mutex held.
+	if term < bc.term {
+		return false
+	}
+	if term > bc.term || bc.role != follower {
+		bc.stepDown(term)
+	}
+	bc.leader, bc.lastContact = leaderId, time.Now()
+	return true
+}
+
+func (bc *Blockchain) HttpAppendEntries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := bc.VerifyReplica(r); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	var request AppendRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if !bc.acceptLeader(request.Term, request.LeaderId) {
+		json.NewEncoder(w).Encode(AppendResponse{Term: bc.term, LastIndex: bc.lastIndex()})
+		return
+	}
+
+	entries := request.Entries
+	prevIndex, prevTerm := request.PrevLogIndex, request.PrevLogTerm
+	if prevIndex < bc.snapshotIndex {
+		// compacted entries are committed, so they match the leader's
+		skip := bc.snapshotIndex - prevIndex
+		if skip > len(entries) {
+			skip = len(entries)
+		}
+		entries = entries[skip:]
+		prevIndex, prevTerm = bc.snapshotIndex, bc.snapshotTerm
+	}
+
+	if bc.termAt(prevIndex) != prevTerm {
+		lastIndex := bc.lastIndex()
+		if prevIndex-1 < lastIndex {
+			lastIndex = prevIndex - 1
+		}
+		json.NewEncoder(w).Encode(AppendResponse{Term: bc.term, LastIndex: lastIndex})
+		return
+	}
+
+	for i, entry := range entries {
+		truncated := false
+		if entry.Index <= bc.lastIndex() {
+			if bc.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			// conflicting entry (appended by a leader that failed) - the leader's log wins
+			bc.truncate(entry.Index)
+			truncated = true
+		}
+		for _, e := range entries[i:] {
+			bc.log = append(bc.log, e)
+			bc.logRequest(e)
+		}
+		// stored before the leader counts this replica
+		if truncated {
+			bc.saveLog()
+		} else {
+			bc.appendLog(entries[i:])
+		}
+		break
+	}
+
+	if last := prevIndex + len(entries); request.LeaderCommit > bc.commitIndex && last > bc.commitIndex {
+		bc.commitIndex = request.LeaderCommit
+		if last < bc.commitIndex {
+			bc.commitIndex = last
+		}
+		bc.apply()
+	}
+
+	json.NewEncoder(w).Encode(AppendResponse{Term: bc.term, Success: true, LastIndex: bc.lastIndex()})
+}
+
+func (bc *Blockchain) HttpInstallSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := bc.VerifyReplica(r); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusForbidden)
+		return
+	}
+
+	var request SnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, pbft.JsonBodyPadding("incorrect request body"), http.StatusBadRequest)
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if !bc.acceptLeader(request.Term, request.LeaderId) {
+		json.NewEncoder(w).Encode(AppendResponse{Term: bc.term, LastIndex: bc.lastIndex()})
+		return
+	}
+
+	snapshot := request.Snapshot
+	if snapshot.LastIndex > bc.commitIndex && len(snapshot.Chain) > 0 {
+		if bc.termAt(snapshot.LastIndex) == snapshot.LastTerm {
+			// entries following the snapshot are kept
+			bc.log = append([]Entry{}, bc.log[snapshot.LastIndex-bc.snapshotIndex:]...)
+		} else {
+			bc.log = nil
+		}
+		bc.snapshotIndex, bc.snapshotTerm = snapshot.LastIndex, snapshot.LastTerm
+		bc.commitIndex, bc.lastApplied = snapshot.LastIndex, snapshot.LastIndex
+
+		bc.Chain = snapshot.Chain
+		bc.restoreRequests(snapshot.Requests)
+		for _, entry := range bc.log {
+			bc.logRequest(entry)
+		}
+		if snapshot.MembersIndex >= bc.membersIndex && len(snapshot.Members) > 0 {
+			bc.members, bc.membersIndex = snapshot.Members, snapshot.MembersIndex
+			bc.saveState()
+		}
+		bc.Reindex()
+		bc.saveSnapshot()
+		bc.saveLog()
+		fmt.Println("[RAFT] installed snapshot up to entry", snapshot.LastIndex)
+	}
+
+	json.NewEncoder(w).Encode(AppendResponse{Term: bc.term, Success: true, LastIndex: bc.lastIndex()})
+}
@@ -0,0 +1,241 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"evoting/consensus"
+	"evoting/pbft"
+)
+
+/*
+Client requests.
+Clients talk to Raft replicas the same way as to PBFT replicas: a request is answered with the block it was assigned
+to (pbft.VotingInfo) and every replica sends a signed reply to the client once the block is executed or rejected.
+Requests are identified by the client and the request id, so a retransmitted request is never appended again.
+Applied requests are remembered for an hour (the same as the results kept by clients, see pbft/client.go), so the
+request log and the snapshots don't grow without bound.
+*/
+
+const (
+	requestRetention   time.Duration = time.Hour // applied requests are forgotten this long after their block was created
+	maxTrackedRequests int           = 10000     // ... or earlier, oldest first, once more requests are remembered
+)
+
+type requestEntry struct {
+	Info  pbft.VotingInfo // block the request was assigned to
+	Reply pbft.Reply      // reply sent once the entry is applied, empty until then
+}
+
+type trackedRequest struct {
+	key     string
+	blockId int
+}
+
+func (bc *Blockchain) knownRequest(clientId string, requestId string) (*requestEntry, bool) {
+	// Requests without an id (older clients) are never deduplicated.
+	// Called with the mutex held.
+	if requestId == "" {
+		return nil, false
+	}
+	entry, exists := bc.requests[pbft.RequestKey(clientId, requestId)]
+	return entry, exists
+}
+
+func (bc *Blockchain) logRequest(entry Entry) {
+	// Called with the mutex held whenever an entry is added to the log.
+	if entry.Noop || entry.RequestId == "" {
+		return
+	}
+
+	key := pbft.RequestKey(entry.Client.Identifier, entry.RequestId)
+	if _, exists := bc.requests[key]; exists {
+		return
+	}
+
+	bc.requests[key] = &requestEntry{Info: bc.votingInfo(entry)}
+	bc.trackedRequests = append(bc.trackedRequests, trackedRequest{key: key, blockId: entry.Index})
+}
+
+func (bc *Blockchain) restoreRequests(requests map[string]pbft.VotingInfo) {
+	// Replaces the request log with the requests of a snapshot. Called with the mutex held.
+	bc.requests = make(map[string]*requestEntry)
+	bc.trackedRequests = nil
+	for key, info := range requests {
+		bc.requests[key] = &requestEntry{Info: info}
+		bc.trackedRequests = append(bc.trackedRequests, trackedRequest{key: key, blockId: info.VotingData.BlockId})
+	}
+	sort.Slice(bc.trackedRequests, func(i, j int) bool {
+		return bc.trackedRequests[i].blockId < bc.trackedRequests[j].blockId
+	})
+}
+
+func (bc *Blockchain) pruneRequests() {
+	/*
+		Forgets the oldest applied requests once there are too many of them or they are too old. Requests whose
+		entry hasn't been applied yet are kept, the log bounds them.
+		Called with the mutex held.
+	*/
+	for len(bc.trackedRequests) > 0 {
+		oldest := bc.trackedRequests[0]
+		known, exists := bc.requests[oldest.key]
+		if exists && known.Info.VotingData.BlockId == oldest.blockId {
+			age := time.Since(time.Unix(int64(known.Info.BlockData.Timestamp), 0))
+			if oldest.blockId > bc.lastApplied || (len(bc.trackedRequests) <= maxTrackedRequests && age < requestRetention) {
+				return
+			}
+			delete(bc.requests, oldest.key)
+		}
+		// otherwise the entry was truncated from the log
+		bc.trackedRequests = bc.trackedRequests[1:]
+	}
+}
+
+func (bc *Blockchain) votingInfo(entry Entry) pbft.VotingInfo {
+	// Response to the client's request, the client only needs the block id and the request id.
+	digest := pbft.CalculateHash(entry.Block)
+	voting := pbft.Voting{BlockId: entry.Index, Digest: digest, YesVotes: []pbft.VoteRequest{}, NoVotes: []pbft.VoteRequest{}, Client: entry.Client, RequestId: entry.RequestId}
+	info := pbft.VotingInfo{View: entry.Term, VotingData: voting, BlockData: entry.Block, Digest: digest, Sender: bc.leader}
+	info.Signature = bc.sign(info)
+	return info
+}
+
+func (bc *Blockchain) replyToClient(entry Entry, reply pbft.Reply) {
+	/*
+		Signs the reply, records it (so it can be sent again if the client retransmits the request)
+		and sends it to the client.
+		Called with the mutex held.
+	*/
+	if entry.Client.Identifier == "" {
+		return
+	}
+
+	reply.BlockId, reply.ReplicaId, reply.RequestIds = entry.Index, bc.Self.Identifier, []string{}
+	if entry.RequestId != "" {
+		reply.RequestIds = []string{entry.RequestId}
+	}
+	reply.Signature = bc.sign(reply)
+
+	if known, exists := bc.knownRequest(entry.Client.Identifier, entry.RequestId); exists && known.Info.VotingData.BlockId == entry.Index {
+		known.Reply = reply
+	}
+
+	go pbft.SendReply(entry.Client, reply)
+}
+
+func (bc *Blockchain) validateBlock(block pbft.Block) []pbft.RejectReason {
+	return pbft.ValidateTransactions(block.Transactions, bc.TokenUsed)
+}
+
+func (bc *Blockchain) apply() {
+	// Executes committed entries in order, the result is the same on every replica. Called with the mutex held.
+	for bc.lastApplied < bc.commitIndex {
+		bc.lastApplied++
+		entry := bc.entry(bc.lastApplied)
+		if len(entry.Members) > 0 {
+			bc.applyMembers(entry)
+			continue
+		}
+		if entry.Noop {
+			continue
+		}
+
+		block := entry.Block
+		block.PreviousBlockHash = pbft.CalculateHash(bc.LastBlock())
+
+		if reasons := bc.validateBlock(block); len(reasons) > 0 {
+			fmt.Println("[INFO] block", block.Identifier, "rejected, reasons:", reasons)
+			bc.replyToClient(entry, pbft.Reply{Result: "rejected", Reasons: reasons})
+			continue
+		}
+
+		bc.AppendBlock(block)
+		bc.replyToClient(entry, pbft.Reply{Result: "committed", BlockHash: pbft.CalculateHash(block)})
+	}
+
+	bc.pruneRequests()
+	bc.compact()
+}
+
+func (bc *Blockchain) HttpRequest(w http.ResponseWriter, r *http.Request) {
+	// The leader appends the client's request to its log, followers forward it to the leader.
+	w.Header().Set("Content-Type", "application/json")
+
+	var req pbft.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// either the client itself or a follower forwarding the request
+	if pbft.VerifyPeer(r, req.Client) != nil && bc.VerifyReplica(r) != nil {
+		http.Error(w, pbft.JsonBodyPadding("request must come from the client or a replica"), http.StatusForbidden)
+		return
+	}
+
+	info, err := bc.submit(req, r.URL.Query().Get("forwarded") != "")
+	if err != nil {
+		http.Error(w, pbft.JsonBodyPadding(err.Error()), http.StatusServiceUnavailable)
+		return
+	}
+
+	json.NewEncoder(w).Encode(info)
+}
+
+func (bc *Blockchain) Submit(requestId string, transactions []consensus.Transaction) (consensus.Receipt, error) {
+	// Request submitted through the shared API (see consensus/http.go) - there is no client to send the replies to.
+	info, err := bc.submit(pbft.Request{RequestId: requestId, Timestamp: int(time.Now().Unix()), Transactions: transactions}, false)
+	if err != nil {
+		return consensus.Receipt{}, err
+	}
+	return consensus.Receipt{RequestId: requestId, Status: "pending", BlockId: info.VotingData.BlockId}, nil
+}
+
+func (bc *Blockchain) submit(req pbft.Request, forwarded bool) (pbft.VotingInfo, error) {
+	// Appends the request to the leader's log, returns the block the request was assigned to.
+	bc.mutex.Lock()
+
+	if known, exists := bc.knownRequest(req.Client.Identifier, req.RequestId); exists {
+		// retransmitted request - repeat the reply if it has been applied already
+		if known.Reply.Result != "" {
+			go pbft.SendReply(req.Client, known.Reply)
+		}
+		info := known.Info
+		bc.mutex.Unlock()
+		return info, nil
+	}
+
+	if bc.role != leader {
+		leaderNode := bc.PeerById(bc.leader)
+		bc.mutex.Unlock()
+
+		if leaderNode == (pbft.Node{}) || forwarded {
+			// no leader elected yet, or the replicas disagree on the leader while the term changes
+			return pbft.VotingInfo{}, errors.New("no leader available, try again later")
+		}
+
+		// followers relay the request to the leader, which doesn't forward it any further
+		info, err := pbft.ForwardRequest(leaderNode, "request?forwarded=true", req)
+		if err != nil {
+			fmt.Println("[ERROR] failed to forward request to the leader:", err.Error())
+			return pbft.VotingInfo{}, errors.New("failed to forward request to the leader")
+		}
+		return info, nil
+	}
+
+	block := pbft.Block{Timestamp: int(time.Now().Unix()), Transactions: append([]pbft.Transaction{}, req.Transactions...)}
+	entry := bc.appendEntry(Entry{Block: block, Client: req.Client, RequestId: req.RequestId})
+	fmt.Println("[RAFT] Request, new entry:", entry.Index)
+
+	// a cluster of a single replica commits right away
+	bc.advanceCommit()
+	info := bc.votingInfo(entry)
+	bc.mutex.Unlock()
+
+	go bc.replicate()
+	return info, nil
+}
@@ -0,0 +1,212 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+Persistent state.
+The current term, the vote, the log and the snapshot are written to disk (and synced) before the replica answers
+a message that depends on them - a vote request, an append-entries request or a client request - so a restarted
+replica neither votes twice in a term nor forgets entries it has acknowledged. The term, the vote and the members
+(see membership.go) are kept in state.json, the entries after the snapshot in log.jsonl and the snapshot in
+snapshot.json. New entries are appended to log.jsonl, one JSON entry per line, the log is rewritten only when entries
+are removed (conflicting entries, compaction, an installed snapshot). Other files are replaced atomically (written to
+a temporary file, synced and renamed).
+The commit index isn't persisted, a restarted replica applies the entries after the snapshot again once it learns
+the commit index from the leader.
+*/
+
+const logFile = "log.jsonl"
+
+type persistentState struct {
+	Term         int      `json:"term"`
+	VotedFor     string   `json:"voted-for"`
+	Members      []string `json:"members"`
+	MembersIndex int      `json:"members-index"` // entry the members were taken from, 0 if initial
+}
+
+func writeFileSync(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// the rename itself has to be synced as well
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (bc *Blockchain) persist(file string, err error) {
+	// A replica that can't persist its state must not answer any further messages, so it stops - Raft tolerates
+	// crashed replicas.
+	if err != nil {
+		fmt.Println("[ERROR] failed to persist", file, "- stopping the replica:", err.Error())
+		os.Exit(1)
+	}
+}
+
+func (bc *Blockchain) save(file string, value interface{}) {
+	// Writes the value to the data directory. Called with the mutex held.
+	data, _ := json.Marshal(value)
+	bc.persist(file, writeFileSync(filepath.Join(bc.DataDir, file), data))
+}
+
+func (bc *Blockchain) saveState() {
+	bc.save("state.json", persistentState{Term: bc.term, VotedFor: bc.votedFor, Members: bc.members, MembersIndex: bc.membersIndex})
+}
+
+func encodeEntries(entries []Entry) []byte {
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		line, _ := json.Marshal(entry)
+		buffer.Write(append(line, '\n'))
+	}
+	return buffer.Bytes()
+}
+
+func (bc *Blockchain) appendLog(entries []Entry) {
+	// Appends entries added at the end of the log to the log file. Called with the mutex held.
+	if bc.logFile == nil {
+		bc.saveLog()
+		return
+	}
+
+	_, err := bc.logFile.Write(encodeEntries(entries))
+	if err == nil {
+		err = bc.logFile.Sync()
+	}
+	bc.persist(logFile, err)
+}
+
+func (bc *Blockchain) saveLog() {
+	// Rewrites the log file with the entries after the snapshot, used once entries are removed. Called with the mutex held.
+	path := filepath.Join(bc.DataDir, logFile)
+	bc.persist(logFile, writeFileSync(path, encodeEntries(bc.log)))
+
+	// the file was replaced, further entries are appended to the new one
+	if bc.logFile != nil {
+		bc.logFile.Close()
+	}
+	var err error
+	bc.logFile, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	bc.persist(logFile, err)
+}
+
+func (bc *Blockchain) saveSnapshot() {
+	bc.save("snapshot.json", bc.snapshot())
+}
+
+func load(path string, value interface{}) (bool, error) {
+	// Returns false if the file doesn't exist (first start).
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+func loadLog(path string) ([]Entry, error) {
+	// Returns the entries of the log file, without an entry the replica stopped writing in the middle of.
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// the last entry is complete only if it ends with a newline
+			return entries, nil
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func (bc *Blockchain) restore() error {
+	// Loads the state persisted before a restart, the chain has to be initialized with the genesis block.
+	if err := os.MkdirAll(bc.DataDir, 0700); err != nil {
+		return err
+	}
+
+	var state persistentState
+	if _, err := load(filepath.Join(bc.DataDir, "state.json"), &state); err != nil {
+		return fmt.Errorf("state.json: %v", err.Error())
+	}
+	bc.term, bc.votedFor = state.Term, state.VotedFor
+	bc.members, bc.membersIndex = state.Members, state.MembersIndex
+
+	var snapshot Snapshot
+	exists, err := load(filepath.Join(bc.DataDir, "snapshot.json"), &snapshot)
+	if err != nil {
+		return fmt.Errorf("snapshot.json: %v", err.Error())
+	}
+	if exists && len(snapshot.Chain) > 0 {
+		bc.Chain = snapshot.Chain
+		bc.snapshotIndex, bc.snapshotTerm = snapshot.LastIndex, snapshot.LastTerm
+		bc.commitIndex, bc.lastApplied = snapshot.LastIndex, snapshot.LastIndex
+		bc.restoreRequests(snapshot.Requests)
+		if snapshot.MembersIndex > bc.membersIndex && len(snapshot.Members) > 0 {
+			bc.members, bc.membersIndex = snapshot.Members, snapshot.MembersIndex
+		}
+	}
+
+	entries, err := loadLog(filepath.Join(bc.DataDir, logFile))
+	if err != nil {
+		return fmt.Errorf("%v: %v", logFile, err.Error())
+	}
+	for _, entry := range entries {
+		// the log may still contain entries compacted into the snapshot if the replica stopped in between
+		if entry.Index > bc.snapshotIndex {
+			bc.log = append(bc.log, entry)
+			bc.logRequest(entry)
+		}
+	}
+	bc.saveLog() // drops a partly written entry and opens the log file
+
+	bc.Reindex()
+	if bc.term > 0 {
+		fmt.Println("[RAFT] restored term", bc.term, "snapshot up to entry", bc.snapshotIndex, "and", len(bc.log), "log entries")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+HTTP transport shared by all components (replicas, client nodes, the connector and node discovery).
+Plain HTTP by default, mutual TLS if TLS_CERT, TLS_KEY and TLS_CA are set. Cluster listeners (ListenAndServe)
+require a client certificate signed by the CA, public listeners (ListenAndServePublic - the connector's API
+used by the web application) serve TLS without asking browsers for a certificate. Outgoing requests always
+present the node certificate.
+*/
+
+var (
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+	urlScheme  = "http"
+	serverTLS  *tls.Config
+	selfCert   *x509.Certificate
+)
+
+type Config struct {
+	CertFile string // node certificate (PEM)
+	KeyFile  string // node private key (PEM)
+	CAFile   string // CA certificate used to verify peers (PEM)
+}
+
+func ConfigFromEnv() *Config {
+	// Returns nil if TLS is not configured.
+	if os.Getenv("TLS_CERT") == "" {
+		return nil
+	}
+
+	return &Config{CertFile: os.Getenv("TLS_CERT"), KeyFile: os.Getenv("TLS_KEY"), CAFile: os.Getenv("TLS_CA")}
+}
+
+func EnableFromEnv() error {
+	conf := ConfigFromEnv()
+	if conf == nil {
+		return nil
+	}
+	return Enable(conf)
+}
+
+func Enable(conf *Config) error {
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	caPem, err := ioutil.ReadFile(conf.CAFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return errors.New("no CA certificates found in " + conf.CAFile)
+	}
+
+	selfCert, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	serverTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	httpClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool},
+		},
+	}
+	urlScheme = "https"
+
+	return nil
+}
+
+func Enabled() bool {
+	return serverTLS != nil
+}
+
+func Certificate() *x509.Certificate {
+	// Certificate of this node, nil if TLS is disabled.
+	return selfCert
+}
+
+func NodeURL(address string, endpoint string) string {
+	return fmt.Sprintf("%v://%v/%v", urlScheme, address, endpoint)
+}
+
+func Get(address string, endpoint string) (*http.Response, error) {
+	return httpClient.Get(NodeURL(address, endpoint))
+}
+
+func Post(address string, endpoint string, body []byte) (*http.Response, error) {
+	return httpClient.Post(NodeURL(address, endpoint), "application/json", bytes.NewBuffer(body))
+}
+
+func ClientWithTimeout(timeout time.Duration) *http.Client {
+	// Same transport as Get and Post, used for requests expected to take longer.
+	return &http.Client{Timeout: timeout, Transport: httpClient.Transport}
+}
+
+func ListenAndServe(port int, handler http.Handler) error {
+	if serverTLS == nil {
+		return http.ListenAndServe(fmt.Sprintf(":%v", port), handler)
+	}
+
+	server := &http.Server{Addr: fmt.Sprintf(":%v", port), Handler: handler, TLSConfig: serverTLS}
+	return server.ListenAndServeTLS("", "")
+}
+
+func ListenAndServePublic(port int, handler http.Handler) error {
+	if serverTLS == nil {
+		return http.ListenAndServe(fmt.Sprintf(":%v", port), handler)
+	}
+
+	public := &tls.Config{Certificates: serverTLS.Certificates}
+	server := &http.Server{Addr: fmt.Sprintf(":%v", port), Handler: handler, TLSConfig: public}
+	return server.ListenAndServeTLS("", "")
+}